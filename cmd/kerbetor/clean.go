@@ -0,0 +1,205 @@
+package kerbetor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/asabellico/kerbetor/pkg/kerbetor"
+	"github.com/dustin/go-humanize"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var cleanCmd = &cobra.Command{
+	Use:   "clean [path]...",
+	Short: "Remove stale download work directories and leftover TOR data directories",
+	Long: `Remove the download work directories (<file>.ktor) found under the given paths, the current
+directory by default, and the TOR data directories (ktor-tor-data*) left behind in them and in the
+temporary directory. Only work directories of completed downloads and those that cannot be resumed
+are removed, unless --keep-resumable=false is set. Directories used by a running kerbetor are never
+removed.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		olderThanStr, _ := cmd.Flags().GetString("older-than")
+		dryRun, _ := cmd.Flags().GetBool("dry-run")
+		keepResumable, _ := cmd.Flags().GetBool("keep-resumable")
+		olderThan, err := parseAge(olderThanStr)
+		if err != nil {
+			exitWithError(err)
+		}
+		if len(args) == 0 {
+			args = []string{"."}
+		}
+
+		var candidates []cleanCandidate
+		for _, root := range args {
+			workDirs, err := kerbetor.FindWorkDirs(root)
+			if err != nil {
+				exitWithError(err)
+			}
+			for _, workDir := range workDirs {
+				status, err := kerbetor.InspectWorkDir(workDir)
+				if err != nil {
+					logrus.Warn(err)
+					continue
+				}
+				if keepResumable && status.Resumable() && !fileExists(status.Output) {
+					logrus.Debug("Keeping resumable ", workDir)
+					continue
+				}
+				candidates = append(candidates, cleanCandidate{path: workDir, lastActivity: status.LastActivity})
+			}
+		}
+		torRoots := append([]string{os.TempDir()}, args...)
+		seen := make(map[string]bool)
+		for _, root := range torRoots {
+			torDataDirs, err := kerbetor.FindTorDataDirs(root)
+			if err != nil {
+				exitWithError(err)
+			}
+			for _, torDataDir := range torDataDirs {
+				absPath, _ := filepath.Abs(torDataDir)
+				if seen[absPath] {
+					continue
+				}
+				seen[absPath] = true
+				candidates = append(candidates, cleanCandidate{path: torDataDir, lastActivity: lastModified(torDataDir)})
+			}
+		}
+
+		var removed int
+		var freed uint64
+		failed := false
+		for _, candidate := range candidates {
+			if olderThan > 0 && time.Since(candidate.lastActivity) < olderThan {
+				logrus.Debug("Keeping recent ", candidate.path)
+				continue
+			}
+			size := dirSize(candidate.path)
+			if dryRun {
+				owner, err := kerbetor.DirOwner(candidate.path)
+				if err != nil {
+					logrus.Warn("Skipping ", candidate.path, ": ", err)
+					continue
+				}
+				if owner != nil {
+					logrus.Warn("Skipping ", candidate.path, ": in use by kerbetor (", owner, ")")
+					continue
+				}
+				fmt.Printf("Would remove %s (%s, last activity %s)\n", candidate.path, humanize.Bytes(size), humanize.Time(candidate.lastActivity))
+			} else {
+				err := removeUnlockedDir(candidate.path)
+				var lockedErr *kerbetor.DirLockedError
+				if errors.As(err, &lockedErr) {
+					logrus.Warn("Skipping ", candidate.path, ": in use by kerbetor (", lockedErr.Owner, ")")
+					continue
+				}
+				if err != nil {
+					logrus.Error("Cannot remove ", candidate.path, ": ", err)
+					failed = true
+					continue
+				}
+				fmt.Printf("Removed %s (%s, last activity %s)\n", candidate.path, humanize.Bytes(size), humanize.Time(candidate.lastActivity))
+			}
+			removed++
+			freed += size
+		}
+
+		if dryRun {
+			fmt.Printf("%d directories would be removed, freeing %s\n", removed, humanize.Bytes(freed))
+		} else {
+			fmt.Printf("%d directories removed, %s freed\n", removed, humanize.Bytes(freed))
+		}
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
+
+type cleanCandidate struct {
+	path         string
+	lastActivity time.Time
+}
+
+// removeUnlockedDir removes dir while holding its lock, so that no kerbetor starts using it in
+// the meantime. It returns a *kerbetor.DirLockedError if dir is in use.
+func removeUnlockedDir(dir string) error {
+	lock, err := kerbetor.LockDir(context.Background(), dir, false, logrus.StandardLogger())
+	if err != nil {
+		return err
+	}
+	err = os.RemoveAll(dir)
+	lock.Unlock()
+	if err != nil {
+		// Windows cannot remove the open lock file. A kerbetor taking the lock meanwhile holds
+		// the file open, which makes this second attempt fail too
+		err = os.RemoveAll(dir)
+	}
+	return err
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// parseAge parses a duration, accepting days as "7d" in addition to time.ParseDuration units.
+func parseAge(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	if days, found := strings.CutSuffix(value, "d"); found {
+		n, err := strconv.ParseFloat(days, 64)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid age %q", value)
+		}
+		return time.Duration(n * float64(24*time.Hour)), nil
+	}
+	age, err := time.ParseDuration(value)
+	if err != nil || age < 0 {
+		return 0, fmt.Errorf("invalid age %q", value)
+	}
+	return age, nil
+}
+
+// lastModified returns the latest modification time of dir and of the files it contains.
+func lastModified(dir string) time.Time {
+	var latest time.Time
+	filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info, err := entry.Info(); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+		return nil
+	})
+	return latest
+}
+
+func dirSize(dir string) uint64 {
+	var size uint64
+	filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return nil
+		}
+		if info, err := entry.Info(); err == nil {
+			size += uint64(info.Size())
+		}
+		return nil
+	})
+	return size
+}
+
+func init() {
+	cleanCmd.Flags().String("older-than", "", "only remove directories without activity for this long, e.g. 12h or 7d")
+	cleanCmd.Flags().Bool("dry-run", false, "only print what would be removed")
+	cleanCmd.Flags().Bool("keep-resumable", true, "keep work directories of unfinished downloads that can still be resumed, --keep-resumable=false removes them too")
+	rootCmd.AddCommand(cleanCmd)
+}
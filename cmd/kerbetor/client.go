@@ -0,0 +1,218 @@
+package kerbetor
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/asabellico/kerbetor/pkg/kerbetor"
+	"github.com/dustin/go-humanize"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var clientCmd = &cobra.Command{
+	Use:   "client",
+	Short: "Control a running kerbetor daemon",
+}
+
+var clientAddCmd = &cobra.Command{
+	Use:   "add <remote url>...",
+	Short: "Queue downloads",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		dir, _ := cmd.Flags().GetString("dir")
+		out, _ := cmd.Flags().GetString("output")
+		priority, _ := cmd.Flags().GetInt("priority")
+		if out != "" && len(args) > 1 {
+			exitWithError(fmt.Errorf("--output cannot be used with multiple URLs"))
+		}
+		checksums, err := checksumsFromFlags(cmd)
+		if err != nil {
+			exitWithError(err)
+		}
+		if len(checksums) > 0 && len(args) > 1 {
+			exitWithError(fmt.Errorf("checksum flags cannot be used with multiple URLs"))
+		}
+		mirrors, _ := cmd.Flags().GetStringArray("mirror")
+		if len(mirrors) > 0 && len(args) > 1 {
+			exitWithError(fmt.Errorf("--mirror cannot be used with multiple URLs"))
+		}
+
+		client := apiClientFromFlags(cmd)
+		var jobs []kerbetor.Job
+		for _, remoteUrl := range args {
+			job, err := client.AddJob(kerbetor.JobRequest{URL: remoteUrl, Mirrors: mirrors, Dir: dir, Out: out, Priority: priority, Checksums: checksums})
+			if err != nil {
+				exitWithError(err)
+			}
+			jobs = append(jobs, *job)
+		}
+		printJobs(cmd, jobs)
+	},
+}
+
+var clientListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the jobs of the daemon",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		jobs, err := apiClientFromFlags(cmd).Jobs()
+		if err != nil {
+			exitWithError(err)
+		}
+		printJobs(cmd, jobs)
+	},
+}
+
+var clientStatusCmd = &cobra.Command{
+	Use:   "status [job id]...",
+	Short: "Show the progress of jobs, or the daemon circuits when no job is given",
+	Run: func(cmd *cobra.Command, args []string) {
+		client := apiClientFromFlags(cmd)
+		if len(args) == 0 {
+			status, err := client.Status()
+			if err != nil {
+				exitWithError(err)
+			}
+			printDaemonStatus(cmd, status)
+			return
+		}
+		runJobCommand(cmd, args, client.Job)
+	},
+}
+
+var clientPauseCmd = &cobra.Command{
+	Use:   "pause <job id>...",
+	Short: "Pause jobs, keeping their progress",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runJobCommand(cmd, args, apiClientFromFlags(cmd).PauseJob)
+	},
+}
+
+var clientResumeCmd = &cobra.Command{
+	Use:   "resume <job id>...",
+	Short: "Resume paused or failed jobs",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runJobCommand(cmd, args, apiClientFromFlags(cmd).ResumeJob)
+	},
+}
+
+var clientCancelCmd = &cobra.Command{
+	Use:   "cancel <job id>...",
+	Short: "Cancel jobs and remove their partial data",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		runJobCommand(cmd, args, apiClientFromFlags(cmd).CancelJob)
+	},
+}
+
+var clientRemoveCmd = &cobra.Command{
+	Use:   "remove <job id>...",
+	Short: "Remove finished, paused or failed jobs from the list",
+	Args:  cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		client := apiClientFromFlags(cmd)
+		for _, id := range args {
+			if err := client.RemoveJob(id); err != nil {
+				exitWithError(err)
+			}
+		}
+	},
+}
+
+var clientPriorityCmd = &cobra.Command{
+	Use:   "priority <job id> <priority>",
+	Short: "Set the priority of a job, higher priorities start first",
+	Args:  cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		priority, err := strconv.Atoi(args[1])
+		if err != nil {
+			exitWithError(fmt.Errorf("invalid priority %q", args[1]))
+		}
+		job, err := apiClientFromFlags(cmd).SetJobPriority(args[0], priority)
+		if err != nil {
+			exitWithError(err)
+		}
+		printJobs(cmd, []kerbetor.Job{*job})
+	},
+}
+
+func apiClientFromFlags(cmd *cobra.Command) *kerbetor.APIClient {
+	address, _ := cmd.Flags().GetString("daemon")
+	if address == "" {
+		address = defaultDaemonAddress(defaultDaemonStateDir())
+	}
+	return kerbetor.NewAPIClient(address)
+}
+
+func runJobCommand(cmd *cobra.Command, ids []string, call func(id string) (*kerbetor.Job, error)) {
+	var jobs []kerbetor.Job
+	for _, id := range ids {
+		job, err := call(id)
+		if err != nil {
+			exitWithError(err)
+		}
+		jobs = append(jobs, *job)
+	}
+	printJobs(cmd, jobs)
+}
+
+func printJobs(cmd *cobra.Command, jobs []kerbetor.Job) {
+	if asJSON, _ := cmd.Flags().GetBool("json"); asJSON {
+		printJSON(jobs)
+		return
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTATUS\tPRIORITY\tPROGRESS\tSPEED\tOUTPUT")
+	for _, job := range jobs {
+		progress := humanize.Bytes(job.DownloadedBytes)
+		if job.TotalBytes > 0 {
+			progress = fmt.Sprintf("%s/%s (%.0f%%)", humanize.Bytes(job.DownloadedBytes), humanize.Bytes(job.TotalBytes), float64(job.DownloadedBytes)*100/float64(job.TotalBytes))
+		}
+		status := string(job.Status)
+		if job.Error != "" {
+			status += ": " + job.Error
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s/s\t%s\n", job.ID, status, job.Priority, progress, humanize.Bytes(job.Speed), job.Output)
+	}
+	w.Flush()
+}
+
+func printDaemonStatus(cmd *cobra.Command, status *kerbetor.APIStatus) {
+	if asJSON, _ := cmd.Flags().GetBool("json"); asJSON {
+		printJSON(status)
+		return
+	}
+	fmt.Println("kerbetor daemon", status.Version)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CIRCUIT\tTHROUGHPUT\tDOWNLOADED\tACTIVE\tERRORS\tRENEWALS")
+	for _, circuit := range status.Circuits {
+		fmt.Fprintf(w, "%s\t%s/s\t%s\t%d\t%d\t%d\n", circuit.Name, humanize.Bytes(uint64(circuit.Throughput)), humanize.Bytes(circuit.Bytes), circuit.Active, circuit.Errors, circuit.Renewals)
+	}
+	w.Flush()
+}
+
+func printJSON(value interface{}) {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(value)
+}
+
+func exitWithError(err error) {
+	logrus.Error(err)
+	os.Exit(1)
+}
+
+func init() {
+	clientCmd.PersistentFlags().String("daemon", "", "address of the daemon, \"unix:<socket path>\" or \"host:port\" (default unix socket in the default state directory)")
+	clientCmd.PersistentFlags().Bool("json", false, "print JSON")
+	clientAddCmd.Flags().String("dir", "", "directory of the downloaded file, inside the download directory of the daemon (default download directory of the daemon)")
+	clientAddCmd.Flags().Int("priority", 0, "priority of the job, higher priorities start first")
+	clientCmd.AddCommand(clientAddCmd, clientListCmd, clientStatusCmd, clientPauseCmd, clientResumeCmd, clientCancelCmd, clientRemoveCmd, clientPriorityCmd)
+	rootCmd.AddCommand(clientCmd)
+}
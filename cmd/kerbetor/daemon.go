@@ -0,0 +1,183 @@
+package kerbetor
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/asabellico/kerbetor/pkg/kerbetor"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+const daemonShutdownTimeout = 10 * time.Second
+
+var daemonCmd = &cobra.Command{
+	Use:   "daemon",
+	Short: "Run a download queue with warm TOR circuits, driven by a local JSON API",
+	Long: `Run kerbetor as a daemon: TOR circuits are bootstrapped once and shared by a persistent
+queue of downloads, controlled through an HTTP/JSON API on a unix socket or a localhost port
+(see "kerbetor client"). Download flags such as --tor-circuits and --chunk-size apply to every job.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		if verbose {
+			logrus.SetLevel(logrus.DebugLevel)
+		}
+
+		stateDir, _ := cmd.Flags().GetString("state-dir")
+		listen, _ := cmd.Flags().GetString("listen")
+		if listen == "" {
+			listen = defaultDaemonAddress(stateDir)
+		}
+		rpcListen, _ := cmd.Flags().GetString("rpc-listen")
+		rpcSecret, _ := cmd.Flags().GetString("rpc-secret")
+		if rpcSecret == "" {
+			rpcSecret = os.Getenv("KERBETOR_RPC_SECRET")
+		}
+		if rpcListen != "" && rpcSecret == "" {
+			logrus.Error("--rpc-listen requires --rpc-secret (or KERBETOR_RPC_SECRET): without it any local program could queue downloads")
+			os.Exit(1)
+		}
+		rpcAllowedOrigins, _ := cmd.Flags().GetStringArray("rpc-allow-origin")
+		downloadDir, _ := cmd.Flags().GetString("download-dir")
+		maxActive, _ := cmd.Flags().GetInt("max-active")
+		numTorCircuits, _ := cmd.Flags().GetUint("tor-circuits")
+		torConfig, err := torConfigFromFlags(cmd)
+		if err != nil {
+			logrus.Error(err)
+			os.Exit(1)
+		}
+		downloaderOpts, err := downloaderOptionsFromFlags(cmd)
+		if err != nil {
+			logrus.Error(err)
+			os.Exit(1)
+		}
+
+		listener, err := listenDaemon(listen)
+		if err != nil {
+			logrus.Error("Cannot listen on ", listen, ": ", err)
+			os.Exit(1)
+		}
+		defer listener.Close()
+		var rpcListener net.Listener
+		if rpcListen != "" {
+			rpcListener, err = net.Listen("tcp", rpcListen)
+			if err != nil {
+				logrus.Error("Cannot listen on ", rpcListen, ": ", err)
+				os.Exit(1)
+			}
+			defer rpcListener.Close()
+		}
+
+		ctx, stopSignals := interruptContext()
+		defer stopSignals()
+
+		var pool *kerbetor.CircuitPool
+		if numTorCircuits > 0 {
+			logrus.Info("Creating TOR circuits...")
+			pool, err = kerbetor.NewTorCircuitPool(ctx, numTorCircuits, torConfig, logrus.StandardLogger())
+			if err != nil {
+				logrus.Error("Cannot create tor circuits: ", err)
+				os.Exit(1)
+			}
+			defer pool.Close()
+		}
+
+		manager, err := kerbetor.NewJobManager(stateDir, downloadDir, maxActive, pool, logrus.StandardLogger(), downloaderOpts...)
+		if err != nil {
+			logrus.Error(err)
+			os.Exit(1)
+		}
+		defer manager.Close()
+
+		server := &http.Server{Handler: kerbetor.NewAPIHandler(manager)}
+		go func() {
+			if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logrus.Error("API server stopped: ", err)
+			}
+		}()
+		logrus.Info("kerbetor daemon listening on ", listen)
+
+		var rpcServer *http.Server
+		if rpcListener != nil {
+			rpcHandler, err := kerbetor.NewAria2RPCHandler(manager, rpcSecret, rpcAllowedOrigins, logrus.StandardLogger())
+			if err != nil {
+				logrus.Error(err)
+				os.Exit(1)
+			}
+			rpcServer = &http.Server{Handler: rpcHandler}
+			go func() {
+				if err := rpcServer.Serve(rpcListener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+					logrus.Error("aria2 RPC server stopped: ", err)
+				}
+			}()
+			logrus.Info("aria2 RPC listening on http://", rpcListener.Addr(), kerbetor.Aria2RPCPath)
+		}
+
+		<-ctx.Done()
+		logrus.Info("Shutting down ...")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), daemonShutdownTimeout)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+		if rpcServer != nil {
+			rpcServer.Shutdown(shutdownCtx)
+		}
+	},
+}
+
+// listenDaemon listens on address. A unix socket left behind by a previous daemon is replaced,
+// and the socket is only accessible to the current user.
+func listenDaemon(address string) (net.Listener, error) {
+	socketPath, isUnix := strings.CutPrefix(address, "unix:")
+	if isUnix {
+		if err := os.MkdirAll(filepath.Dir(socketPath), 0700); err != nil {
+			return nil, err
+		}
+		if _, err := kerbetor.NewAPIClient(address).Status(); err == nil {
+			return nil, errors.New("another kerbetor daemon is already running")
+		}
+		os.Remove(socketPath)
+	}
+	listener, err := kerbetor.ListenAPI(address)
+	if err != nil {
+		return nil, err
+	}
+	if isUnix {
+		os.Chmod(socketPath, 0600)
+	}
+	return listener, nil
+}
+
+func defaultDaemonStateDir() string {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return ".kerbetor"
+	}
+	return filepath.Join(configDir, "kerbetor")
+}
+
+// defaultDaemonAddress is a unix socket in the state directory, or a localhost port where unix
+// sockets are not available.
+func defaultDaemonAddress(stateDir string) string {
+	if runtime.GOOS == "windows" {
+		return "127.0.0.1:6801"
+	}
+	return "unix:" + filepath.Join(stateDir, "daemon.sock")
+}
+
+func init() {
+	daemonCmd.Flags().String("state-dir", defaultDaemonStateDir(), "directory holding the job queue")
+	daemonCmd.Flags().String("listen", "", "API address, \"unix:<socket path>\" or a localhost \"host:port\" (default unix socket in the state directory)")
+	daemonCmd.Flags().String("download-dir", ".", "default directory of downloaded files")
+	daemonCmd.Flags().String("rpc-listen", "", "also serve an aria2 compatible JSON-RPC API on this address, e.g. 127.0.0.1:6800, for aria2 front-ends")
+	daemonCmd.Flags().String("rpc-secret", "", "secret token of the aria2 JSON-RPC API, required with --rpc-listen (default from KERBETOR_RPC_SECRET)")
+	daemonCmd.Flags().StringArray("rpc-allow-origin", nil, "origin of a web front-end allowed to use the aria2 JSON-RPC API, e.g. http://localhost:8080, can be repeated")
+	daemonCmd.Flags().Int("max-active", 2, "number of jobs downloading at the same time")
+	rootCmd.AddCommand(daemonCmd)
+}
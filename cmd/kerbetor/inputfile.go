@@ -0,0 +1,304 @@
+package kerbetor
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/asabellico/kerbetor/pkg/kerbetor"
+)
+
+const (
+	// maxInputLineSize bounds the lines of text and JSON Lines input files.
+	maxInputLineSize = 1024 * 1024
+	// utf8BOM starts files saved by some editors and spreadsheets
+	utf8BOM = "\ufeff"
+)
+
+// inputEntry is a download listed in an input file.
+type inputEntry struct {
+	url       string
+	out       string
+	dir       string
+	checksums []kerbetor.Checksum
+	header    http.Header
+	mirrors   []string
+	// size and pieces come from metalinks, 0 and nil when unknown
+	size   uint64
+	pieces *kerbetor.PieceHashes
+}
+
+// inputRecord is a line of a JSON Lines input file.
+type inputRecord struct {
+	URL      string            `json:"url"`
+	Out      string            `json:"out"`
+	Dir      string            `json:"dir"`
+	SHA256   string            `json:"sha256"`
+	SHA512   string            `json:"sha512"`
+	MD5      string            `json:"md5"`
+	Checksum string            `json:"checksum"`
+	Headers  map[string]string `json:"headers"`
+	Mirrors  []string          `json:"mirrors"`
+}
+
+// readUrlsFromFile reads the downloads listed in an input file: JSON Lines for .jsonl and .ndjson
+// files, CSV for .csv files, metalinks for .meta4 and .metalink files, and the aria2 text format
+// otherwise.
+func readUrlsFromFile(filePath string) ([]inputEntry, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	switch strings.ToLower(filepath.Ext(filePath)) {
+	case ".jsonl", ".ndjson":
+		return readJSONLInput(file)
+	case ".csv":
+		return readCSVInput(file)
+	case ".meta4", ".metalink":
+		return readMetalinkInput(file)
+	}
+	return readTextInput(file)
+}
+
+// readTextInput reads one URL per line, optionally followed by whitespace separated checksums such
+// as "sha256=<digest>". As in aria2 input files, the indented "<option>=<value>" lines following
+// a URL set options of its download.
+func readTextInput(r io.Reader) ([]inputEntry, error) {
+	var entries []inputEntry
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxInputLineSize)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		rawLine := strings.TrimPrefix(scanner.Text(), utf8BOM)
+		line := strings.TrimSpace(rawLine)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if rawLine[0] == ' ' || rawLine[0] == '\t' {
+			if len(entries) == 0 {
+				return nil, fmt.Errorf("line %d: option %q before any URL", lineNumber, line)
+			}
+			name, value, found := strings.Cut(line, "=")
+			if !found {
+				return nil, fmt.Errorf("line %d: invalid option %q, expected <option>=<value>", lineNumber, line)
+			}
+			if err := entries[len(entries)-1].setOption(strings.TrimSpace(name), strings.TrimSpace(value)); err != nil {
+				return nil, fmt.Errorf("line %d: %s", lineNumber, err)
+			}
+			continue
+		}
+
+		fields := strings.Fields(line)
+		entry := inputEntry{url: fields[0]}
+		for _, field := range fields[1:] {
+			checksum, err := kerbetor.ParseChecksum(field)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", lineNumber, err)
+			}
+			entry.checksums = append(entry.checksums, checksum)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// readJSONLInput reads one JSON object per line, see inputRecord.
+func readJSONLInput(r io.Reader) ([]inputEntry, error) {
+	var entries []inputEntry
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxInputLineSize)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := strings.TrimSpace(strings.TrimPrefix(scanner.Text(), utf8BOM))
+		if line == "" {
+			continue
+		}
+		var record inputRecord
+		decoder := json.NewDecoder(strings.NewReader(line))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&record); err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNumber, err)
+		}
+		if record.URL == "" {
+			return nil, fmt.Errorf("line %d: missing url", lineNumber)
+		}
+
+		entry := inputEntry{url: record.URL}
+		options := [][2]string{
+			{"out", record.Out}, {"dir", record.Dir},
+			{"sha256", record.SHA256}, {"sha512", record.SHA512}, {"md5", record.MD5}, {"checksum", record.Checksum},
+		}
+		for name, value := range record.Headers {
+			options = append(options, [2]string{"header", name + ": " + value})
+		}
+		for _, mirror := range record.Mirrors {
+			options = append(options, [2]string{"mirror", mirror})
+		}
+		for _, option := range options {
+			if option[1] == "" {
+				continue
+			}
+			if err := entry.setOption(option[0], option[1]); err != nil {
+				return nil, fmt.Errorf("line %d: %s", lineNumber, err)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// readCSVInput reads a CSV file whose first row names the columns: url, and the options of the
+// text format. The header and mirror columns can be repeated; empty cells are ignored.
+func readCSVInput(r io.Reader) ([]inputEntry, error) {
+	reader := csv.NewReader(r)
+	reader.Comment = '#'
+	reader.TrimLeadingSpace = true
+	columns, err := reader.Read()
+	if err == io.EOF {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	urlColumn := -1
+	for idx, column := range columns {
+		columns[idx] = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(column, utf8BOM)))
+		if columns[idx] == "url" {
+			urlColumn = idx
+		}
+	}
+	if urlColumn < 0 {
+		return nil, fmt.Errorf("the first row must name the columns, including url")
+	}
+
+	var entries []inputEntry
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		lineNumber, _ := reader.FieldPos(0)
+		entry := inputEntry{url: strings.TrimSpace(record[urlColumn])}
+		if entry.url == "" {
+			return nil, fmt.Errorf("line %d: missing url", lineNumber)
+		}
+		for idx, value := range record {
+			value = strings.TrimSpace(value)
+			if idx == urlColumn || value == "" {
+				continue
+			}
+			if err := entry.setOption(columns[idx], value); err != nil {
+				return nil, fmt.Errorf("line %d: %s", lineNumber, err)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// readMetalinkInput reads the files of a metalink, each downloaded from all its URLs to the path
+// named by the metalink.
+func readMetalinkInput(r io.Reader) ([]inputEntry, error) {
+	metalink, err := kerbetor.ParseMetalink(r)
+	if err != nil {
+		return nil, err
+	}
+	var entries []inputEntry
+	for _, file := range metalink.Files {
+		entry := inputEntry{url: file.URLs[0], out: file.Name, mirrors: file.URLs[1:], size: file.Size, pieces: file.Pieces}
+		if file.Checksum != nil {
+			entry.checksums = append(entry.checksums, *file.Checksum)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// setOption sets an option of the download: out, dir, sha256, sha512, md5, checksum (aria2's
+// "sha-256=<digest>"), header ("<name>: <value>") or mirror.
+func (e *inputEntry) setOption(name string, value string) error {
+	if value == "" {
+		return fmt.Errorf("option %s has no value", name)
+	}
+	switch name {
+	case "out":
+		e.out = value
+	case "dir":
+		e.dir = value
+	case "sha256", "sha512", "md5":
+		checksum, err := kerbetor.NewChecksum(name, value)
+		if err != nil {
+			return err
+		}
+		e.checksums = append(e.checksums, checksum)
+	case "checksum":
+		algorithm, digest, found := strings.Cut(value, "=")
+		if !found {
+			return fmt.Errorf("invalid checksum %q, expected <algorithm>=<digest>", value)
+		}
+		// aria2 writes algorithms as sha-256
+		checksum, err := kerbetor.NewChecksum(strings.ReplaceAll(algorithm, "-", ""), digest)
+		if err != nil {
+			return err
+		}
+		e.checksums = append(e.checksums, checksum)
+	case "header":
+		headerName, headerValue, found := strings.Cut(value, ":")
+		if !found || strings.TrimSpace(headerName) == "" {
+			return fmt.Errorf("invalid header %q, expected <name>: <value>", value)
+		}
+		if e.header == nil {
+			e.header = make(http.Header)
+		}
+		e.header.Add(strings.TrimSpace(headerName), strings.TrimSpace(headerValue))
+	case "mirror":
+		if _, err := url.ParseRequestURI(value); err != nil {
+			return fmt.Errorf("invalid mirror %q", value)
+		}
+		e.mirrors = append(e.mirrors, value)
+	default:
+		return fmt.Errorf("unknown option %q", name)
+	}
+	return nil
+}
+
+// outputPath returns where the download is written according to its out and dir options. A
+// relative dir is taken inside the batch output directory outputDir, which may be empty.
+func (e *inputEntry) outputPath(outputDir string, index int) (string, error) {
+	dir := e.dir
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(outputDir, dir)
+	}
+	name := e.out
+	if name == "" {
+		name = defaultOutputName(e.url, index)
+	}
+	// out may name subdirectories, as metalink file names do
+	outputPath := filepath.Join(dir, name)
+	if parent := filepath.Dir(outputPath); parent != "." {
+		if err := os.MkdirAll(parent, 0755); err != nil {
+			return "", fmt.Errorf("cannot create output directory: %s", err)
+		}
+	}
+	return outputPath, nil
+}
@@ -0,0 +1,180 @@
+package kerbetor
+
+import (
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/asabellico/kerbetor/pkg/kerbetor"
+)
+
+var (
+	testSHA256 = strings.Repeat("ab", 32)
+	testMD5    = strings.Repeat("cd", 16)
+)
+
+type inputTest struct {
+	name  string
+	input string
+	want  []inputEntry
+}
+
+type inputErrorTest struct {
+	name  string
+	input string
+	// err is the start of the expected error, with its line number
+	err string
+}
+
+func runInputTests(t *testing.T, read func(io.Reader) ([]inputEntry, error), tests []inputTest, errorTests []inputErrorTest) {
+	t.Helper()
+	for _, test := range tests {
+		entries, err := read(strings.NewReader(test.input))
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(entries, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, entries, test.want)
+		}
+	}
+	for _, test := range errorTests {
+		entries, err := read(strings.NewReader(test.input))
+		if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+			t.Errorf("%s: got %+v, %v, want error %q", test.name, entries, err, test.err)
+		}
+	}
+}
+
+func TestReadTextInput(t *testing.T) {
+	runInputTests(t, readTextInput, []inputTest{
+		{
+			name:  "urls and checksums",
+			input: "http://a.onion/1.bin\nhttp://a.onion/2.bin sha256=" + testSHA256 + " md5=" + testMD5 + "\n",
+			want: []inputEntry{
+				{url: "http://a.onion/1.bin"},
+				{url: "http://a.onion/2.bin", checksums: []kerbetor.Checksum{{Algorithm: "sha256", Digest: testSHA256}, {Algorithm: "md5", Digest: testMD5}}},
+			},
+		},
+		{
+			name: "indented options",
+			input: "http://a.onion/1.bin\n" +
+				"  out=one.bin\n" +
+				"\tdir=sub\n" +
+				"  checksum=sha-256=" + testSHA256 + "\n" +
+				"  header=Cookie: session=1\n" +
+				"  header = Referer : http://a.onion/ \n" +
+				"  mirror=http://b.onion/1.bin\n" +
+				"http://a.onion/2.bin\n" +
+				"  out=two.bin\n",
+			want: []inputEntry{
+				{
+					url:       "http://a.onion/1.bin",
+					out:       "one.bin",
+					dir:       "sub",
+					checksums: []kerbetor.Checksum{{Algorithm: "sha256", Digest: testSHA256}},
+					header:    http.Header{"Cookie": {"session=1"}, "Referer": {"http://a.onion/"}},
+					mirrors:   []string{"http://b.onion/1.bin"},
+				},
+				{url: "http://a.onion/2.bin", out: "two.bin"},
+			},
+		},
+		{
+			name:  "bom and crlf",
+			input: "\ufeffhttp://a.onion/1.bin\r\n  out=one.bin\r\nhttp://a.onion/2.bin\r\n",
+			want:  []inputEntry{{url: "http://a.onion/1.bin", out: "one.bin"}, {url: "http://a.onion/2.bin"}},
+		},
+		{
+			name:  "blank and comment lines",
+			input: "# downloads\n\nhttp://a.onion/1.bin\n  # a comment between options\n\n  out=one.bin\n   \n#http://a.onion/2.bin\n",
+			want:  []inputEntry{{url: "http://a.onion/1.bin", out: "one.bin"}},
+		},
+		{
+			name:  "empty",
+			input: "\n# nothing\n",
+		},
+	}, []inputErrorTest{
+		{"unknown option", "http://a.onion/1.bin\n\n  split=4\n", `line 3: unknown option "split"`},
+		{"option without value", "http://a.onion/1.bin\n  out=\n", "line 2: option out has no value"},
+		{"option without equal sign", "http://a.onion/1.bin\n  out\n", "line 2: invalid option"},
+		{"option before url", "# list\n  out=one.bin\nhttp://a.onion/1.bin\n", "line 2: option"},
+		{"invalid checksum", "http://a.onion/1.bin\r\nhttp://a.onion/2.bin sha256=abcd\r\n", "line 2:"},
+		{"invalid header", "http://a.onion/1.bin\n  header=Cookie\n", "line 2: invalid header"},
+		{"invalid mirror", "http://a.onion/1.bin\n  mirror=b.onion\n", "line 2: invalid mirror"},
+	})
+}
+
+func TestReadJSONLInput(t *testing.T) {
+	runInputTests(t, readJSONLInput, []inputTest{
+		{
+			name: "records",
+			input: `{"url": "http://a.onion/1.bin", "out": "one.bin", "dir": "sub", "sha256": "` + testSHA256 + `"}` + "\n" +
+				`{"url": "http://a.onion/2.bin", "checksum": "md5=` + testMD5 + `", "headers": {"Cookie": "session=1"}, "mirrors": ["http://b.onion/2.bin"]}` + "\n",
+			want: []inputEntry{
+				{url: "http://a.onion/1.bin", out: "one.bin", dir: "sub", checksums: []kerbetor.Checksum{{Algorithm: "sha256", Digest: testSHA256}}},
+				{
+					url:       "http://a.onion/2.bin",
+					checksums: []kerbetor.Checksum{{Algorithm: "md5", Digest: testMD5}},
+					header:    http.Header{"Cookie": {"session=1"}},
+					mirrors:   []string{"http://b.onion/2.bin"},
+				},
+			},
+		},
+		{
+			name:  "bom, crlf and blank lines",
+			input: "\ufeff{\"url\": \"http://a.onion/1.bin\"}\r\n\r\n  \r\n{\"url\": \"http://a.onion/2.bin\"}\r\n",
+			want:  []inputEntry{{url: "http://a.onion/1.bin"}, {url: "http://a.onion/2.bin"}},
+		},
+	}, []inputErrorTest{
+		{"malformed json", "{\"url\": \"http://a.onion/1.bin\"}\n\n{\"url\": \"http://a.onion/2.bin\"\n", "line 3:"},
+		{"not an object", "[\"http://a.onion/1.bin\"]\n", "line 1:"},
+		{"unknown field", "{\"url\": \"http://a.onion/1.bin\", \"split\": 4}\n", `line 1: json: unknown field "split"`},
+		{"missing url", "{\"url\": \"http://a.onion/1.bin\"}\n{\"out\": \"two.bin\"}\n", "line 2: missing url"},
+		{"invalid checksum", "{\"url\": \"http://a.onion/1.bin\", \"md5\": \"abcd\"}\n", "line 1:"},
+		{"invalid mirror", "\n{\"url\": \"http://a.onion/1.bin\", \"mirrors\": [\"b.onion\"]}\n", "line 2: invalid mirror"},
+	})
+}
+
+func TestReadCSVInput(t *testing.T) {
+	runInputTests(t, readCSVInput, []inputTest{
+		{
+			name: "columns",
+			input: "url,out,sha256,header,header,mirror\n" +
+				"http://a.onion/1.bin,one.bin," + testSHA256 + ",Cookie: session=1,Referer: http://a.onion/,http://b.onion/1.bin\n" +
+				"http://a.onion/2.bin,,,,,\n",
+			want: []inputEntry{
+				{
+					url:       "http://a.onion/1.bin",
+					out:       "one.bin",
+					checksums: []kerbetor.Checksum{{Algorithm: "sha256", Digest: testSHA256}},
+					header:    http.Header{"Cookie": {"session=1"}, "Referer": {"http://a.onion/"}},
+					mirrors:   []string{"http://b.onion/1.bin"},
+				},
+				{url: "http://a.onion/2.bin"},
+			},
+		},
+		{
+			name:  "bom, crlf, case and quotes",
+			input: "\ufeffOut, URL\r\n\"one, two.bin\", http://a.onion/1.bin\r\n",
+			want:  []inputEntry{{url: "http://a.onion/1.bin", out: "one, two.bin"}},
+		},
+		{
+			name:  "blank and comment lines",
+			input: "# downloads\nurl,dir\n\n# http://a.onion/0.bin,sub\nhttp://a.onion/1.bin,sub\n\n",
+			want:  []inputEntry{{url: "http://a.onion/1.bin", dir: "sub"}},
+		},
+		{
+			name:  "empty",
+			input: "",
+		},
+	}, []inputErrorTest{
+		{"no url column", "out,dir\none.bin,sub\n", "the first row must name the columns"},
+		{"unknown column", "url,split\nhttp://a.onion/1.bin,4\n", `line 2: unknown option "split"`},
+		{"missing url", "url,out\nhttp://a.onion/1.bin,one.bin\n\n,two.bin\n", "line 4: missing url"},
+		{"wrong number of fields", "url,out\nhttp://a.onion/1.bin,one.bin\nhttp://a.onion/2.bin\n", "record on line 3: wrong number of fields"},
+		{"unterminated quote", "url,out\nhttp://a.onion/1.bin,\"one.bin\n", "parse error on line 2"},
+		{"invalid checksum", "url,md5\r\nhttp://a.onion/1.bin,abcd\r\n", "line 2:"},
+	})
+}
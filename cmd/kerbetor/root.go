@@ -1,23 +1,27 @@
 package kerbetor
 
 import (
-	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"net"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/asabellico/kerbetor/pkg/kerbetor"
 	"github.com/dustin/go-humanize"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"github.com/vbauerster/mpb/v8"
 )
 
 var verbose bool
 var rootCmd = &cobra.Command{
-	Use:   "kerbetor [flags] <remote url>",
+	Use:   "kerbetor [flags] <remote url> [mirror url]...",
 	Short: "kerbetor - a download manager for the dark web",
 	Long: `kerbetor is a download manager for the dark web. 
 	
@@ -30,8 +34,8 @@ It is a CLI tool that can be used to download files from TOR concurrently, using
 			}
 			return nil
 		}
-		if len(args) != 1 {
-			return fmt.Errorf("requires a single remote url argument")
+		if len(args) == 0 {
+			return fmt.Errorf("requires a remote url argument")
 		}
 		return nil
 	},
@@ -42,77 +46,105 @@ It is a CLI tool that can be used to download files from TOR concurrently, using
 
 		output, _ := cmd.Flags().GetString("output")
 		inputFile, _ := cmd.Flags().GetString("input-file")
-		chunkSizeStr, _ := cmd.Flags().GetString("chunk-size")
-		chunkCount, _ := cmd.Flags().GetUint("chunks")
-		if chunkCount > 0 && cmd.Flags().Changed("chunk-size") {
-			logrus.Error("Cannot set both --chunks and --chunk-size")
+		checksums, err := checksumsFromFlags(cmd)
+		if err != nil {
+			logrus.Error(err)
 			os.Exit(1)
 		}
-		chunkSize, err := humanize.ParseBytes(chunkSizeStr)
+		downloaderOpts, err := downloaderOptionsFromFlags(cmd)
 		if err != nil {
-			logrus.Error("Cannot parse chunk size:", err)
+			logrus.Error(err)
 			os.Exit(1)
 		}
-		maxConcurrentDownloads, _ := cmd.Flags().GetUint("parallel-downloads")
-		numTorCircuits, _ := cmd.Flags().GetUint("tor-circuits")
 
-		if chunkCount > 0 {
-			logrus.Info("Chunk count: ", chunkCount)
-			logrus.Info("Chunk size: auto (from --chunks)")
-		} else {
-			logrus.Info("Chunk size: ", humanize.Bytes(chunkSize))
-		}
-		logrus.Info("Max concurrent downloads: ", maxConcurrentDownloads)
-		logrus.Info("Number of TOR circuits: ", numTorCircuits)
+		ctx, stopSignals := interruptContext()
+		defer stopSignals()
 
 		if inputFile != "" {
-			remoteUrls, err := readUrlsFromFile(inputFile)
+			entries, err := readUrlsFromFile(inputFile)
 			if err != nil {
 				logrus.Error("Cannot read input file: ", err)
 				os.Exit(1)
 			}
-			if len(remoteUrls) == 0 {
+			if len(entries) == 0 {
 				logrus.Error("Input file contains no URLs")
 				os.Exit(1)
 			}
+			if mirrors, _ := cmd.Flags().GetStringArray("mirror"); len(mirrors) > 0 {
+				logrus.Error("--mirror cannot be used with --input-file, set mirror= per URL in the input file")
+				os.Exit(1)
+			}
+			if len(checksums) > 0 && len(entries) > 1 {
+				logrus.Error("Checksum flags cannot be used with multiple URLs, set them per line in the input file")
+				os.Exit(1)
+			}
 
-			outputDir, useOutputAsFile, err := resolveOutputForBatch(output, len(remoteUrls))
+			outputDir, useOutputAsFile, err := resolveOutputForBatch(output, len(entries))
 			if err != nil {
 				logrus.Error(err)
 				os.Exit(1)
 			}
-
-			downloaded := 0
-			downloadErrors := 0
-			for idx, remoteUrl := range remoteUrls {
+			jobs := make([]batchJob, len(entries))
+			for idx, entry := range entries {
 				outputPath := output
 				if outputDir != "" {
-					outputPath = buildOutputPath(outputDir, remoteUrl, idx)
+					outputPath = buildOutputPath(outputDir, entry.url, idx)
 				} else if outputPath == "" || !useOutputAsFile {
-					outputPath = buildOutputPath("", remoteUrl, idx)
+					outputPath = buildOutputPath("", entry.url, idx)
 				}
-				logrus.Info("Downloading ", remoteUrl, ". Writing output to: ", outputPath)
-				errDownload := kerbetor.ConcurrentFileDownload(remoteUrl, outputPath, chunkSize, maxConcurrentDownloads, numTorCircuits, chunkCount)
-				if errDownload != nil {
-					logrus.Error(errDownload)
-					downloadErrors++
-				} else {
-					downloaded++
+				// an output file given for a single URL takes precedence over its out and dir
+				if (entry.out != "" || entry.dir != "") && !useOutputAsFile {
+					outputPath, err = entry.outputPath(outputDir, idx)
+					if err != nil {
+						logrus.Error(err)
+						os.Exit(1)
+					}
+				}
+				opts := withChecksums(downloaderOpts, append(checksums, entry.checksums...))
+				if entry.header != nil {
+					opts = append(opts, kerbetor.WithHeader(entry.header))
+				}
+				if len(entry.mirrors) > 0 {
+					opts = append(opts, kerbetor.WithMirrors(entry.mirrors...))
+				}
+				if entry.size > 0 {
+					opts = append(opts, kerbetor.WithFileSize(entry.size))
+				}
+				if entry.pieces != nil {
+					opts = append(opts, kerbetor.WithPieceHashes(entry.pieces))
 				}
+				jobs[idx] = batchJob{url: entry.url, output: outputPath, opts: opts}
+			}
+
+			downloaded, downloadErrors, err := downloadBatch(ctx, cmd, jobs)
+			if err != nil {
+				logrus.Error(err)
+				os.Exit(1)
+			}
+			logDownloadSummary(len(entries), downloaded, downloadErrors)
+			if downloaded+downloadErrors < len(jobs) {
+				exitIfPaused(ctx)
 			}
-			logDownloadSummary(len(remoteUrls), downloaded, downloadErrors)
 			return
 		}
 
+		// further arguments are mirrors of the same file
 		remoteUrl := args[0]
+		mirrors, _ := cmd.Flags().GetStringArray("mirror")
+		mirrors = append(append([]string{}, args[1:]...), mirrors...)
 		if output == "" {
 			output = buildOutputPath("", remoteUrl, 0)
 		}
 		logrus.Info("Downloading ", remoteUrl, ". Writing output to: ", output)
 		downloaded := 0
 		downloadErrors := 0
-		errDownload := kerbetor.ConcurrentFileDownload(remoteUrl, output, chunkSize, maxConcurrentDownloads, numTorCircuits, chunkCount)
+		opts := withChecksums(downloaderOpts, checksums)
+		if len(mirrors) > 0 {
+			opts = append(opts, kerbetor.WithMirrors(mirrors...))
+		}
+		errDownload := downloadFile(ctx, remoteUrl, output, opts)
 		if errDownload != nil {
+			exitIfPaused(ctx)
 			logrus.Error(errDownload)
 			downloadErrors++
 		} else {
@@ -126,10 +158,25 @@ func init() {
 	rootCmd.PersistentFlags().StringP("output", "o", "", "downloaded file output path")
 	rootCmd.PersistentFlags().UintP("parallel-downloads", "p", 3, "number of parallel downloads")
 	rootCmd.PersistentFlags().UintP("tor-circuits", "c", 1, "number of TOR circuits to use")
+	rootCmd.PersistentFlags().String("tor-mode", kerbetor.TorModeProcess, "how TOR circuits are created: \"process\" starts a TOR process per circuit, \"shared\" a single TOR process with an isolated SOCKS port per circuit")
+	rootCmd.PersistentFlags().Bool("tor-cache", false, "cache TOR directory information between runs in $XDG_CACHE_HOME/kerbetor/tor to speed up bootstrap")
+	rootCmd.PersistentFlags().String("tor-cache-dir", "", "cache TOR directory information between runs in this directory (implies --tor-cache)")
+	rootCmd.PersistentFlags().Duration("tor-bootstrap-timeout", kerbetor.DefaultTorBootstrapTimeout, "maximum time to wait for each TOR circuit to bootstrap (0 to wait forever)")
+	rootCmd.PersistentFlags().StringArray("tor-socks", nil, "SOCKS address (host:port) of a running TOR to use instead of starting TOR processes, can be repeated (default from TOR_SOCKS_HOST/TOR_SOCKS_PORT)")
+	rootCmd.PersistentFlags().String("tor-control", "", "control port address (host:port) of the running TOR set with --tor-socks")
 	rootCmd.PersistentFlags().StringP("chunk-size", "s", "100mb", "chunk size")
 	rootCmd.PersistentFlags().UintP("chunks", "n", 0, "number of chunks (overrides --chunk-size)")
-	rootCmd.PersistentFlags().StringP("input-file", "i", "", "path to a text file with one URL per line")
-	rootCmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "verbose output")
+	rootCmd.PersistentFlags().StringP("input-file", "i", "", "path to a file listing the URLs to download: one URL per line with optional indented options, .jsonl, .csv, or a .meta4 or .metalink metalink")
+	rootCmd.PersistentFlags().Uint("parallel-files", 1, "number of files of --input-file downloaded at the same time, sharing the TOR circuits")
+	rootCmd.PersistentFlags().String("whole-file-size", "16mb", "files of --input-file up to this size are downloaded in a single chunk instead of being split (0 to always split)")
+	rootCmd.PersistentFlags().StringArray("mirror", nil, "URL of a mirror serving the same file, can be repeated")
+	rootCmd.PersistentFlags().Bool("restart-on-change", false, "restart the download from scratch if the remote file changed since it was started")
+	rootCmd.PersistentFlags().String("sha256", "", "expected SHA-256 digest of the downloaded file")
+	rootCmd.PersistentFlags().String("sha512", "", "expected SHA-512 digest of the downloaded file")
+	rootCmd.PersistentFlags().String("md5", "", "expected MD5 digest of the downloaded file")
+	rootCmd.PersistentFlags().Bool("wait-for-lock", false, "wait for another kerbetor downloading the same file to finish instead of failing")
+	rootCmd.PersistentFlags().Bool("write-checksum", false, "write a <file>.sha256 checksum file next to each download")
+	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "verbose output")
 }
 
 func Execute() {
@@ -138,26 +185,240 @@ func Execute() {
 	}
 }
 
-func readUrlsFromFile(filePath string) ([]string, error) {
-	file, err := os.Open(filePath)
+// downloaderOptionsFromFlags returns the Downloader options set by the command line flags.
+func downloaderOptionsFromFlags(cmd *cobra.Command) ([]kerbetor.Option, error) {
+	chunkSizeStr, _ := cmd.Flags().GetString("chunk-size")
+	chunkCount, _ := cmd.Flags().GetUint("chunks")
+	if chunkCount > 0 && cmd.Flags().Changed("chunk-size") {
+		return nil, fmt.Errorf("Cannot set both --chunks and --chunk-size")
+	}
+	chunkSize, err := humanize.ParseBytes(chunkSizeStr)
+	if err != nil {
+		return nil, fmt.Errorf("Cannot parse chunk size: %s", err)
+	}
+	maxConcurrentDownloads, _ := cmd.Flags().GetUint("parallel-downloads")
+	numTorCircuits, _ := cmd.Flags().GetUint("tor-circuits")
+	torConfig, err := torConfigFromFlags(cmd)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
+	restartOnChange, _ := cmd.Flags().GetBool("restart-on-change")
+	writeChecksum, _ := cmd.Flags().GetBool("write-checksum")
+	waitForLock, _ := cmd.Flags().GetBool("wait-for-lock")
 
-	var urls []string
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" || strings.HasPrefix(line, "#") {
-			continue
+	if chunkCount > 0 {
+		logrus.Info("Chunk count: ", chunkCount)
+		logrus.Info("Chunk size: auto (from --chunks)")
+	} else {
+		logrus.Info("Chunk size: ", humanize.Bytes(chunkSize))
+	}
+	logrus.Info("Max concurrent downloads: ", maxConcurrentDownloads)
+	logrus.Info("Number of TOR circuits: ", numTorCircuits)
+	if len(torConfig.SOCKSAddrs) > 0 {
+		logrus.Info("Using external TOR: ", strings.Join(torConfig.SOCKSAddrs, ", "))
+	}
+
+	return []kerbetor.Option{
+		kerbetor.WithChunkSize(chunkSize),
+		kerbetor.WithChunkCount(chunkCount),
+		kerbetor.WithWorkers(maxConcurrentDownloads),
+		kerbetor.WithTorCircuits(numTorCircuits),
+		kerbetor.WithBootstrapTimeout(torConfig.BootstrapTimeout),
+		kerbetor.WithTorMode(torConfig.Mode),
+		kerbetor.WithTorCacheDir(torConfig.CacheDir),
+		kerbetor.WithExternalTor(torConfig.SOCKSAddrs, torConfig.ControlAddr, torConfig.ControlPassword),
+		kerbetor.WithRestartOnChange(restartOnChange),
+		kerbetor.WithChecksumSidecar(writeChecksum),
+		kerbetor.WithWaitForLock(waitForLock),
+	}, nil
+}
+
+// torConfigFromFlags returns the TOR settings of the command line flags.
+func torConfigFromFlags(cmd *cobra.Command) (kerbetor.TorConfig, error) {
+	bootstrapTimeout, _ := cmd.Flags().GetDuration("tor-bootstrap-timeout")
+	torSocks := torSocksFromFlags(cmd)
+	torControl, _ := cmd.Flags().GetString("tor-control")
+	torMode, _ := cmd.Flags().GetString("tor-mode")
+	// the cache leaves traces of tor use on disk, only when asked for
+	torCache, _ := cmd.Flags().GetBool("tor-cache")
+	torCacheDir, _ := cmd.Flags().GetString("tor-cache-dir")
+	if torCache && torCacheDir == "" {
+		var err error
+		if torCacheDir, err = kerbetor.DefaultTorCacheDir(); err != nil {
+			return kerbetor.TorConfig{}, fmt.Errorf("cannot find the TOR cache directory: %s", err)
 		}
-		urls = append(urls, line)
 	}
-	if err := scanner.Err(); err != nil {
-		return nil, err
+	if torMode != kerbetor.TorModeProcess && torMode != kerbetor.TorModeShared {
+		return kerbetor.TorConfig{}, fmt.Errorf("Invalid --tor-mode %s, expected %s or %s", torMode, kerbetor.TorModeProcess, kerbetor.TorModeShared)
+	}
+	if torControl != "" && len(torSocks) == 0 {
+		return kerbetor.TorConfig{}, fmt.Errorf("--tor-control requires --tor-socks")
+	}
+	return kerbetor.TorConfig{
+		BootstrapTimeout: bootstrapTimeout,
+		Mode:             torMode,
+		CacheDir:         torCacheDir,
+		SOCKSAddrs:       torSocks,
+		ControlAddr:      torControl,
+		ControlPassword:  os.Getenv("TOR_CONTROL_PASSWD"),
+	}, nil
+}
+
+// downloadFile downloads remoteUrl to outputPath, drawing progress bars on the terminal unless
+// downloaderOpts set another progress sink.
+func downloadFile(ctx context.Context, remoteUrl string, outputPath string, downloaderOpts []kerbetor.Option) error {
+	opts := []kerbetor.Option{kerbetor.WithProgress(kerbetor.NewBarProgress(nil))}
+	opts = append(opts, downloaderOpts...)
+	_, err := kerbetor.NewDownloader(opts...).Download(ctx, remoteUrl, outputPath)
+	var lockedErr *kerbetor.DirLockedError
+	if errors.As(err, &lockedErr) {
+		return fmt.Errorf("%s. Use --wait-for-lock to wait for it", err)
+	}
+	return err
+}
+
+type batchJob struct {
+	url    string
+	output string
+	opts   []kerbetor.Option
+}
+
+// downloadBatch downloads the files of an input file, --parallel-files at a time. The files share
+// one pool of TOR circuits, bootstrapped once for the whole batch. It returns the number of files
+// downloaded and failed; files interrupted or not started because ctx was cancelled are not counted.
+func downloadBatch(ctx context.Context, cmd *cobra.Command, jobs []batchJob) (int, int, error) {
+	parallelFiles, _ := cmd.Flags().GetUint("parallel-files")
+	if parallelFiles == 0 {
+		return 0, 0, fmt.Errorf("--parallel-files cannot be 0")
+	}
+	wholeFileSizeStr, _ := cmd.Flags().GetString("whole-file-size")
+	wholeFileSize, err := humanize.ParseBytes(wholeFileSizeStr)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Cannot parse whole file size: %s", err)
+	}
+	commonOpts := []kerbetor.Option{kerbetor.WithWholeFileSize(wholeFileSize)}
+
+	numTorCircuits, _ := cmd.Flags().GetUint("tor-circuits")
+	if numTorCircuits > 0 && len(jobs) > 1 {
+		torConfig, err := torConfigFromFlags(cmd)
+		if err != nil {
+			return 0, 0, err
+		}
+		logrus.Info("Creating TOR circuits...")
+		pool, err := kerbetor.NewTorCircuitPool(ctx, numTorCircuits, torConfig, logrus.StandardLogger())
+		if err != nil {
+			if ctx.Err() != nil {
+				return 0, 0, nil
+			}
+			return 0, 0, fmt.Errorf("Cannot create tor circuits: %s", err)
+		}
+		defer pool.Close()
+		commonOpts = append(commonOpts, kerbetor.WithCircuitPool(pool))
+	}
+
+	// with several files at a time, each file gets a single bar in a shared container
+	var progress *mpb.Progress
+	if parallelFiles > 1 {
+		progress = kerbetor.NewProgressContainer()
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	downloaded, downloadErrors := 0, 0
+	next := make(chan batchJob)
+	for i := uint(0); i < parallelFiles && i < uint(len(jobs)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range next {
+				opts := append(append([]kerbetor.Option{}, job.opts...), commonOpts...)
+				if progress != nil {
+					opts = append(opts, kerbetor.WithProgress(kerbetor.NewFileBarProgress(progress, filepath.Base(job.output))))
+				}
+				logrus.Info("Downloading ", job.url, ". Writing output to: ", job.output)
+				errDownload := downloadFile(ctx, job.url, job.output, opts)
+				if errDownload != nil && ctx.Err() != nil {
+					// paused, neither downloaded nor failed
+					continue
+				}
+				mu.Lock()
+				if errDownload != nil {
+					logrus.Error(errDownload)
+					downloadErrors++
+				} else {
+					downloaded++
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+feed:
+	for _, job := range jobs {
+		select {
+		case next <- job:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(next)
+	wg.Wait()
+	if progress != nil {
+		progress.Wait()
+	}
+	return downloaded, downloadErrors, nil
+}
+
+// exitIfPaused exits with exitCodePaused when the downloads were interrupted by a signal.
+func exitIfPaused(ctx context.Context) {
+	if ctx.Err() == nil {
+		return
+	}
+	logrus.Info("Download paused. Run the same command again to resume it")
+	os.Exit(exitCodePaused)
+}
+
+// torSocksFromFlags returns the --tor-socks addresses, falling back to the TOR_SOCKS_HOST and
+// TOR_SOCKS_PORT environment variables used by Whonix and Tails.
+func torSocksFromFlags(cmd *cobra.Command) []string {
+	torSocks, _ := cmd.Flags().GetStringArray("tor-socks")
+	if len(torSocks) > 0 {
+		return torSocks
+	}
+	host, port := os.Getenv("TOR_SOCKS_HOST"), os.Getenv("TOR_SOCKS_PORT")
+	if host == "" && port == "" {
+		return nil
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	if port == "" {
+		port = "9050"
+	}
+	return []string{net.JoinHostPort(host, port)}
+}
+
+func withChecksums(downloaderOpts []kerbetor.Option, checksums []kerbetor.Checksum) []kerbetor.Option {
+	opts := append([]kerbetor.Option{}, downloaderOpts...)
+	for _, checksum := range checksums {
+		opts = append(opts, kerbetor.WithChecksum(checksum))
+	}
+	return opts
+}
+
+func checksumsFromFlags(cmd *cobra.Command) ([]kerbetor.Checksum, error) {
+	var checksums []kerbetor.Checksum
+	for _, algorithm := range []string{"sha256", "sha512", "md5"} {
+		digest, _ := cmd.Flags().GetString(algorithm)
+		if digest == "" {
+			continue
+		}
+		checksum, err := kerbetor.NewChecksum(algorithm, digest)
+		if err != nil {
+			return nil, err
+		}
+		checksums = append(checksums, checksum)
 	}
-	return urls, nil
+	return checksums, nil
 }
 
 func resolveOutputForBatch(output string, urlCount int) (string, bool, error) {
@@ -0,0 +1,53 @@
+package kerbetor
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/asabellico/kerbetor/pkg/kerbetor"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// exitCodePaused is returned when downloads were interrupted by a signal and can be
+	// resumed by running the same command again.
+	exitCodePaused = 3
+	// exitCodeForced is returned when a second signal interrupts the shutdown.
+	exitCodeForced = 130
+)
+
+// interruptContext returns a context cancelled on the first SIGINT or SIGTERM, which stops the
+// downloads and leaves them resumable. A second signal exits immediately, killing the tor
+// processes, which run in their own process group and do not get the signal.
+// The returned function stops listening for signals.
+func interruptContext() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+
+	go func() {
+		select {
+		case sig := <-signals:
+			logrus.Warn("Received ", sig, ", pausing downloads. Interrupt again to exit immediately")
+			cancel()
+		case <-done:
+			return
+		}
+		select {
+		case sig := <-signals:
+			logrus.Error("Received ", sig, " again, killing tor and exiting")
+			kerbetor.KillTorProcesses()
+			os.Exit(exitCodeForced)
+		case <-done:
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(signals)
+		close(done)
+		cancel()
+	}
+}
@@ -0,0 +1,72 @@
+package kerbetor
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/asabellico/kerbetor/pkg/kerbetor"
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+)
+
+var statusCmd = &cobra.Command{
+	Use:   "status [path]...",
+	Short: "Show the state of interrupted downloads",
+	Long: `Find download work directories (<file>.ktor) under the given paths, the current directory by
+default, and report their progress and any problem that would prevent resuming them. A path can
+also be a work directory or the output path of a download.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 {
+			args = []string{"."}
+		}
+		var statuses []*kerbetor.WorkDirStatus
+		for _, root := range args {
+			workDirs, err := kerbetor.FindWorkDirs(root)
+			if err != nil {
+				exitWithError(err)
+			}
+			for _, workDir := range workDirs {
+				status, err := kerbetor.InspectWorkDir(workDir)
+				if err != nil {
+					exitWithError(err)
+				}
+				statuses = append(statuses, status)
+			}
+		}
+
+		if asJSON, _ := cmd.Flags().GetBool("json"); asJSON {
+			if statuses == nil {
+				statuses = []*kerbetor.WorkDirStatus{}
+			}
+			printJSON(statuses)
+			return
+		}
+		if len(statuses) == 0 {
+			fmt.Println("No interrupted downloads found")
+			return
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "WORK DIR\tPROGRESS\tCHUNKS\tLAST ACTIVITY\tURL")
+		for _, status := range statuses {
+			progress := humanize.Bytes(status.DownloadedBytes)
+			if status.FileSize > 0 {
+				progress = fmt.Sprintf("%s/%s (%.1f%%)", humanize.Bytes(status.DownloadedBytes), humanize.Bytes(status.FileSize), status.Percent)
+			}
+			chunks := fmt.Sprintf("%d/%d done, %d partial", status.CompletedChunks, status.Chunks, status.PartialChunks)
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", status.Path, progress, chunks, humanize.Time(status.LastActivity), status.URL)
+		}
+		w.Flush()
+
+		for _, status := range statuses {
+			for _, problem := range status.Problems {
+				fmt.Printf("! %s: %s\n", status.Path, problem)
+			}
+		}
+	},
+}
+
+func init() {
+	statusCmd.Flags().Bool("json", false, "print JSON")
+	rootCmd.AddCommand(statusCmd)
+}
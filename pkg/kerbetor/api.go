@@ -0,0 +1,264 @@
+package kerbetor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// APIStatus is returned by GET /v1/status.
+type APIStatus struct {
+	Version  string         `json:"version"`
+	Circuits []CircuitStats `json:"circuits"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+type apiPriority struct {
+	Priority int `json:"priority"`
+}
+
+// NewAPIHandler returns the HTTP/JSON API of the daemon, driving m:
+//
+//	GET    /v1/status               daemon version and circuit statistics
+//	GET    /v1/jobs                 list jobs
+//	POST   /v1/jobs                 add a job (JobRequest)
+//	GET    /v1/jobs/{id}            job status and progress
+//	DELETE /v1/jobs/{id}            forget a finished job
+//	POST   /v1/jobs/{id}/pause      pause a job
+//	POST   /v1/jobs/{id}/resume     resume a paused or failed job
+//	POST   /v1/jobs/{id}/cancel     cancel a job and remove its partial data
+//	POST   /v1/jobs/{id}/priority   set the priority ({"priority": n})
+//
+// Requests sent by web browsers, which carry an Origin header, are rejected: on a TCP port any web
+// page could otherwise queue downloads.
+func NewAPIHandler(m *JobManager) http.Handler {
+	return &apiHandler{manager: m}
+}
+
+type apiHandler struct {
+	manager *JobManager
+}
+
+func (h *apiHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Origin") != "" {
+		writeAPIError(w, http.StatusForbidden, errors.New("requests from web pages are not allowed"))
+		return
+	}
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 2 || parts[0] != "v1" {
+		writeAPIError(w, http.StatusNotFound, errors.New("not found"))
+		return
+	}
+
+	switch {
+	case len(parts) == 2 && parts[1] == "status" && r.Method == http.MethodGet:
+		status := APIStatus{Version: Version, Circuits: []CircuitStats{}}
+		if pool := h.manager.Pool(); pool != nil {
+			status.Circuits = pool.Stats()
+		}
+		writeAPIResponse(w, http.StatusOK, status)
+	case len(parts) == 2 && parts[1] == "jobs" && r.Method == http.MethodGet:
+		writeAPIResponse(w, http.StatusOK, h.manager.Jobs())
+	case len(parts) == 2 && parts[1] == "jobs" && r.Method == http.MethodPost:
+		var req JobRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %s", err))
+			return
+		}
+		job, err := h.manager.Add(req)
+		h.writeJob(w, http.StatusCreated, job, err)
+	case len(parts) == 3 && parts[1] == "jobs" && r.Method == http.MethodGet:
+		job, err := h.manager.Job(parts[2])
+		h.writeJob(w, http.StatusOK, job, err)
+	case len(parts) == 3 && parts[1] == "jobs" && r.Method == http.MethodDelete:
+		if err := h.manager.Remove(parts[2]); err != nil {
+			h.writeJob(w, http.StatusOK, Job{}, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case len(parts) == 4 && parts[1] == "jobs" && r.Method == http.MethodPost:
+		id := parts[2]
+		var job Job
+		var err error
+		switch parts[3] {
+		case "pause":
+			job, err = h.manager.Pause(id)
+		case "resume":
+			job, err = h.manager.Resume(id)
+		case "cancel":
+			job, err = h.manager.Cancel(id)
+		case "priority":
+			var req apiPriority
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeAPIError(w, http.StatusBadRequest, fmt.Errorf("invalid request: %s", err))
+				return
+			}
+			job, err = h.manager.SetPriority(id, req.Priority)
+		default:
+			writeAPIError(w, http.StatusNotFound, errors.New("not found"))
+			return
+		}
+		h.writeJob(w, http.StatusOK, job, err)
+	default:
+		writeAPIError(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+func (h *apiHandler) writeJob(w http.ResponseWriter, status int, job Job, err error) {
+	var stateErr *JobStateError
+	switch {
+	case errors.Is(err, ErrJobNotFound):
+		writeAPIError(w, http.StatusNotFound, err)
+	case errors.As(err, &stateErr):
+		writeAPIError(w, http.StatusConflict, err)
+	case err != nil:
+		writeAPIError(w, http.StatusBadRequest, err)
+	default:
+		writeAPIResponse(w, status, job)
+	}
+}
+
+func writeAPIResponse(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, err error) {
+	writeAPIResponse(w, status, apiError{Error: err.Error()})
+}
+
+// ListenAPI listens on address, either "unix:<socket path>" or "host:port". The API has no
+// authentication, so TCP addresses must be loopback addresses.
+func ListenAPI(address string) (net.Listener, error) {
+	if socketPath, ok := strings.CutPrefix(address, "unix:"); ok {
+		return net.Listen("unix", socketPath)
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if tcpAddr, ok := listener.Addr().(*net.TCPAddr); !ok || !tcpAddr.IP.IsLoopback() {
+		listener.Close()
+		return nil, fmt.Errorf("%s is not a loopback address, the API can only listen on localhost", address)
+	}
+	return listener, nil
+}
+
+// APIClient talks to the API of a kerbetor daemon.
+type APIClient struct {
+	baseUrl    string
+	httpClient *http.Client
+}
+
+// NewAPIClient returns a client of the daemon listening on address, either "unix:<socket path>"
+// or "host:port".
+func NewAPIClient(address string) *APIClient {
+	transport := &http.Transport{}
+	baseUrl := "http://" + address
+	if socketPath, ok := strings.CutPrefix(address, "unix:"); ok {
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socketPath)
+		}
+		baseUrl = "http://kerbetor"
+	}
+	return &APIClient{baseUrl: baseUrl, httpClient: &http.Client{Transport: transport, Timeout: time.Minute}}
+}
+
+func (c *APIClient) Status() (*APIStatus, error) {
+	var status APIStatus
+	err := c.call(http.MethodGet, "/v1/status", nil, &status)
+	return &status, err
+}
+
+func (c *APIClient) Jobs() ([]Job, error) {
+	var jobs []Job
+	err := c.call(http.MethodGet, "/v1/jobs", nil, &jobs)
+	return jobs, err
+}
+
+func (c *APIClient) AddJob(req JobRequest) (*Job, error) {
+	var job Job
+	err := c.call(http.MethodPost, "/v1/jobs", req, &job)
+	return &job, err
+}
+
+func (c *APIClient) Job(id string) (*Job, error) {
+	var job Job
+	err := c.call(http.MethodGet, "/v1/jobs/"+id, nil, &job)
+	return &job, err
+}
+
+func (c *APIClient) RemoveJob(id string) error {
+	return c.call(http.MethodDelete, "/v1/jobs/"+id, nil, nil)
+}
+
+func (c *APIClient) PauseJob(id string) (*Job, error) {
+	var job Job
+	err := c.call(http.MethodPost, "/v1/jobs/"+id+"/pause", nil, &job)
+	return &job, err
+}
+
+func (c *APIClient) ResumeJob(id string) (*Job, error) {
+	var job Job
+	err := c.call(http.MethodPost, "/v1/jobs/"+id+"/resume", nil, &job)
+	return &job, err
+}
+
+func (c *APIClient) CancelJob(id string) (*Job, error) {
+	var job Job
+	err := c.call(http.MethodPost, "/v1/jobs/"+id+"/cancel", nil, &job)
+	return &job, err
+}
+
+func (c *APIClient) SetJobPriority(id string, priority int) (*Job, error) {
+	var job Job
+	err := c.call(http.MethodPost, "/v1/jobs/"+id+"/priority", apiPriority{Priority: priority}, &job)
+	return &job, err
+}
+
+func (c *APIClient) call(method string, path string, body interface{}, result interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		content, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(content)
+	}
+	req, err := http.NewRequest(method, c.baseUrl+path, reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("cannot reach kerbetor daemon: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		var apiErr apiError
+		if err := json.NewDecoder(resp.Body).Decode(&apiErr); err != nil || apiErr.Error == "" {
+			return fmt.Errorf("kerbetor daemon returned %s", resp.Status)
+		}
+		return errors.New(apiErr.Error)
+	}
+	if result == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
@@ -0,0 +1,20 @@
+package kerbetor
+
+import "testing"
+
+func TestListenAPILoopbackOnly(t *testing.T) {
+	for _, address := range []string{"127.0.0.1:0", "localhost:0"} {
+		listener, err := ListenAPI(address)
+		if err != nil {
+			t.Errorf("ListenAPI(%q): %s", address, err)
+			continue
+		}
+		listener.Close()
+	}
+	for _, address := range []string{":0", "0.0.0.0:0"} {
+		if listener, err := ListenAPI(address); err == nil {
+			listener.Close()
+			t.Errorf("ListenAPI(%q) listens on %s, want an error", address, listener.Addr())
+		}
+	}
+}
@@ -0,0 +1,690 @@
+package kerbetor
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Aria2RPCPath is the path of the aria2 compatible JSON-RPC endpoint.
+const Aria2RPCPath = "/jsonrpc"
+
+// JSON-RPC error codes. aria2 answers every failed method call with code 1.
+const (
+	aria2ErrParse          = -32700
+	aria2ErrInvalidRequest = -32600
+	aria2ErrMethodNotFound = -32601
+	aria2ErrInvalidParams  = -32602
+	aria2ErrFailed         = 1
+)
+
+type aria2Request struct {
+	JSONRPC string            `json:"jsonrpc"`
+	ID      json.RawMessage   `json:"id"`
+	Method  string            `json:"method"`
+	Params  []json.RawMessage `json:"params"`
+}
+
+type aria2Response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  interface{}     `json:"result,omitempty"`
+	Error   *aria2Error     `json:"error,omitempty"`
+}
+
+type aria2Notification struct {
+	JSONRPC string              `json:"jsonrpc"`
+	Method  string              `json:"method"`
+	Params  []map[string]string `json:"params"`
+}
+
+type aria2Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *aria2Error) Error() string {
+	return e.Message
+}
+
+type aria2Call struct {
+	MethodName string            `json:"methodName"`
+	Params     []json.RawMessage `json:"params"`
+}
+
+var aria2Methods = []string{
+	"aria2.addUri", "aria2.remove", "aria2.forceRemove", "aria2.pause", "aria2.pauseAll",
+	"aria2.forcePause", "aria2.forcePauseAll", "aria2.unpause", "aria2.unpauseAll",
+	"aria2.tellStatus", "aria2.getUris", "aria2.getFiles", "aria2.getPeers", "aria2.tellActive",
+	"aria2.tellWaiting", "aria2.tellStopped", "aria2.getOption", "aria2.changeOption",
+	"aria2.getGlobalOption", "aria2.changeGlobalOption", "aria2.getGlobalStat",
+	"aria2.purgeDownloadResult", "aria2.removeDownloadResult", "aria2.getVersion",
+	"aria2.getSessionInfo", "aria2.saveSession", "system.multicall", "system.listMethods",
+	"system.listNotifications",
+}
+
+var aria2Notifications = map[JobStatus]string{
+	JobActive:    "aria2.onDownloadStart",
+	JobPaused:    "aria2.onDownloadPause",
+	JobCancelled: "aria2.onDownloadStop",
+	JobCompleted: "aria2.onDownloadComplete",
+	JobFailed:    "aria2.onDownloadError",
+}
+
+// NewAria2RPCHandler returns an aria2 compatible JSON-RPC server driving m, so that aria2
+// front-ends can queue downloads. Jobs are exposed as aria2 downloads whose GID is the job ID.
+// Requests are accepted as HTTP POST, HTTP GET and over websocket, which also receives the
+// download notifications. Every call must start with the "token:<secret>" parameter, secret cannot
+// be empty. Requests from web pages, which carry an Origin header, are rejected unless their origin
+// is in allowedOrigins (e.g. "http://localhost:8080" for a local AriaNg).
+func NewAria2RPCHandler(m *JobManager, secret string, allowedOrigins []string, logger logrus.FieldLogger) (http.Handler, error) {
+	if secret == "" {
+		return nil, errors.New("the aria2 RPC needs a secret token")
+	}
+	origins := make(map[string]bool)
+	for _, origin := range allowedOrigins {
+		origins[strings.TrimSuffix(origin, "/")] = true
+	}
+	return &aria2Handler{manager: m, secret: secret, allowedOrigins: origins, logger: logger, sessionID: newJobID() + newJobID()}, nil
+}
+
+type aria2Handler struct {
+	manager        *JobManager
+	secret         string
+	allowedOrigins map[string]bool
+	logger         logrus.FieldLogger
+	sessionID      string
+}
+
+func (h *aria2Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// browsers do not apply CORS to websockets, the origin must be checked for every request
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if !h.allowedOrigins[origin] {
+			h.logger.Debug("aria2 RPC: rejecting request from origin ", origin)
+			http.Error(w, "origin not allowed", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Vary", "Origin")
+	}
+	if r.URL.Path != Aria2RPCPath {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case r.Method == http.MethodOptions:
+		w.WriteHeader(http.StatusOK)
+	case isWebsocketUpgrade(r):
+		h.serveWebsocket(w, r)
+	case r.Method == http.MethodPost:
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxWebsocketMessage))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json-rpc")
+		w.Write(h.handleMessage(body))
+	case r.Method == http.MethodGet:
+		h.serveGet(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// serveGet handles the GET form of aria2: /jsonrpc?method=M&id=ID&params=<base64 JSON array>.
+// JSONP callbacks are not supported.
+func (h *aria2Handler) serveGet(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	req := aria2Request{JSONRPC: "2.0", Method: query.Get("method")}
+	if id := query.Get("id"); id != "" {
+		req.ID, _ = json.Marshal(id)
+	}
+	var response []byte
+	if params := query.Get("params"); params != "" {
+		decoded, err := base64.StdEncoding.DecodeString(params)
+		if err == nil {
+			err = json.Unmarshal(decoded, &req.Params)
+		}
+		if err != nil {
+			response = h.encode(aria2Response{JSONRPC: "2.0", ID: req.ID, Error: &aria2Error{Code: aria2ErrParse, Message: "Parse error."}})
+		}
+	}
+	if response == nil {
+		response = h.encode(h.handleRequest(req))
+	}
+	w.Header().Set("Content-Type", "application/json-rpc")
+	w.Write(response)
+}
+
+func (h *aria2Handler) serveWebsocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgradeWebsocket(w, r)
+	if err != nil {
+		h.logger.Debug("aria2 RPC: ", err)
+		return
+	}
+	defer conn.Close()
+
+	changes, unsubscribe := h.manager.Subscribe()
+	defer unsubscribe()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case job := <-changes:
+				method, ok := aria2Notifications[job.Status]
+				if !ok {
+					continue
+				}
+				notification := aria2Notification{JSONRPC: "2.0", Method: method, Params: []map[string]string{{"gid": job.ID}}}
+				if err := conn.WriteMessage(h.encode(notification)); err != nil {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	for {
+		message, err := conn.ReadMessage()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				h.logger.Debug("aria2 RPC websocket: ", err)
+			}
+			return
+		}
+		if err := conn.WriteMessage(h.handleMessage(message)); err != nil {
+			return
+		}
+	}
+}
+
+// handleMessage answers a JSON-RPC request or batch of requests.
+func (h *aria2Handler) handleMessage(message []byte) []byte {
+	message = bytes.TrimSpace(message)
+	if bytes.HasPrefix(message, []byte("[")) {
+		var batch []aria2Request
+		if err := json.Unmarshal(message, &batch); err != nil {
+			return h.encode(aria2Response{JSONRPC: "2.0", Error: &aria2Error{Code: aria2ErrParse, Message: "Parse error."}})
+		}
+		responses := make([]aria2Response, 0, len(batch))
+		for _, req := range batch {
+			responses = append(responses, h.handleRequest(req))
+		}
+		return h.encode(responses)
+	}
+
+	var req aria2Request
+	if err := json.Unmarshal(message, &req); err != nil {
+		return h.encode(aria2Response{JSONRPC: "2.0", Error: &aria2Error{Code: aria2ErrParse, Message: "Parse error."}})
+	}
+	return h.encode(h.handleRequest(req))
+}
+
+func (h *aria2Handler) handleRequest(req aria2Request) aria2Response {
+	response := aria2Response{JSONRPC: "2.0", ID: req.ID}
+	if req.Method == "" {
+		response.Error = &aria2Error{Code: aria2ErrInvalidRequest, Message: "Invalid Request."}
+		return response
+	}
+	result, err := h.call(req.Method, req.Params)
+	if err != nil {
+		response.Error = toAria2Error(err)
+		return response
+	}
+	response.Result = result
+	return response
+}
+
+func (h *aria2Handler) encode(value interface{}) []byte {
+	content, err := json.Marshal(value)
+	if err != nil {
+		h.logger.Warn("aria2 RPC: cannot encode response: ", err)
+		return []byte(`{"jsonrpc":"2.0","id":null,"error":{"code":1,"message":"Internal error."}}`)
+	}
+	return content
+}
+
+func toAria2Error(err error) *aria2Error {
+	var rpcErr *aria2Error
+	if errors.As(err, &rpcErr) {
+		return rpcErr
+	}
+	return &aria2Error{Code: aria2ErrFailed, Message: err.Error()}
+}
+
+func (h *aria2Handler) call(method string, params []json.RawMessage) (interface{}, error) {
+	if strings.HasPrefix(method, "system.") {
+		// system methods do not need the token, tolerate it; calls in a multicall carry their own
+		if len(params) > 0 && bytes.HasPrefix(params[0], []byte(`"token:`)) {
+			params = params[1:]
+		}
+	}
+	switch method {
+	case "system.listMethods":
+		return aria2Methods, nil
+	case "system.listNotifications":
+		return []string{"aria2.onDownloadStart", "aria2.onDownloadPause", "aria2.onDownloadStop", "aria2.onDownloadComplete", "aria2.onDownloadError"}, nil
+	case "system.multicall":
+		return h.multicall(params)
+	}
+
+	params, err := h.authorize(params)
+	if err != nil {
+		return nil, err
+	}
+	p := aria2Params(params)
+
+	switch method {
+	case "aria2.addUri":
+		return h.addUri(p)
+	case "aria2.remove", "aria2.forceRemove":
+		return h.jobCall(p, h.manager.Cancel)
+	case "aria2.pause", "aria2.forcePause":
+		return h.jobCall(p, h.manager.Pause)
+	case "aria2.unpause":
+		return h.jobCall(p, h.manager.Resume)
+	case "aria2.pauseAll", "aria2.forcePauseAll":
+		for _, job := range h.manager.Jobs() {
+			if job.Status == JobQueued || job.Status == JobActive {
+				h.manager.Pause(job.ID)
+			}
+		}
+		return "OK", nil
+	case "aria2.unpauseAll":
+		for _, job := range h.manager.Jobs() {
+			if job.Status == JobPaused {
+				h.manager.Resume(job.ID)
+			}
+		}
+		return "OK", nil
+	case "aria2.tellStatus":
+		var gid string
+		var keys []string
+		if err := p.required(0, &gid); err != nil {
+			return nil, err
+		}
+		if err := p.optional(1, &keys); err != nil {
+			return nil, err
+		}
+		job, err := h.manager.Job(gid)
+		if err != nil {
+			return nil, err
+		}
+		return h.status(job, keys), nil
+	case "aria2.getUris":
+		job, err := h.job(p)
+		if err != nil {
+			return nil, err
+		}
+		return aria2Uris(job), nil
+	case "aria2.getFiles":
+		job, err := h.job(p)
+		if err != nil {
+			return nil, err
+		}
+		return []map[string]interface{}{aria2File(job)}, nil
+	case "aria2.getPeers":
+		if _, err := h.job(p); err != nil {
+			return nil, err
+		}
+		return []interface{}{}, nil
+	case "aria2.tellActive":
+		var keys []string
+		if err := p.optional(0, &keys); err != nil {
+			return nil, err
+		}
+		return h.tell(func(job Job) bool { return job.Status == JobActive }, 0, -1, keys), nil
+	case "aria2.tellWaiting", "aria2.tellStopped":
+		var offset, num int
+		var keys []string
+		if err := p.required(0, &offset); err != nil {
+			return nil, err
+		}
+		if err := p.required(1, &num); err != nil {
+			return nil, err
+		}
+		if err := p.optional(2, &keys); err != nil {
+			return nil, err
+		}
+		filter := func(job Job) bool { return job.Status == JobQueued || job.Status == JobPaused }
+		if method == "aria2.tellStopped" {
+			filter = func(job Job) bool {
+				return job.Status == JobCompleted || job.Status == JobFailed || job.Status == JobCancelled
+			}
+		}
+		return h.tell(filter, offset, num, keys), nil
+	case "aria2.getOption":
+		job, err := h.job(p)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]string{"dir": filepath.Dir(job.Output), "out": filepath.Base(job.Output)}, nil
+	case "aria2.changeOption":
+		var gid string
+		var options map[string]interface{}
+		if err := p.required(0, &gid); err != nil {
+			return nil, err
+		}
+		if err := p.required(1, &options); err != nil {
+			return nil, err
+		}
+		if _, err := h.manager.Job(gid); err != nil {
+			return nil, err
+		}
+		if len(options) > 0 {
+			names := make([]string, 0, len(options))
+			for name := range options {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("options cannot be changed: %s", strings.Join(names, ", "))
+		}
+		return "OK", nil
+	case "aria2.getGlobalOption":
+		return map[string]string{
+			"dir":                      h.manager.DownloadDir(),
+			"max-concurrent-downloads": strconv.Itoa(h.manager.MaxActive()),
+		}, nil
+	case "aria2.changeGlobalOption":
+		var options map[string]interface{}
+		if err := p.required(0, &options); err != nil {
+			return nil, err
+		}
+		for name, value := range options {
+			if name != "max-concurrent-downloads" {
+				return nil, fmt.Errorf("option %s cannot be changed", name)
+			}
+			maxActive, err := strconv.Atoi(fmt.Sprint(value))
+			if err != nil {
+				return nil, fmt.Errorf("invalid value for %s: %v", name, value)
+			}
+			if err := h.manager.SetMaxActive(maxActive); err != nil {
+				return nil, err
+			}
+		}
+		return "OK", nil
+	case "aria2.getGlobalStat":
+		return h.globalStat(), nil
+	case "aria2.purgeDownloadResult":
+		for _, job := range h.manager.Jobs() {
+			if job.Status == JobCompleted || job.Status == JobFailed || job.Status == JobCancelled {
+				h.manager.Remove(job.ID)
+			}
+		}
+		return "OK", nil
+	case "aria2.removeDownloadResult":
+		var gid string
+		if err := p.required(0, &gid); err != nil {
+			return nil, err
+		}
+		if err := h.manager.Remove(gid); err != nil {
+			return nil, err
+		}
+		return "OK", nil
+	case "aria2.getVersion":
+		return map[string]interface{}{"version": Version, "enabledFeatures": []string{"HTTPS"}}, nil
+	case "aria2.getSessionInfo":
+		return map[string]string{"sessionId": h.sessionID}, nil
+	case "aria2.saveSession":
+		// the queue is saved after every change
+		return "OK", nil
+	}
+	return nil, &aria2Error{Code: aria2ErrMethodNotFound, Message: fmt.Sprintf("No such method: %s", method)}
+}
+
+// authorize checks and strips the "token:<secret>" parameter.
+func (h *aria2Handler) authorize(params []json.RawMessage) ([]json.RawMessage, error) {
+	var token string
+	if len(params) > 0 && json.Unmarshal(params[0], &token) == nil && strings.HasPrefix(token, "token:") {
+		params = params[1:]
+	} else {
+		token = ""
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte("token:"+h.secret)) != 1 {
+		return nil, &aria2Error{Code: aria2ErrFailed, Message: "Unauthorized"}
+	}
+	return params, nil
+}
+
+func (h *aria2Handler) multicall(params []json.RawMessage) (interface{}, error) {
+	var calls []aria2Call
+	if err := aria2Params(params).required(0, &calls); err != nil {
+		return nil, err
+	}
+	results := make([]interface{}, 0, len(calls))
+	for _, call := range calls {
+		if call.MethodName == "system.multicall" {
+			results = append(results, &aria2Error{Code: aria2ErrFailed, Message: "Recursive system.multicall forbidden."})
+			continue
+		}
+		result, err := h.call(call.MethodName, call.Params)
+		if err != nil {
+			results = append(results, toAria2Error(err))
+			continue
+		}
+		results = append(results, []interface{}{result})
+	}
+	return results, nil
+}
+
+// addUri queues the download of the first URI, the others being its mirrors. Options supported:
+// dir, out, checksum and pause.
+func (h *aria2Handler) addUri(p aria2Params) (interface{}, error) {
+	var uris []string
+	var options map[string]interface{}
+	if err := p.required(0, &uris); err != nil {
+		return nil, err
+	}
+	if err := p.optional(1, &options); err != nil {
+		return nil, err
+	}
+	if len(uris) == 0 {
+		return nil, &aria2Error{Code: aria2ErrInvalidParams, Message: "No URI to download."}
+	}
+	for _, uri := range uris {
+		parsedURL, err := url.Parse(uri)
+		if err != nil || (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") {
+			return nil, fmt.Errorf("unsupported URI %s, only http and https are supported", uri)
+		}
+	}
+
+	req := JobRequest{URL: uris[0], Mirrors: uris[1:]}
+	for name, value := range options {
+		stringValue := fmt.Sprint(value)
+		switch name {
+		case "dir":
+			req.Dir = stringValue
+		case "out":
+			req.Out = stringValue
+		case "checksum":
+			// aria2 writes algorithms as sha-256
+			algorithm, digest, _ := strings.Cut(stringValue, "=")
+			checksum, err := NewChecksum(strings.ReplaceAll(algorithm, "-", ""), digest)
+			if err != nil {
+				return nil, err
+			}
+			req.Checksums = append(req.Checksums, checksum)
+		case "pause":
+			req.Paused = stringValue == "true"
+		default:
+			h.logger.Debug("aria2 RPC: ignoring unsupported option ", name)
+		}
+	}
+	job, err := h.manager.Add(req)
+	if err != nil {
+		return nil, err
+	}
+	return job.ID, nil
+}
+
+func (h *aria2Handler) job(p aria2Params) (Job, error) {
+	var gid string
+	if err := p.required(0, &gid); err != nil {
+		return Job{}, err
+	}
+	return h.manager.Job(gid)
+}
+
+func (h *aria2Handler) jobCall(p aria2Params, call func(id string) (Job, error)) (interface{}, error) {
+	var gid string
+	if err := p.required(0, &gid); err != nil {
+		return nil, err
+	}
+	job, err := call(gid)
+	if err != nil {
+		return nil, err
+	}
+	return job.ID, nil
+}
+
+// tell returns the status of num jobs matching filter starting at offset, in queue order. A
+// negative offset counts from the end of the queue and walks it backwards, a negative num
+// returns every job.
+func (h *aria2Handler) tell(filter func(job Job) bool, offset int, num int, keys []string) []map[string]interface{} {
+	var jobs []Job
+	for _, job := range h.manager.Jobs() {
+		if filter(job) {
+			jobs = append(jobs, job)
+		}
+	}
+	if offset < 0 {
+		for i, j := 0, len(jobs)-1; i < j; i, j = i+1, j-1 {
+			jobs[i], jobs[j] = jobs[j], jobs[i]
+		}
+		offset = -offset - 1
+	}
+	statuses := make([]map[string]interface{}, 0)
+	for i := offset; i < len(jobs) && (num < 0 || len(statuses) < num); i++ {
+		statuses = append(statuses, h.status(jobs[i], keys))
+	}
+	return statuses
+}
+
+func (h *aria2Handler) status(job Job, keys []string) map[string]interface{} {
+	connections := 0
+	if job.Status == JobActive && h.manager.Pool() != nil {
+		connections = h.manager.Pool().Len()
+	}
+	errorCode := "0"
+	if job.Status == JobFailed {
+		errorCode = "1"
+	}
+	status := map[string]interface{}{
+		"gid":             job.ID,
+		"status":          aria2Status(job.Status),
+		"totalLength":     strconv.FormatUint(job.TotalBytes, 10),
+		"completedLength": strconv.FormatUint(job.DownloadedBytes, 10),
+		"uploadLength":    "0",
+		"downloadSpeed":   strconv.FormatUint(job.Speed, 10),
+		"uploadSpeed":     "0",
+		"connections":     strconv.Itoa(connections),
+		"dir":             filepath.Dir(job.Output),
+		"files":           []map[string]interface{}{aria2File(job)},
+		"errorCode":       errorCode,
+		"errorMessage":    job.Error,
+	}
+	if len(keys) == 0 {
+		return status
+	}
+	filtered := make(map[string]interface{}, len(keys))
+	for _, key := range keys {
+		if value, ok := status[key]; ok {
+			filtered[key] = value
+		}
+	}
+	return filtered
+}
+
+func (h *aria2Handler) globalStat() map[string]string {
+	var speed uint64
+	var active, waiting, stopped int
+	for _, job := range h.manager.Jobs() {
+		switch job.Status {
+		case JobActive:
+			active++
+			speed += job.Speed
+		case JobQueued, JobPaused:
+			waiting++
+		default:
+			stopped++
+		}
+	}
+	return map[string]string{
+		"downloadSpeed":   strconv.FormatUint(speed, 10),
+		"uploadSpeed":     "0",
+		"numActive":       strconv.Itoa(active),
+		"numWaiting":      strconv.Itoa(waiting),
+		"numStopped":      strconv.Itoa(stopped),
+		"numStoppedTotal": strconv.Itoa(stopped),
+	}
+}
+
+func aria2Status(status JobStatus) string {
+	switch status {
+	case JobQueued:
+		return "waiting"
+	case JobCompleted:
+		return "complete"
+	case JobFailed:
+		return "error"
+	case JobCancelled:
+		return "removed"
+	}
+	return string(status)
+}
+
+func aria2Uris(job Job) []map[string]string {
+	uris := []map[string]string{{"uri": job.URL, "status": "used"}}
+	for _, mirror := range job.Mirrors {
+		uris = append(uris, map[string]string{"uri": mirror, "status": "used"})
+	}
+	return uris
+}
+
+func aria2File(job Job) map[string]interface{} {
+	return map[string]interface{}{
+		"index":           "1",
+		"path":            job.Output,
+		"length":          strconv.FormatUint(job.TotalBytes, 10),
+		"completedLength": strconv.FormatUint(job.DownloadedBytes, 10),
+		"selected":        "true",
+		"uris":            aria2Uris(job),
+	}
+}
+
+// aria2Params decodes positional parameters.
+type aria2Params []json.RawMessage
+
+func (p aria2Params) required(i int, value interface{}) error {
+	if i >= len(p) {
+		return &aria2Error{Code: aria2ErrInvalidParams, Message: fmt.Sprintf("Missing parameter %d.", i+1)}
+	}
+	return p.optional(i, value)
+}
+
+func (p aria2Params) optional(i int, value interface{}) error {
+	if i >= len(p) {
+		return nil
+	}
+	if err := json.Unmarshal(p[i], value); err != nil {
+		return &aria2Error{Code: aria2ErrInvalidParams, Message: fmt.Sprintf("Invalid parameter %d: %s", i+1, err)}
+	}
+	return nil
+}
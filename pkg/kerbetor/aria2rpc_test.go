@@ -0,0 +1,379 @@
+package kerbetor
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const testRPCSecret = "s3cret"
+
+var testModTime = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+// newTestAria2 starts an aria2 RPC server driving a JobManager that downloads without TOR. Files
+// are served by a test server under /files/, /slow/ never answers until the test ends.
+func newTestAria2(t *testing.T, allowedOrigins ...string) (*JobManager, *httptest.Server, *httptest.Server) {
+	t.Helper()
+	logger := logrus.New()
+	logger.Out = io.Discard
+
+	release := make(chan struct{})
+	files := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/slow/") {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+			return
+		}
+		http.ServeContent(w, r, "file", testModTime, strings.NewReader("hello kerbetor"))
+	}))
+	t.Cleanup(files.Close)
+	t.Cleanup(func() { close(release) })
+
+	manager, err := NewJobManager(t.TempDir(), t.TempDir(), 1, nil, logger, WithTorCircuits(0), WithWorkers(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(manager.Close)
+
+	handler, err := NewAria2RPCHandler(manager, testRPCSecret, allowedOrigins, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rpc := httptest.NewServer(handler)
+	t.Cleanup(rpc.Close)
+	return manager, rpc, files
+}
+
+type testAria2Response struct {
+	ID     json.RawMessage `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *aria2Error     `json:"error"`
+}
+
+// aria2TestCall posts a JSON-RPC request for method with the secret token and params, and decodes the
+// result into result. It returns the JSON-RPC error, if any.
+func aria2TestCall(t *testing.T, rpc *httptest.Server, method string, result interface{}, params ...interface{}) *aria2Error {
+	t.Helper()
+	return aria2RawTestCall(t, rpc, method, result, append([]interface{}{"token:" + testRPCSecret}, params...)...)
+}
+
+func aria2RawTestCall(t *testing.T, rpc *httptest.Server, method string, result interface{}, params ...interface{}) *aria2Error {
+	t.Helper()
+	body, err := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": "1", "method": method, "params": params})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response testAria2Response
+	postAria2(t, rpc, string(body), &response)
+	if response.Error != nil {
+		return response.Error
+	}
+	if result != nil {
+		if err := json.Unmarshal(response.Result, result); err != nil {
+			t.Fatalf("%s: cannot decode result %s: %s", method, response.Result, err)
+		}
+	}
+	return nil
+}
+
+func postAria2(t *testing.T, rpc *httptest.Server, body string, response interface{}) {
+	t.Helper()
+	resp, err := http.Post(rpc.URL+Aria2RPCPath, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got HTTP status %d", resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(response); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func addTestJob(t *testing.T, rpc *httptest.Server, uri string, options map[string]interface{}) string {
+	t.Helper()
+	var gid string
+	if rpcErr := aria2TestCall(t, rpc, "aria2.addUri", &gid, []string{uri}, options); rpcErr != nil {
+		t.Fatalf("addUri %s: %s", uri, rpcErr.Message)
+	}
+	return gid
+}
+
+func TestAria2RequiresSecret(t *testing.T) {
+	if _, err := NewAria2RPCHandler(nil, "", nil, logrus.New()); err == nil {
+		t.Fatal("handler created without a secret")
+	}
+
+	_, rpc, _ := newTestAria2(t)
+	for _, params := range [][]interface{}{
+		nil,
+		{"token:wrong"},
+		{"token:" + testRPCSecret + "x"},
+		{"token:"},
+	} {
+		rpcErr := aria2RawTestCall(t, rpc, "aria2.getVersion", nil, params...)
+		if rpcErr == nil || rpcErr.Message != "Unauthorized" {
+			t.Errorf("params %v: got %v, want Unauthorized", params, rpcErr)
+		}
+	}
+	var version map[string]interface{}
+	if rpcErr := aria2TestCall(t, rpc, "aria2.getVersion", &version); rpcErr != nil {
+		t.Fatal(rpcErr.Message)
+	}
+	if version["version"] != Version {
+		t.Errorf("got version %v", version)
+	}
+	// system methods do not need the token
+	var methods []string
+	if rpcErr := aria2RawTestCall(t, rpc, "system.listMethods", &methods); rpcErr != nil || len(methods) == 0 {
+		t.Errorf("system.listMethods: %v %v", methods, rpcErr)
+	}
+}
+
+func TestAria2RejectsForeignOrigins(t *testing.T) {
+	_, rpc, _ := newTestAria2(t, "http://localhost:8080/")
+	body := `{"jsonrpc":"2.0","id":"1","method":"aria2.getVersion","params":["token:` + testRPCSecret + `"]}`
+
+	for _, test := range []struct {
+		method, origin string
+		upgrade        bool
+		status         int
+	}{
+		{http.MethodPost, "", false, http.StatusOK},
+		{http.MethodPost, "http://localhost:8080", false, http.StatusOK},
+		{http.MethodOptions, "http://localhost:8080", false, http.StatusOK},
+		{http.MethodPost, "http://evil.example", false, http.StatusForbidden},
+		{http.MethodPost, "null", false, http.StatusForbidden},
+		{http.MethodOptions, "http://evil.example", false, http.StatusForbidden},
+		{http.MethodGet, "http://evil.example", true, http.StatusForbidden},
+	} {
+		req, err := http.NewRequest(test.method, rpc.URL+Aria2RPCPath, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if test.origin != "" {
+			req.Header.Set("Origin", test.origin)
+		}
+		if test.upgrade {
+			req.Header.Set("Connection", "Upgrade")
+			req.Header.Set("Upgrade", "websocket")
+			req.Header.Set("Sec-WebSocket-Version", "13")
+			req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("%s from %q: got status %d, want %d", test.method, test.origin, resp.StatusCode, test.status)
+		}
+		allowed := resp.Header.Get("Access-Control-Allow-Origin")
+		if test.status == http.StatusOK && allowed != test.origin || test.status != http.StatusOK && allowed != "" {
+			t.Errorf("%s from %q: got Access-Control-Allow-Origin %q", test.method, test.origin, allowed)
+		}
+	}
+
+	// JSONP is not supported
+	resp, err := http.Get(rpc.URL + Aria2RPCPath + "?method=aria2.getVersion&id=1&jsoncallback=steal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if strings.HasPrefix(string(content), "steal(") || resp.Header.Get("Content-Type") == "text/javascript" {
+		t.Errorf("got a JSONP response: %s", content)
+	}
+}
+
+func TestAria2AddUriAndTellStatus(t *testing.T) {
+	manager, rpc, files := newTestAria2(t)
+	digest := strings.Repeat("A", 64)
+	gid := addTestJob(t, rpc, files.URL+"/files/a.bin", map[string]interface{}{
+		"dir":      "sub",
+		"out":      "renamed.bin",
+		"checksum": "sha-256=" + digest,
+		"pause":    "true",
+		"split":    "4",
+	})
+
+	job, err := manager.Job(gid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(resolvedDir(t, manager.DownloadDir()), "sub", "renamed.bin"); job.Output != want {
+		t.Errorf("got output %s, want %s", job.Output, want)
+	}
+	if len(job.Checksums) != 1 || job.Checksums[0] != (Checksum{Algorithm: "sha256", Digest: strings.ToLower(digest)}) {
+		t.Errorf("got checksums %v", job.Checksums)
+	}
+
+	var status map[string]interface{}
+	if rpcErr := aria2TestCall(t, rpc, "aria2.tellStatus", &status, gid); rpcErr != nil {
+		t.Fatal(rpcErr.Message)
+	}
+	if status["gid"] != gid || status["status"] != "paused" || status["dir"] != filepath.Dir(job.Output) {
+		t.Errorf("got status %v", status)
+	}
+	status = nil
+	if rpcErr := aria2TestCall(t, rpc, "aria2.tellStatus", &status, gid, []string{"status", "unknown"}); rpcErr != nil {
+		t.Fatal(rpcErr.Message)
+	}
+	if len(status) != 1 || status["status"] != "paused" {
+		t.Errorf("got filtered status %v", status)
+	}
+	if rpcErr := aria2TestCall(t, rpc, "aria2.tellStatus", nil, "0000000000000000"); rpcErr == nil {
+		t.Error("tellStatus of an unknown gid succeeded")
+	}
+
+	for _, test := range []struct {
+		uris    []string
+		options map[string]interface{}
+	}{
+		{nil, nil},
+		{[]string{"ftp://example.onion/file"}, nil},
+		{[]string{files.URL + "/files/b.bin"}, map[string]interface{}{"dir": "../.."}},
+		{[]string{files.URL + "/files/b.bin"}, map[string]interface{}{"dir": "/etc"}},
+		{[]string{files.URL + "/files/b.bin"}, map[string]interface{}{"checksum": "crc32=00000000"}},
+		{[]string{files.URL + "/files/b.bin"}, map[string]interface{}{"checksum": "sha-256=abcd"}},
+	} {
+		if rpcErr := aria2TestCall(t, rpc, "aria2.addUri", nil, test.uris, test.options); rpcErr == nil {
+			t.Errorf("addUri %v %v succeeded", test.uris, test.options)
+		}
+	}
+}
+
+// resolvedDir returns dir as JobManager paths are built, absolute with symbolic links resolved.
+func resolvedDir(t *testing.T, dir string) string {
+	t.Helper()
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved, err := filepath.EvalSymlinks(dir); err == nil {
+		dir = resolved
+	}
+	return dir
+}
+
+func TestAria2TellPaging(t *testing.T) {
+	manager, rpc, files := newTestAria2(t)
+	active := addTestJob(t, rpc, files.URL+"/slow/active.bin", nil)
+	var waiting []string
+	for i, name := range []string{"w0", "w1", "w2", "w3"} {
+		// higher priorities first: w0 to w3 in queue order
+		job, err := manager.Add(JobRequest{URL: files.URL + "/files/" + name, Priority: 10 - i, Paused: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		waiting = append(waiting, job.ID)
+	}
+	stopped, err := manager.Cancel(waiting[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	waiting = waiting[:3]
+
+	gids := func(method string, params ...interface{}) []string {
+		t.Helper()
+		var statuses []map[string]interface{}
+		if rpcErr := aria2TestCall(t, rpc, method, &statuses, params...); rpcErr != nil {
+			t.Fatalf("%s: %s", method, rpcErr.Message)
+		}
+		ids := []string{}
+		for _, status := range statuses {
+			ids = append(ids, status["gid"].(string))
+		}
+		return ids
+	}
+	for _, test := range []struct {
+		got, want []string
+	}{
+		{gids("aria2.tellActive"), []string{active}},
+		{gids("aria2.tellActive", []string{"gid"}), []string{active}},
+		{gids("aria2.tellWaiting", 0, 10), waiting},
+		{gids("aria2.tellWaiting", 0, 2), waiting[:2]},
+		{gids("aria2.tellWaiting", 1, 1), waiting[1:2]},
+		{gids("aria2.tellWaiting", 2, 10), waiting[2:]},
+		{gids("aria2.tellWaiting", 5, 10), []string{}},
+		{gids("aria2.tellWaiting", -1, 2), []string{waiting[2], waiting[1]}},
+		{gids("aria2.tellWaiting", 0, -1), waiting},
+		{gids("aria2.tellStopped", 0, 10), []string{stopped.ID}},
+	} {
+		if strings.Join(test.got, ",") != strings.Join(test.want, ",") {
+			t.Errorf("got %v, want %v", test.got, test.want)
+		}
+	}
+	if rpcErr := aria2TestCall(t, rpc, "aria2.tellWaiting", nil, 0); rpcErr == nil || rpcErr.Code != aria2ErrInvalidParams {
+		t.Errorf("tellWaiting without num: got %v, want invalid params", rpcErr)
+	}
+}
+
+func TestAria2MulticallAndBatch(t *testing.T) {
+	_, rpc, files := newTestAria2(t)
+	token := "token:" + testRPCSecret
+
+	var results []json.RawMessage
+	calls := []map[string]interface{}{
+		{"methodName": "aria2.addUri", "params": []interface{}{token, []string{files.URL + "/files/m.bin"}, map[string]string{"pause": "true"}}},
+		{"methodName": "aria2.getGlobalStat", "params": []interface{}{token}},
+		{"methodName": "aria2.getGlobalStat", "params": []interface{}{"token:wrong"}},
+		{"methodName": "aria2.noSuchMethod", "params": []interface{}{token}},
+		{"methodName": "system.multicall", "params": []interface{}{}},
+	}
+	if rpcErr := aria2RawTestCall(t, rpc, "system.multicall", &results, calls); rpcErr != nil {
+		t.Fatal(rpcErr.Message)
+	}
+	if len(results) != len(calls) {
+		t.Fatalf("got %d results, want %d", len(results), len(calls))
+	}
+	var gid []string
+	if err := json.Unmarshal(results[0], &gid); err != nil || len(gid) != 1 || gid[0] == "" {
+		t.Errorf("addUri result %s", results[0])
+	}
+	var stat []map[string]string
+	if err := json.Unmarshal(results[1], &stat); err != nil || len(stat) != 1 || stat[0]["numWaiting"] != "1" {
+		t.Errorf("getGlobalStat result %s", results[1])
+	}
+	for i, want := range []int{aria2ErrFailed, aria2ErrMethodNotFound, aria2ErrFailed} {
+		var rpcErr aria2Error
+		if err := json.Unmarshal(results[2+i], &rpcErr); err != nil || rpcErr.Code != want {
+			t.Errorf("result %d: got %s, want error code %d", 2+i, results[2+i], want)
+		}
+	}
+
+	var responses []testAria2Response
+	postAria2(t, rpc, `[
+		{"jsonrpc":"2.0","id":"a","method":"aria2.getVersion","params":["`+token+`"]},
+		{"jsonrpc":"2.0","id":"b","method":"aria2.tellStatus","params":["`+token+`"]},
+		{"jsonrpc":"2.0","id":"c"}
+	]`, &responses)
+	if len(responses) != 3 {
+		t.Fatalf("got %d responses, want 3", len(responses))
+	}
+	if string(responses[0].ID) != `"a"` || responses[0].Error != nil || len(responses[0].Result) == 0 {
+		t.Errorf("response a: %+v", responses[0])
+	}
+	if string(responses[1].ID) != `"b"` || responses[1].Error == nil || responses[1].Error.Code != aria2ErrInvalidParams {
+		t.Errorf("response b: %+v", responses[1])
+	}
+	if string(responses[2].ID) != `"c"` || responses[2].Error == nil || responses[2].Error.Code != aria2ErrInvalidRequest {
+		t.Errorf("response c: %+v", responses[2])
+	}
+
+	var parseError testAria2Response
+	postAria2(t, rpc, `[{"jsonrpc":`, &parseError)
+	if parseError.Error == nil || parseError.Error.Code != aria2ErrParse {
+		t.Errorf("malformed batch: %+v", parseError)
+	}
+}
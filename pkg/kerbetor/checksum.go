@@ -0,0 +1,85 @@
+package kerbetor
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Checksum is an expected digest of a downloaded file.
+type Checksum struct {
+	Algorithm string `json:"algorithm"`
+	Digest    string `json:"digest"`
+}
+
+// ChecksumMismatchError is returned when the merged file does not match an expected Checksum.
+type ChecksumMismatchError struct {
+	Path      string
+	Algorithm string
+	Expected  string
+	Actual    string
+}
+
+func (e *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf("%s checksum mismatch for %s: expected %s, got %s", e.Algorithm, e.Path, e.Expected, e.Actual)
+}
+
+func NewChecksum(algorithm string, digest string) (Checksum, error) {
+	c := Checksum{Algorithm: strings.ToLower(strings.TrimSpace(algorithm)), Digest: strings.ToLower(strings.TrimSpace(digest))}
+	h, err := c.NewHash()
+	if err != nil {
+		return Checksum{}, err
+	}
+	if decoded, err := hex.DecodeString(c.Digest); err != nil || len(decoded) != h.Size() {
+		return Checksum{}, fmt.Errorf("invalid %s digest: %s", c.Algorithm, digest)
+	}
+	return c, nil
+}
+
+// ParseChecksum parses "<algorithm>=<hex digest>" or "<algorithm>:<hex digest>".
+func ParseChecksum(value string) (Checksum, error) {
+	sep := strings.IndexAny(value, "=:")
+	if sep < 0 {
+		return Checksum{}, fmt.Errorf("invalid checksum %q, expected <algorithm>=<digest>", value)
+	}
+	return NewChecksum(value[:sep], value[sep+1:])
+}
+
+func (c Checksum) NewHash() (hash.Hash, error) {
+	return newHash(c.Algorithm)
+}
+
+func (c Checksum) String() string {
+	return c.Algorithm + "=" + c.Digest
+}
+
+func newHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case "md5":
+		return md5.New(), nil
+	case "sha1":
+		return sha1.New(), nil
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	}
+	return nil, fmt.Errorf("unsupported checksum algorithm: %s", algorithm)
+}
+
+// WriteChecksumSidecar writes <filePath>.<algorithm> in the format used by sha256sum and friends.
+func WriteChecksumSidecar(filePath string, algorithm string, digest string) error {
+	sidecarPath := filePath + "." + algorithm
+	content := fmt.Sprintf("%s  %s\n", digest, filepath.Base(filePath))
+	if err := os.WriteFile(sidecarPath, []byte(content), 0644); err != nil {
+		return fmt.Errorf("cannot write checksum file %s: %s", sidecarPath, err)
+	}
+	return nil
+}
@@ -1,13 +1,15 @@
 package kerbetor
 
 import (
+	"context"
 	"fmt"
+	"hash"
 	"io"
-	"io/ioutil"
 	"math"
 	"os"
+	"sort"
 	"strconv"
-	"strings"
+	"sync"
 
 	"github.com/sirupsen/logrus"
 )
@@ -21,8 +23,23 @@ const (
 	ChunkStatusError
 )
 
+func (s ChunkStatus) String() string {
+	switch s {
+	case ChunkStatusNotStarted:
+		return "not-started"
+	case ChunkStatusInProgress:
+		return "in-progress"
+	case ChunkStatusCompleted:
+		return "completed"
+	case ChunkStatusError:
+		return "error"
+	}
+	return fmt.Sprintf("unknown(%d)", uint8(s))
+}
+
+// Chunk is a range of the remote file downloaded into its own .part file. The URL it is fetched
+// from is chosen for each attempt, among the mirrors of the download.
 type Chunk struct {
-	remoteUrl   string
 	startOffset uint64
 	endOffset   uint64
 
@@ -30,6 +47,11 @@ type Chunk struct {
 	chunkPath       string
 	status          ChunkStatus
 	bytesDownloaded uint64
+	// claimed is the number of bytes, from startOffset, a worker has reserved for writing
+	claimed  uint64
+	sha256   string
+	attempts int
+	lastErr  error
 }
 
 type ChunkController struct {
@@ -37,56 +59,19 @@ type ChunkController struct {
 	fileSize  uint64
 	chunkSize uint64
 	chunks    *[]*Chunk
-}
-
-func CheckChunksMetadata(remoteUrl string, workPath string, fileSize uint64, chunkSize uint64) (bool, error) {
-	// check file metadata.ktor if remoteUrl, fileSize and chunkSize are the same
-	// if not, returns false and error
 
-	// if metadata.ktor does not exist, create it
-	if _, err := os.Stat(workPath + "/metadata.ktor"); os.IsNotExist(err) {
-		metadataFile, err := os.Create(workPath + "/metadata.ktor")
-		if err != nil {
-			return false, fmt.Errorf("cannot create file %s/metadata.ktor: %s", workPath, err)
-		}
-		defer metadataFile.Close()
-
-		_, err = metadataFile.WriteString(remoteUrl + "\n" + strconv.FormatInt(int64(fileSize), 10) + "\n" + strconv.FormatInt(int64(chunkSize), 10))
-		if err != nil {
-			return false, fmt.Errorf("cannot write to file %s/metadata.ktor: %s", workPath, err)
-		}
-		return true, nil
-	}
-
-	// read metadata.ktor file
-	metadataFile, err := os.Open(workPath + "/metadata.ktor")
-	if err != nil {
-		return false, fmt.Errorf("cannot open file %s/metadata.ktor: %s", workPath, err)
-	}
-	defer metadataFile.Close()
-
-	metadataFileContent, err := ioutil.ReadAll(metadataFile)
-	if err != nil {
-		return false, fmt.Errorf("cannot read file %s/metadata.ktor: %s", workPath, err)
-	}
-
-	// check if remoteUrl, fileSize and chunkSize are the same
-	// if not, return false
-	metadata := string(metadataFileContent)
-	metadataArray := strings.Split(metadata, "\n")
-	if metadataArray[0] != remoteUrl {
-		return false, fmt.Errorf("remote URL is different")
-	}
-	if metadataArray[1] != strconv.FormatInt(int64(fileSize), 10) {
-		return false, fmt.Errorf("file size is different")
-	}
-	if metadataArray[2] != strconv.FormatInt(int64(chunkSize), 10) {
-		return false, fmt.Errorf("chunk size is different")
-	}
-	return true, nil
+	mu        sync.Mutex
+	metadata  *WorkDirMetadata
+	nextIndex int
+	// changed is closed and replaced whenever a chunk changes status, waking up idle workers
+	changed chan struct{}
+	logger  logrus.FieldLogger
 }
 
-func GenerateChunks(fileSize uint64, chunkSize uint64, workPath string, remoteUrl string) *[]*Chunk {
+// MinSplitSize is the smallest range StealChunk hands to an idle worker.
+const MinSplitSize = 1024 * 1024
+
+func GenerateChunks(fileSize uint64, chunkSize uint64, workPath string) *[]*Chunk {
 	var chunks []*Chunk
 	if fileSize == 0 {
 		return &chunks
@@ -96,7 +81,6 @@ func GenerateChunks(fileSize uint64, chunkSize uint64, workPath string, remoteUr
 
 	for idx := 0; ; idx++ {
 		chunks = append(chunks, &Chunk{
-			remoteUrl:   remoteUrl,
 			startOffset: startOffset,
 			endOffset:   endOffset,
 			chunkPath:   fmt.Sprintf("%s/%d.part", workPath, idx),
@@ -110,7 +94,6 @@ func GenerateChunks(fileSize uint64, chunkSize uint64, workPath string, remoteUr
 		if endOffset >= fileSize {
 			endOffset = fileSize - 1
 			chunks = append(chunks, &Chunk{
-				remoteUrl:   remoteUrl,
 				startOffset: startOffset,
 				endOffset:   endOffset,
 				chunkPath:   fmt.Sprintf("%s/%d.part", workPath, idx+1),
@@ -124,7 +107,34 @@ func GenerateChunks(fileSize uint64, chunkSize uint64, workPath string, remoteUr
 	return &chunks
 }
 
-func NewChunkController(remoteUrl string, workPath string, fileSize uint64, chunkSize uint64) (*ChunkController, error) {
+// chunksFromMetadata rebuilds the chunk layout recorded in the metadata, including the ranges
+// that were split while downloading.
+func chunksFromMetadata(metadata *WorkDirMetadata, workPath string) (*[]*Chunk, error) {
+	saved := append([]ChunkMetadata{}, metadata.Chunks...)
+	sort.Slice(saved, func(i, j int) bool { return saved[i].StartOffset < saved[j].StartOffset })
+
+	var chunks []*Chunk
+	var nextOffset uint64
+	for _, chunkMetadata := range saved {
+		if chunkMetadata.StartOffset != nextOffset || chunkMetadata.EndOffset < chunkMetadata.StartOffset {
+			return nil, fmt.Errorf("chunk %d layout is different", chunkMetadata.Index)
+		}
+		chunks = append(chunks, &Chunk{
+			startOffset: chunkMetadata.StartOffset,
+			endOffset:   chunkMetadata.EndOffset,
+			chunkPath:   fmt.Sprintf("%s/%d.part", workPath, chunkMetadata.Index),
+			index:       chunkMetadata.Index,
+		})
+		nextOffset = chunkMetadata.EndOffset + 1
+	}
+	if nextOffset != metadata.FileSize {
+		return nil, fmt.Errorf("chunks do not cover the whole file")
+	}
+	return &chunks, nil
+}
+
+func NewChunkController(remoteUrl string, workPath string, info *RemoteFileInfo, chunkSize uint64, logger logrus.FieldLogger) (*ChunkController, error) {
+	fileSize := info.Size
 	// if workPath directory do not exist, create it
 	if _, err := os.Stat(workPath); os.IsNotExist(err) {
 		err := os.Mkdir(workPath, os.ModePerm)
@@ -133,59 +143,348 @@ func NewChunkController(remoteUrl string, workPath string, fileSize uint64, chun
 		}
 	}
 
-	// check if metadata.ktor file is correct
-	metadataCheck, err := CheckChunksMetadata(remoteUrl, workPath, fileSize, chunkSize)
-	if metadataCheck == false {
+	// load metadata.ktor, migrating legacy files
+	metadata, err := LoadWorkDirMetadata(workPath)
+	if err == ErrMetadataNotFound {
+		metadata = NewWorkDirMetadata(remoteUrl, info, chunkSize)
+	} else if err != nil {
 		return nil, fmt.Errorf("error checking metadata: %s", err)
+	} else if err := metadata.Matches(remoteUrl, info, chunkSize); err != nil {
+		if _, ok := err.(*RemoteFileChangedError); ok {
+			return nil, err
+		}
+		return nil, fmt.Errorf("error checking metadata: %s", err)
+	}
+	// fill in validators missing from older metadata
+	if metadata.ETag == "" {
+		metadata.ETag = info.ETag
+	}
+	if metadata.LastModified == "" {
+		metadata.LastModified = info.LastModified
+	}
+	if metadata.Migrated {
+		logger.Info("Migrating legacy metadata in ", workPath)
+	}
+
+	savedChunks := make(map[int]ChunkMetadata, len(metadata.Chunks))
+	for _, chunkMetadata := range metadata.Chunks {
+		savedChunks[chunkMetadata.Index] = chunkMetadata
+	}
+
+	var chunks *[]*Chunk
+	if len(metadata.Chunks) > 0 {
+		chunks, err = chunksFromMetadata(metadata, workPath)
+		if err != nil {
+			return nil, fmt.Errorf("error checking metadata: %s", err)
+		}
+	} else {
+		chunks = GenerateChunks(fileSize, chunkSize, workPath)
 	}
 
-	chunks := GenerateChunks(fileSize, chunkSize, workPath, remoteUrl)
-	for idx, chunk := range *chunks {
+	nextIndex := 0
+	for _, chunk := range *chunks {
+		if chunk.index >= nextIndex {
+			nextIndex = chunk.index + 1
+		}
 
 		if exists, _ := FileExists(chunk.chunkPath); !exists {
 			// chunk file does not exist
 			chunk.status = ChunkStatusNotStarted
-		} else {
-			// chunk file exists
-			// check if chunk file size is correct
-			chunkFileSize, err := GetFileSize(chunk.chunkPath)
+			continue
+		}
+
+		// chunk file exists
+		// check if chunk file size is correct
+		chunkFileSize, err := GetFileSize(chunk.chunkPath)
+		if err != nil {
+			return nil, fmt.Errorf("cannot get file size of %s: %s", chunk.chunkPath, err)
+		}
+		expectedSize := chunk.endOffset - chunk.startOffset + 1
+		if chunkFileSize == expectedSize {
+			// chunk file size is correct, check its content against the recorded hash
+			digest, err := HashFile(chunk.chunkPath)
 			if err != nil {
-				return nil, fmt.Errorf("cannot get file size of %s: %s", chunk.chunkPath, err)
+				return nil, fmt.Errorf("cannot hash %s: %s", chunk.chunkPath, err)
 			}
-			expectedSize := chunk.endOffset - chunk.startOffset + 1
-			if chunkFileSize == expectedSize {
-				// chunk file size is correct
-				chunk.status = ChunkStatusCompleted
-			} else if chunkFileSize > 0 && chunkFileSize < expectedSize {
-				// chunk file is partially downloaded
-				(*chunks)[idx].status = ChunkStatusNotStarted
-				(*chunks)[idx].bytesDownloaded = chunkFileSize
-			} else {
-				// chunk file size is not correct
-				(*chunks)[idx].status = ChunkStatusNotStarted
+			if saved, ok := savedChunks[chunk.index]; ok && saved.SHA256 != "" && saved.SHA256 != digest {
+				logger.Warn("Chunk #", chunk.index, " is corrupted, downloading it again")
+				if err := os.Remove(chunk.chunkPath); err != nil {
+					return nil, fmt.Errorf("cannot remove corrupted chunk %s: %s", chunk.chunkPath, err)
+				}
+				chunk.status = ChunkStatusNotStarted
+				continue
 			}
+			chunk.status = ChunkStatusCompleted
+			chunk.sha256 = digest
+		} else if chunkFileSize > 0 && chunkFileSize < expectedSize {
+			// chunk file is partially downloaded
+			chunk.status = ChunkStatusNotStarted
+			chunk.bytesDownloaded = chunkFileSize
+		} else {
+			// chunk file size is not correct
+			chunk.status = ChunkStatusNotStarted
 		}
 	}
 
-	return &ChunkController{
+	c := &ChunkController{
 		workPath:  workPath,
 		fileSize:  fileSize,
 		chunkSize: chunkSize,
 		chunks:    chunks,
-	}, nil
+		metadata:  metadata,
+		nextIndex: nextIndex,
+		changed:   make(chan struct{}),
+		logger:    logger,
+	}
+	if err := c.Checkpoint(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Checkpoint writes the current state of every chunk to the work dir metadata.
+func (c *ChunkController) Checkpoint() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	chunksMetadata := make([]ChunkMetadata, 0, len(*c.chunks))
+	for _, chunk := range *c.chunks {
+		chunksMetadata = append(chunksMetadata, ChunkMetadata{
+			Index:           chunk.index,
+			StartOffset:     chunk.startOffset,
+			EndOffset:       chunk.endOffset,
+			Status:          chunk.status,
+			BytesDownloaded: chunk.bytesDownloaded,
+			SHA256:          chunk.sha256,
+		})
+	}
+	c.metadata.Chunks = chunksMetadata
+	return c.metadata.Save(c.workPath)
+}
+
+// IfRange returns the validator workers must send with ranged requests.
+func (c *ChunkController) IfRange() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.metadata.IfRange()
+}
+
+// ChunkRange returns the current range of chunk, which shrinks when its tail is stolen.
+func (c *ChunkController) ChunkRange(chunk *Chunk) (uint64, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return chunk.startOffset, chunk.endOffset
+}
+
+// Claim reserves n bytes at offset (relative to the chunk start) for writing and returns
+// how many of them fit in the current range of chunk.
+func (c *ChunkController) Claim(chunk *Chunk, offset uint64, n uint64) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	size := chunk.endOffset - chunk.startOffset + 1
+	if offset >= size {
+		return 0
+	}
+	if n > size-offset {
+		n = size - offset
+	}
+	if offset+n > chunk.claimed {
+		chunk.claimed = offset + n
+	}
+	return n
+}
+
+// StealChunk splits the in-progress chunk with the most bytes left and returns the second
+// half of its remaining range as a new in-progress chunk. It returns nil if no chunk has at
+// least twice MinSplitSize left.
+func (c *ChunkController) StealChunk() *Chunk {
+	c.mu.Lock()
+	var victim *Chunk
+	var victimPos int
+	var victimRemaining uint64
+	for pos, chunk := range *c.chunks {
+		if chunk.status != ChunkStatusInProgress {
+			continue
+		}
+		reserved := chunk.claimed
+		if chunk.bytesDownloaded > reserved {
+			reserved = chunk.bytesDownloaded
+		}
+		remaining := chunk.endOffset - chunk.startOffset + 1 - reserved
+		if remaining > victimRemaining {
+			victim, victimPos, victimRemaining = chunk, pos, remaining
+		}
+	}
+	if victim == nil || victimRemaining < 2*MinSplitSize {
+		c.mu.Unlock()
+		return nil
+	}
+
+	splitAt := victim.endOffset + 1 - victimRemaining/2
+	tail := &Chunk{
+		startOffset: splitAt,
+		endOffset:   victim.endOffset,
+		chunkPath:   fmt.Sprintf("%s/%d.part", c.workPath, c.nextIndex),
+		index:       c.nextIndex,
+		status:      ChunkStatusInProgress,
+		attempts:    1,
+	}
+	c.nextIndex++
+	victim.endOffset = splitAt - 1
+
+	// keep chunks sorted by offset, MergeChunks relies on it
+	chunks := append(*c.chunks, nil)
+	copy(chunks[victimPos+2:], chunks[victimPos+1:])
+	chunks[victimPos+1] = tail
+	*c.chunks = chunks
+	c.mu.Unlock()
+
+	c.logger.Debug(fmt.Sprintf("Split chunk %d at %d, new chunk %d (%d-%d)", victim.index, splitAt, tail.index, tail.startOffset, tail.endOffset))
+	// a leftover part from a split that was never checkpointed would corrupt the new chunk
+	os.Remove(tail.chunkPath)
+	if err := c.Checkpoint(); err != nil {
+		c.logger.Warn("Cannot checkpoint metadata: ", err)
+	}
+	return tail
+}
+
+// HasChunksInProgress reports whether some chunk is still assigned to a worker.
+func (c *ChunkController) HasChunksInProgress() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, chunk := range *c.chunks {
+		if chunk.status == ChunkStatusInProgress {
+			return true
+		}
+	}
+	return false
+}
+
+// SetChunkProgress records how many bytes of chunk are on disk.
+func (c *ChunkController) SetChunkProgress(chunk *Chunk, bytesDownloaded uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	chunk.bytesDownloaded = bytesDownloaded
+}
+
+// CompleteChunk hashes the downloaded chunk, marks it as completed and checkpoints the metadata.
+func (c *ChunkController) CompleteChunk(chunk *Chunk) error {
+	digest, err := HashFile(chunk.chunkPath)
+	if err != nil {
+		return fmt.Errorf("cannot hash %s: %s", chunk.chunkPath, err)
+	}
+	c.mu.Lock()
+	chunk.sha256 = digest
+	c.mu.Unlock()
+	c.SetChunkStatus(chunk, ChunkStatusCompleted, nil)
+	return nil
+}
+
+// SetChunkStatus updates the status of chunk and checkpoints the metadata.
+func (c *ChunkController) SetChunkStatus(chunk *Chunk, status ChunkStatus, err error) {
+	c.mu.Lock()
+	chunk.status = status
+	chunk.lastErr = err
+	if status == ChunkStatusCompleted {
+		chunk.bytesDownloaded = chunk.endOffset - chunk.startOffset + 1
+	} else {
+		chunk.sha256 = ""
+	}
+	if status == ChunkStatusNotStarted {
+		// back in the queue: nothing beyond what is on disk is reserved anymore
+		chunk.claimed = chunk.bytesDownloaded
+	}
+	c.notifyLocked()
+	c.mu.Unlock()
+
+	if err := c.Checkpoint(); err != nil {
+		c.logger.Warn("Cannot checkpoint metadata: ", err)
+	}
+}
+
+// RequeueChunk puts a chunk that failed back in the queue, so that any worker can retry it,
+// or marks it as failed once it used up maxAttempts.
+func (c *ChunkController) RequeueChunk(chunk *Chunk, err error, maxAttempts int) {
+	c.mu.Lock()
+	attempts := chunk.attempts
+	c.mu.Unlock()
+
+	if attempts >= maxAttempts {
+		c.SetChunkStatus(chunk, ChunkStatusError, err)
+		return
+	}
+	c.SetChunkStatus(chunk, ChunkStatusNotStarted, err)
+}
+
+// ReturnChunk puts a chunk back in the queue without counting the failed attempt, for failures
+// that are not caused by the chunk, such as the tor serving it going down.
+func (c *ChunkController) ReturnChunk(chunk *Chunk, err error) {
+	c.mu.Lock()
+	if chunk.attempts > 0 {
+		chunk.attempts--
+	}
+	c.mu.Unlock()
+	c.SetChunkStatus(chunk, ChunkStatusNotStarted, err)
 }
 
 func (c *ChunkController) GetNextEmptyChunk() *Chunk {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.nextEmptyChunkLocked()
+}
+
+func (c *ChunkController) nextEmptyChunkLocked() *Chunk {
 	for _, chunk := range *c.chunks {
 		if chunk.status == ChunkStatusNotStarted {
 			chunk.status = ChunkStatusInProgress
+			chunk.attempts++
 			return chunk
 		}
 	}
 	return nil
 }
 
+// NextChunk is the shared work queue of the download: it returns the next chunk to download,
+// splitting a chunk in progress when the queue is empty. When nothing can be handed out it
+// waits until another worker finishes or gives back a chunk. It returns nil once every chunk
+// is done or ctx is cancelled.
+func (c *ChunkController) NextChunk(ctx context.Context) *Chunk {
+	for {
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		c.mu.Lock()
+		chunk := c.nextEmptyChunkLocked()
+		changed := c.changed
+		c.mu.Unlock()
+		if chunk != nil {
+			return chunk
+		}
+
+		if chunk := c.StealChunk(); chunk != nil {
+			return chunk
+		}
+		if !c.HasChunksInProgress() {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (c *ChunkController) notifyLocked() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
 func (c *ChunkController) GetDownloadedSize() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	var downloadedSize uint64 = 0
 	for _, chunk := range *c.chunks {
 		switch chunk.status {
@@ -201,7 +500,9 @@ func (c *ChunkController) GetDownloadedSize() uint64 {
 	return downloadedSize
 }
 
-func (c *ChunkController) MergeChunks(destinationPath string) (bool, error) {
+// MergeChunks concatenates the chunks into destinationPath, feeding the same bytes to digests.
+// The work dir is left in place, see RemoveWorkDir.
+func (c *ChunkController) MergeChunks(destinationPath string, digests ...hash.Hash) (bool, error) {
 	for _, chunk := range *c.chunks {
 		if chunk.status != ChunkStatusCompleted {
 			return false, fmt.Errorf("cannot merge chunks, chunk %s is not downloaded", chunk.chunkPath)
@@ -209,12 +510,18 @@ func (c *ChunkController) MergeChunks(destinationPath string) (bool, error) {
 	}
 
 	// open destination file
-	destinationFile, err := os.OpenFile(destinationPath, os.O_WRONLY|os.O_CREATE, 0644)
+	destinationFile, err := os.OpenFile(destinationPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 	if err != nil {
 		return false, fmt.Errorf("cannot open file %s: %s", destinationPath, err)
 	}
 	defer destinationFile.Close()
 
+	writers := []io.Writer{destinationFile}
+	for _, digest := range digests {
+		writers = append(writers, digest)
+	}
+	destination := io.MultiWriter(writers...)
+
 	for _, chunk := range *c.chunks {
 		// open chunk file
 		chunkFile, err := os.Open(chunk.chunkPath)
@@ -223,15 +530,16 @@ func (c *ChunkController) MergeChunks(destinationPath string) (bool, error) {
 		}
 
 		// copy chunk file to destination file
-		_, err = io.Copy(destinationFile, chunkFile)
+		_, err = io.Copy(destination, chunkFile)
+		chunkFile.Close()
 		if err != nil {
 			return false, fmt.Errorf("cannot copy file %s to %s: %s", chunk.chunkPath, destinationPath, err)
 		}
-
-		chunkFile.Close()
-		// os.Remove(chunk.chunkPath)
 	}
 
-	os.RemoveAll(c.workPath)
 	return true, nil
 }
+
+func (c *ChunkController) RemoveWorkDir() error {
+	return os.RemoveAll(c.workPath)
+}
@@ -0,0 +1,123 @@
+package kerbetor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+const testChunkURL = "http://example.onion/file.bin"
+
+func newTestChunkController(t *testing.T, workPath string, fileSize uint64, chunkSize uint64) *ChunkController {
+	t.Helper()
+	logger := logrus.New()
+	logger.Out = io.Discard
+	c, err := NewChunkController(testChunkURL, workPath, &RemoteFileInfo{Size: fileSize, ETag: `"v1"`}, chunkSize, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestRequeueResetsClaim(t *testing.T) {
+	const fileSize = 8 * MinSplitSize
+	c := newTestChunkController(t, filepath.Join(t.TempDir(), "file.bin.ktor"), fileSize, fileSize)
+
+	chunk := c.NextChunk(context.Background())
+	c.Claim(chunk, 0, 6*MinSplitSize)
+	c.SetChunkProgress(chunk, MinSplitSize)
+	c.RequeueChunk(chunk, errors.New("connection reset"), 3)
+
+	if retried := c.NextChunk(context.Background()); retried != chunk {
+		t.Fatalf("got chunk %v, want the requeued chunk", retried)
+	}
+	// the retry only has the bytes on disk: the rest is split in halves
+	tail := c.StealChunk()
+	if tail == nil {
+		t.Fatal("chunk not split")
+	}
+	if want := uint64(fileSize - 7*MinSplitSize/2); tail.startOffset != want {
+		t.Errorf("split at %d, want %d", tail.startOffset, want)
+	}
+}
+
+func TestResumeSplitChunks(t *testing.T) {
+	const fileSize = 4*MinSplitSize + 123
+	content := make([]byte, fileSize)
+	rand.New(rand.NewSource(1)).Read(content)
+	dir := t.TempDir()
+	workPath := filepath.Join(dir, "file.bin.ktor")
+
+	c := newTestChunkController(t, workPath, fileSize, fileSize)
+	head := c.NextChunk(context.Background())
+	if err := os.WriteFile(head.chunkPath, content[:MinSplitSize/2], 0644); err != nil {
+		t.Fatal(err)
+	}
+	c.SetChunkProgress(head, MinSplitSize/2)
+	tail := c.StealChunk()
+	if tail == nil {
+		t.Fatal("chunk not split")
+	}
+	tailStart, tailEnd := c.ChunkRange(tail)
+	if err := os.WriteFile(tail.chunkPath, content[tailStart:tailEnd+1], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.CompleteChunk(tail); err != nil {
+		t.Fatal(err)
+	}
+	// interrupted: the head is left partial, recorded by the last checkpoint
+	if err := c.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+
+	resumed := newTestChunkController(t, workPath, fileSize, fileSize)
+	if len(*resumed.chunks) != 2 {
+		t.Fatalf("got %d chunks after resume, want 2", len(*resumed.chunks))
+	}
+	resumedHead, resumedTail := (*resumed.chunks)[0], (*resumed.chunks)[1]
+	if resumedHead.endOffset != tailStart-1 || resumedTail.startOffset != tailStart || resumedTail.endOffset != tailEnd {
+		t.Errorf("got layout %d-%d %d-%d, want the split at %d", resumedHead.startOffset, resumedHead.endOffset, resumedTail.startOffset, resumedTail.endOffset, tailStart)
+	}
+	if resumedTail.status != ChunkStatusCompleted {
+		t.Errorf("tail is %s, want completed", resumedTail.status)
+	}
+	if resumedHead.status != ChunkStatusNotStarted || resumedHead.bytesDownloaded != MinSplitSize/2 {
+		t.Errorf("head is %s with %d bytes, want not-started with %d bytes", resumedHead.status, resumedHead.bytesDownloaded, MinSplitSize/2)
+	}
+	if got := resumed.GetDownloadedSize(); got != MinSplitSize/2+tailEnd-tailStart+1 {
+		t.Errorf("got %d bytes downloaded", got)
+	}
+
+	// finish the head where it stopped
+	if next := resumed.NextChunk(context.Background()); next != resumedHead {
+		t.Fatalf("got chunk %v, want the partial head", next)
+	}
+	file, err := os.OpenFile(resumedHead.chunkPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write(content[MinSplitSize/2 : tailStart])
+	file.Close()
+	if err := resumed.CompleteChunk(resumedHead); err != nil {
+		t.Fatal(err)
+	}
+
+	output := filepath.Join(dir, "file.bin")
+	if _, err := resumed.MergeChunks(output); err != nil {
+		t.Fatal(err)
+	}
+	merged, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(merged, content) {
+		t.Error("merged file differs from the original")
+	}
+}
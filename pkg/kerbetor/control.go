@@ -0,0 +1,407 @@
+package kerbetor
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// controlCommandTimeout bounds how long Command waits for tor to answer.
+const controlCommandTimeout = 30 * time.Second
+
+// ControlReply is a reply of the TOR control protocol. Lines holds the text of every
+// reply line, data blocks ("250+key=" lines) are joined to their line with newlines.
+type ControlReply struct {
+	Status int
+	Lines  []string
+}
+
+func (r *ControlReply) String() string {
+	return fmt.Sprintf("%d %s", r.Status, strings.Join(r.Lines, "; "))
+}
+
+// ControlEvent is an asynchronous event (status 650) received after SetEvents.
+type ControlEvent struct {
+	Type string
+	Data string
+}
+
+// ControlError is returned when tor answers a command with an error status.
+type ControlError struct {
+	Command string
+	Reply   *ControlReply
+}
+
+func (e *ControlError) Error() string {
+	return fmt.Sprintf("tor control command %q failed: %s", e.Command, e.Reply)
+}
+
+// ProtocolInfo is the answer to PROTOCOLINFO.
+type ProtocolInfo struct {
+	AuthMethods []string
+	CookieFile  string
+	TorVersion  string
+}
+
+// BootstrapPhase is the parsed value of GETINFO status/bootstrap-phase.
+type BootstrapPhase struct {
+	Severity string
+	Progress int
+	Tag      string
+	Summary  string
+	Warning  string
+}
+
+// CircuitInfo is an entry of GETINFO circuit-status.
+type CircuitInfo struct {
+	ID      string
+	Status  string
+	Path    []string
+	Purpose string
+}
+
+// ControlConn is a minimal client of the TOR control protocol, covering what kerbetor needs:
+// authentication, GETINFO, SIGNAL and event subscription.
+type ControlConn struct {
+	conn net.Conn
+	// mu serializes commands, tor answers them in order
+	mu sync.Mutex
+	// pending receives the reply of the command in flight, nil when there is none
+	pendingMu sync.Mutex
+	pending   chan *ControlReply
+	events    chan *ControlEvent
+	done      chan struct{}
+	readErr   error
+}
+
+// DialControl connects to the control port at addr. The connection must then be authenticated.
+func DialControl(ctx context.Context, addr string) (*ControlConn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to tor control port %s: %s", addr, err)
+	}
+	c := &ControlConn{
+		conn:   conn,
+		events: make(chan *ControlEvent, 64),
+		done:   make(chan struct{}),
+	}
+	go c.readLoop()
+	return c, nil
+}
+
+func (c *ControlConn) Close() error {
+	return c.conn.Close()
+}
+
+// Events returns the channel receiving asynchronous events. It is closed with the connection.
+// Events are dropped when nobody reads them.
+func (c *ControlConn) Events() <-chan *ControlEvent {
+	return c.events
+}
+
+func (c *ControlConn) readLoop() {
+	defer close(c.done)
+	defer close(c.events)
+
+	reader := bufio.NewReader(c.conn)
+	for {
+		reply, err := readControlReply(reader)
+		if err != nil {
+			c.readErr = err
+			return
+		}
+		if reply.Status == 650 {
+			event := &ControlEvent{Data: strings.Join(reply.Lines, "\n")}
+			event.Type, _, _ = strings.Cut(reply.Lines[0], " ")
+			select {
+			case c.events <- event:
+			default:
+			}
+			continue
+		}
+		c.pendingMu.Lock()
+		pending := c.pending
+		c.pending = nil
+		c.pendingMu.Unlock()
+		if pending != nil {
+			// buffered, never blocks
+			pending <- reply
+		}
+		// otherwise nobody is waiting for this reply, drop it
+	}
+}
+
+func readControlReply(reader *bufio.Reader) (*ControlReply, error) {
+	reply := &ControlReply{}
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if len(line) < 4 {
+			return nil, fmt.Errorf("malformed tor control reply line: %q", line)
+		}
+		status, err := strconv.Atoi(line[:3])
+		if err != nil {
+			return nil, fmt.Errorf("malformed tor control reply line: %q", line)
+		}
+		reply.Status = status
+		separator, text := line[3], line[4:]
+
+		switch separator {
+		case ' ':
+			reply.Lines = append(reply.Lines, text)
+			return reply, nil
+		case '-':
+			reply.Lines = append(reply.Lines, text)
+		case '+':
+			// data block, terminated by a line containing a single "."
+			var data []string
+			for {
+				dataLine, err := reader.ReadString('\n')
+				if err != nil {
+					return nil, err
+				}
+				dataLine = strings.TrimRight(dataLine, "\r\n")
+				if dataLine == "." {
+					break
+				}
+				data = append(data, strings.TrimPrefix(dataLine, "."))
+			}
+			reply.Lines = append(reply.Lines, text+"\n"+strings.Join(data, "\n"))
+		default:
+			return nil, fmt.Errorf("malformed tor control reply line: %q", line)
+		}
+	}
+}
+
+// Command sends a command and waits for its reply, at most controlCommandTimeout. Replies with a
+// status other than 2xx are returned as a *ControlError.
+func (c *ControlConn) Command(command string) (*ControlReply, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), controlCommandTimeout)
+	defer cancel()
+	return c.CommandContext(ctx, command)
+}
+
+// CommandContext is Command, waiting for the reply until ctx is done. A command that gets no
+// reply closes the connection, since later replies could no longer be matched to their commands.
+func (c *ControlConn) CommandContext(ctx context.Context, command string) (*ControlReply, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	replies := make(chan *ControlReply, 1)
+	c.pendingMu.Lock()
+	c.pending = replies
+	c.pendingMu.Unlock()
+	defer func() {
+		c.pendingMu.Lock()
+		c.pending = nil
+		c.pendingMu.Unlock()
+	}()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		c.conn.SetWriteDeadline(deadline)
+	}
+	if _, err := c.conn.Write([]byte(command + "\r\n")); err != nil {
+		return nil, fmt.Errorf("cannot send tor control command: %s", err)
+	}
+	select {
+	case <-ctx.Done():
+		c.conn.Close()
+		return nil, fmt.Errorf("no reply to tor control command %q: %s", strings.Fields(command)[0], ctx.Err())
+	case reply := <-replies:
+		if reply.Status < 200 || reply.Status > 299 {
+			return reply, &ControlError{Command: strings.Fields(command)[0], Reply: reply}
+		}
+		return reply, nil
+	case <-c.done:
+		if c.readErr != nil {
+			return nil, fmt.Errorf("tor control connection closed: %s", c.readErr)
+		}
+		return nil, errors.New("tor control connection closed")
+	}
+}
+
+func (c *ControlConn) ProtocolInfo() (*ProtocolInfo, error) {
+	reply, err := c.Command("PROTOCOLINFO 1")
+	if err != nil {
+		return nil, err
+	}
+	info := &ProtocolInfo{}
+	for _, line := range reply.Lines {
+		switch {
+		case strings.HasPrefix(line, "AUTH "):
+			values := parseControlKeyValues(strings.TrimPrefix(line, "AUTH "))
+			info.AuthMethods = strings.Split(values["METHODS"], ",")
+			info.CookieFile = values["COOKIEFILE"]
+		case strings.HasPrefix(line, "VERSION "):
+			info.TorVersion = parseControlKeyValues(strings.TrimPrefix(line, "VERSION "))["Tor"]
+		}
+	}
+	return info, nil
+}
+
+// Authenticate authenticates with the first method tor accepts among no authentication,
+// cookie and password.
+func (c *ControlConn) Authenticate(password string) error {
+	info, err := c.ProtocolInfo()
+	if err != nil {
+		return err
+	}
+	methods := make(map[string]bool)
+	for _, method := range info.AuthMethods {
+		methods[method] = true
+	}
+
+	switch {
+	case methods["NULL"]:
+		_, err = c.Command("AUTHENTICATE")
+		return err
+	case methods["COOKIE"] && info.CookieFile != "":
+		return c.AuthenticateCookie(info.CookieFile)
+	case methods["HASHEDPASSWORD"] && password != "":
+		_, err = c.Command("AUTHENTICATE " + quoteControlString(password))
+		return err
+	}
+	return fmt.Errorf("no supported tor control authentication method among %s", strings.Join(info.AuthMethods, ","))
+}
+
+func (c *ControlConn) AuthenticateCookie(cookiePath string) error {
+	cookie, err := os.ReadFile(cookiePath)
+	if err != nil {
+		return fmt.Errorf("cannot read tor control cookie: %s", err)
+	}
+	_, err = c.Command("AUTHENTICATE " + hex.EncodeToString(cookie))
+	return err
+}
+
+func (c *ControlConn) GetInfo(keys ...string) (map[string]string, error) {
+	reply, err := c.Command("GETINFO " + strings.Join(keys, " "))
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string)
+	for _, line := range reply.Lines {
+		key, value, found := strings.Cut(line, "=")
+		if !found {
+			continue
+		}
+		values[key] = strings.TrimPrefix(value, "\n")
+	}
+	return values, nil
+}
+
+func (c *ControlConn) BootstrapPhase() (*BootstrapPhase, error) {
+	values, err := c.GetInfo("status/bootstrap-phase")
+	if err != nil {
+		return nil, err
+	}
+	return parseBootstrapPhase(values["status/bootstrap-phase"])
+}
+
+func parseBootstrapPhase(value string) (*BootstrapPhase, error) {
+	severity, rest, _ := strings.Cut(value, " ")
+	kv := parseControlKeyValues(strings.TrimPrefix(rest, "BOOTSTRAP "))
+	progress, err := strconv.Atoi(kv["PROGRESS"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid bootstrap phase: %q", value)
+	}
+	return &BootstrapPhase{Severity: severity, Progress: progress, Tag: kv["TAG"], Summary: kv["SUMMARY"], Warning: kv["WARNING"]}, nil
+}
+
+func (c *ControlConn) Signal(signal string) error {
+	_, err := c.Command("SIGNAL " + signal)
+	return err
+}
+
+// NewNym asks tor to use new circuits for new connections.
+func (c *ControlConn) NewNym() error {
+	return c.Signal("NEWNYM")
+}
+
+func (c *ControlConn) CircuitStatus() ([]CircuitInfo, error) {
+	values, err := c.GetInfo("circuit-status")
+	if err != nil {
+		return nil, err
+	}
+	var circuits []CircuitInfo
+	for _, line := range strings.Split(values["circuit-status"], "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		circuit := CircuitInfo{ID: fields[0], Status: fields[1]}
+		for _, field := range fields[2:] {
+			if strings.Contains(field, "=") {
+				if key, value, _ := strings.Cut(field, "="); key == "PURPOSE" {
+					circuit.Purpose = value
+				}
+				continue
+			}
+			circuit.Path = strings.Split(field, ",")
+		}
+		circuits = append(circuits, circuit)
+	}
+	return circuits, nil
+}
+
+// SetEvents subscribes to the given asynchronous events, replacing the previous subscription.
+func (c *ControlConn) SetEvents(events ...string) error {
+	_, err := c.Command("SETEVENTS " + strings.Join(events, " "))
+	return err
+}
+
+// parseControlKeyValues parses space separated KEY=VALUE pairs where values may be quoted.
+func parseControlKeyValues(s string) map[string]string {
+	values := make(map[string]string)
+	for {
+		s = strings.TrimLeft(s, " ")
+		if s == "" {
+			return values
+		}
+		eq := strings.IndexAny(s, "= ")
+		if eq < 0 || s[eq] == ' ' {
+			// bare word
+			if eq < 0 {
+				return values
+			}
+			s = s[eq:]
+			continue
+		}
+		key := s[:eq]
+		s = s[eq+1:]
+		if strings.HasPrefix(s, "\"") {
+			var value strings.Builder
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				value.WriteByte(s[i])
+			}
+			values[key] = value.String()
+			if i < len(s) {
+				i++
+			}
+			s = s[i:]
+			continue
+		}
+		value, rest, _ := strings.Cut(s, " ")
+		values[key] = value
+		s = rest
+	}
+}
+
+func quoteControlString(s string) string {
+	return "\"" + strings.NewReplacer("\\", "\\\\", "\"", "\\\"").Replace(s) + "\""
+}
@@ -0,0 +1,229 @@
+package kerbetor
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeControlServer accepts a single control connection on a loopback port and runs serve on it.
+// It returns the client connected to it.
+func fakeControlServer(t *testing.T, serve func(reader *bufio.Reader, conn net.Conn)) *ControlConn {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		serve(bufio.NewReader(conn), conn)
+	}()
+
+	control, err := DialControl(context.Background(), listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		control.Close()
+		<-served
+	})
+	return control
+}
+
+// expectCommand reads a command line and fails the test if it is not want.
+func expectCommand(t *testing.T, reader *bufio.Reader, want string) bool {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		t.Errorf("reading command %q: %s", want, err)
+		return false
+	}
+	if got := strings.TrimRight(line, "\r\n"); got != want {
+		t.Errorf("got command %q, want %q", got, want)
+		return false
+	}
+	return true
+}
+
+func TestControlCookieAuthentication(t *testing.T) {
+	cookie := []byte("0123456789abcdef0123456789abcdef")
+	cookiePath := filepath.Join(t.TempDir(), "control_auth_cookie")
+	if err := os.WriteFile(cookiePath, cookie, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	control := fakeControlServer(t, func(reader *bufio.Reader, conn net.Conn) {
+		if !expectCommand(t, reader, "PROTOCOLINFO 1") {
+			return
+		}
+		conn.Write([]byte("250-PROTOCOLINFO 1\r\n" +
+			"250-AUTH METHODS=COOKIE,SAFECOOKIE COOKIEFILE=\"" + cookiePath + "\"\r\n" +
+			"250-VERSION Tor=\"0.4.8.9\"\r\n" +
+			"250 OK\r\n"))
+		if !expectCommand(t, reader, "AUTHENTICATE "+hex.EncodeToString(cookie)) {
+			conn.Write([]byte("515 Authentication failed\r\n"))
+			return
+		}
+		conn.Write([]byte("250 OK\r\n"))
+	})
+
+	if err := control.Authenticate(""); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestControlAuthenticationFailure(t *testing.T) {
+	control := fakeControlServer(t, func(reader *bufio.Reader, conn net.Conn) {
+		if expectCommand(t, reader, "AUTHENTICATE \"secret\"") {
+			conn.Write([]byte("515 Authentication failed: Password did not match\r\n"))
+		}
+	})
+
+	_, err := control.Command("AUTHENTICATE " + quoteControlString("secret"))
+	var controlErr *ControlError
+	if !errors.As(err, &controlErr) {
+		t.Fatalf("got %v, want a *ControlError", err)
+	}
+	if controlErr.Reply.Status != 515 || controlErr.Command != "AUTHENTICATE" {
+		t.Errorf("got %+v", controlErr)
+	}
+}
+
+func TestControlMultiLineReplies(t *testing.T) {
+	control := fakeControlServer(t, func(reader *bufio.Reader, conn net.Conn) {
+		if !expectCommand(t, reader, "GETINFO circuit-status") {
+			return
+		}
+		conn.Write([]byte("250+circuit-status=\r\n" +
+			"1 BUILT $AAAA~relay1,$BBBB~relay2 PURPOSE=GENERAL\r\n" +
+			"2 EXTENDED $CCCC~relay3 PURPOSE=HS_CLIENT_REND\r\n" +
+			".\r\n" +
+			"250 OK\r\n"))
+		if !expectCommand(t, reader, "GETINFO status/bootstrap-phase") {
+			return
+		}
+		conn.Write([]byte("250-status/bootstrap-phase=WARN BOOTSTRAP PROGRESS=80 TAG=ap_conn SUMMARY=\"Connecting to a relay\" WARNING=\"Connection refused\"\r\n" +
+			"250 OK\r\n"))
+	})
+
+	circuits, err := control.CircuitStatus()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(circuits) != 2 {
+		t.Fatalf("got %d circuits, want 2: %+v", len(circuits), circuits)
+	}
+	if c := circuits[0]; c.ID != "1" || c.Status != "BUILT" || c.Purpose != "GENERAL" || strings.Join(c.Path, ",") != "$AAAA~relay1,$BBBB~relay2" {
+		t.Errorf("got %+v", c)
+	}
+	if c := circuits[1]; c.ID != "2" || c.Status != "EXTENDED" || c.Purpose != "HS_CLIENT_REND" {
+		t.Errorf("got %+v", c)
+	}
+
+	phase, err := control.BootstrapPhase()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := BootstrapPhase{Severity: "WARN", Progress: 80, Tag: "ap_conn", Summary: "Connecting to a relay", Warning: "Connection refused"}
+	if *phase != want {
+		t.Errorf("got %+v, want %+v", *phase, want)
+	}
+}
+
+func TestControlEvents(t *testing.T) {
+	control := fakeControlServer(t, func(reader *bufio.Reader, conn net.Conn) {
+		if !expectCommand(t, reader, "SETEVENTS STATUS_CLIENT WARN") {
+			return
+		}
+		// events can come before the reply of the command in flight
+		conn.Write([]byte("650 STATUS_CLIENT NOTICE CIRCUIT_ESTABLISHED\r\n" +
+			"250 OK\r\n" +
+			// a reply nobody waits for must not hold back the events behind it
+			"250 OK\r\n" +
+			"650-WARN Problem bootstrapping\r\n" +
+			"650 WARN second line\r\n"))
+		if expectCommand(t, reader, "SIGNAL NEWNYM") {
+			conn.Write([]byte("250 OK\r\n"))
+		}
+	})
+
+	if err := control.SetEvents("STATUS_CLIENT", "WARN"); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []ControlEvent{
+		{Type: "STATUS_CLIENT", Data: "STATUS_CLIENT NOTICE CIRCUIT_ESTABLISHED"},
+		{Type: "WARN", Data: "WARN Problem bootstrapping\nWARN second line"},
+	} {
+		select {
+		case event := <-control.Events():
+			if *event != want {
+				t.Errorf("got event %+v, want %+v", *event, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %s event", want.Type)
+		}
+	}
+	if err := control.NewNym(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestControlConnectionLost(t *testing.T) {
+	control := fakeControlServer(t, func(reader *bufio.Reader, conn net.Conn) {
+		expectCommand(t, reader, "SIGNAL NEWNYM")
+	})
+
+	if err := control.NewNym(); err == nil || !strings.Contains(err.Error(), "connection closed") {
+		t.Fatalf("got %v, want a connection closed error", err)
+	}
+	select {
+	case _, ok := <-control.Events():
+		if ok {
+			t.Error("got an event, want the events channel closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("events channel not closed")
+	}
+}
+
+func TestControlCommandTimeout(t *testing.T) {
+	control := fakeControlServer(t, func(reader *bufio.Reader, conn net.Conn) {
+		// never answer
+		expectCommand(t, reader, "SIGNAL NEWNYM")
+		reader.ReadString('\n')
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := control.CommandContext(ctx, "SIGNAL NEWNYM"); err == nil {
+		t.Fatal("got a reply, want a timeout")
+	}
+	// the connection is closed, later commands fail right away
+	if _, err := control.CommandContext(context.Background(), "GETINFO version"); err == nil {
+		t.Fatal("command succeeded on a timed out connection")
+	}
+}
+
+func TestParseControlKeyValues(t *testing.T) {
+	values := parseControlKeyValues(`METHODS=COOKIE,SAFECOOKIE COOKIEFILE="/var/lib/tor/my \"dir\"/control_auth_cookie" bare`)
+	if values["METHODS"] != "COOKIE,SAFECOOKIE" {
+		t.Errorf("got METHODS=%q", values["METHODS"])
+	}
+	if want := `/var/lib/tor/my "dir"/control_auth_cookie`; values["COOKIEFILE"] != want {
+		t.Errorf("got COOKIEFILE=%q, want %q", values["COOKIEFILE"], want)
+	}
+}
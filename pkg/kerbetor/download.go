@@ -1,6 +1,8 @@
 package kerbetor
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -10,38 +12,108 @@ import (
 	"time"
 )
 
-const DownloadedBytesRefreshRate = 200 * time.Millisecond
+const (
+	DownloadedBytesRefreshRate = 200 * time.Millisecond
+	MetadataCheckpointInterval = 5 * time.Second
+)
+
+// RemoteFileInfo describes the remote representation being downloaded.
+type RemoteFileInfo struct {
+	Size         uint64
+	ETag         string
+	LastModified string
+	// NoRanges is set when the server answers range requests with the whole file.
+	NoRanges bool
+}
+
+// IfRange returns the validator to send in If-Range headers: a strong ETag if available,
+// otherwise Last-Modified.
+func (i *RemoteFileInfo) IfRange() string {
+	if i == nil {
+		return ""
+	}
+	if i.ETag != "" && !strings.HasPrefix(i.ETag, "W/") {
+		return i.ETag
+	}
+	return i.LastModified
+}
+
+func GetRemoteFileSize(ctx context.Context, sourceUrl string, httpClient *http.Client) (uint64, error) {
+	info, err := GetRemoteFileInfo(ctx, sourceUrl, httpClient)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size, nil
+}
+
+func GetRemoteFileInfo(ctx context.Context, sourceUrl string, httpClient *http.Client) (*RemoteFileInfo, error) {
+	return getRemoteFileInfo(ctx, sourceUrl, nil, httpClient)
+}
 
-func GetRemoteFileSize(sourceUrl string, httpClient *http.Client) (uint64, error) {
+// getRemoteFileInfo probes sourceUrl sending the extra headers header, which may be nil.
+func getRemoteFileInfo(ctx context.Context, sourceUrl string, header http.Header, httpClient *http.Client) (*RemoteFileInfo, error) {
 	if httpClient == nil {
 		httpClient = &http.Client{}
 	}
 
-	resp, err := httpClient.Head(sourceUrl)
+	headReq, err := http.NewRequestWithContext(ctx, "HEAD", sourceUrl, nil)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request: %s", err)
+	}
+	setHeader(headReq, header)
+	resp, err := httpClient.Do(headReq)
 	if resp != nil {
 		defer resp.Body.Close()
 	}
-	if err == nil {
+	if err == nil && resp.StatusCode == http.StatusOK {
 		if size, ok := parseContentLength(resp.Header.Get("Content-Length")); ok {
-			return size, nil
+			info := newRemoteFileInfo(size, resp.Header)
+			switch resp.Header.Get("Accept-Ranges") {
+			case "bytes":
+			case "none":
+				info.NoRanges = true
+			default:
+				// servers do not have to advertise range support, try it
+				rangeInfo, err := getRemoteFileInfoFromRange(ctx, sourceUrl, header, httpClient)
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				info.NoRanges = err == nil && rangeInfo.NoRanges
+			}
+			return info, nil
 		}
 	}
 
-	size, err := getRemoteFileSizeFromRange(sourceUrl, httpClient)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	info, err := getRemoteFileInfoFromRange(ctx, sourceUrl, header, httpClient)
+	if errors.Is(err, ErrUnknownSize) {
+		return nil, err
+	}
 	if err != nil {
-		return 0, fmt.Errorf("remote file size unknown: %s", err)
+		return nil, fmt.Errorf("cannot probe remote file: %s", err)
 	}
-	return size, nil
+	return info, nil
 }
 
-func DownloadFileChunk(sourceUrl string, destinationPath string, startOffset int64, endOffset int64, httpClient *http.Client) (int64, error) {
+func newRemoteFileInfo(size uint64, header http.Header) *RemoteFileInfo {
+	return &RemoteFileInfo{
+		Size:         size,
+		ETag:         header.Get("ETag"),
+		LastModified: header.Get("Last-Modified"),
+	}
+}
+
+func DownloadFileChunk(ctx context.Context, sourceUrl string, destinationPath string, startOffset int64, endOffset int64, httpClient *http.Client) (int64, error) {
 	// init http client
 	if httpClient == nil {
 		httpClient = &http.Client{}
 	}
 
 	// get remote file size to check start-end offsets
-	contentLength, err := GetRemoteFileSize(sourceUrl, httpClient)
+	contentLength, err := GetRemoteFileSize(ctx, sourceUrl, httpClient)
 	if err != nil {
 		return 0, fmt.Errorf("error getting remote file size: %s", err)
 	}
@@ -50,7 +122,7 @@ func DownloadFileChunk(sourceUrl string, destinationPath string, startOffset int
 	}
 
 	// download file chunk
-	req, _ := http.NewRequest("GET", sourceUrl, nil)
+	req, _ := http.NewRequestWithContext(ctx, "GET", sourceUrl, nil)
 	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", startOffset, endOffset))
 	resp, err := httpClient.Do(req)
 	if err != nil {
@@ -84,30 +156,54 @@ func parseContentLength(header string) (uint64, bool) {
 	return uint64(value), true
 }
 
-func getRemoteFileSizeFromRange(sourceUrl string, httpClient *http.Client) (uint64, error) {
-	req, _ := http.NewRequest("GET", sourceUrl, nil)
+func getRemoteFileInfoFromRange(ctx context.Context, sourceUrl string, header http.Header, httpClient *http.Client) (*RemoteFileInfo, error) {
+	req, _ := http.NewRequestWithContext(ctx, "GET", sourceUrl, nil)
+	setHeader(req, header)
 	req.Header.Set("Range", "bytes=0-0")
 	resp, err := httpClient.Do(req)
 	if err != nil {
-		return 0, fmt.Errorf("range probe failed: %s", err)
+		return nil, fmt.Errorf("range probe failed: %s", err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusPartialContent {
-		if size, ok := parseContentLength(resp.Header.Get("Content-Length")); ok && resp.StatusCode == http.StatusOK {
-			return size, fmt.Errorf("server did not honor range request")
+	if resp.StatusCode == http.StatusOK {
+		// the whole file is coming, its length is all we need
+		size, ok := parseContentLength(resp.Header.Get("Content-Length"))
+		if !ok {
+			return nil, fmt.Errorf("%w: %w and sent no Content-Length", ErrUnknownSize, ErrRangeNotSupported)
 		}
-		return 0, fmt.Errorf("server did not honor range request (status %d)", resp.StatusCode)
+		info := newRemoteFileInfo(size, resp.Header)
+		info.NoRanges = true
+		return info, nil
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("server did not honor range request (status %d)", resp.StatusCode)
 	}
 
 	size, err := parseContentRangeTotal(resp.Header.Get("Content-Range"))
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 	if size == 0 {
-		return 0, fmt.Errorf("remote size is zero")
+		return nil, fmt.Errorf("remote size is zero")
+	}
+	return newRemoteFileInfo(size, resp.Header), nil
+}
+
+// ignoredRange reports whether a full response with header to a request sending If-Range ifRange
+// still carries that validator: the server ignored the range rather than the file changed.
+func ignoredRange(header http.Header, ifRange string) bool {
+	return header.Get("ETag") == ifRange || header.Get("Last-Modified") == ifRange
+}
+
+// setHeader adds the extra headers header to req.
+func setHeader(req *http.Request, header http.Header) {
+	for name, values := range header {
+		req.Header.Del(name)
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
 	}
-	return size, nil
 }
 
 func parseContentRangeTotal(header string) (uint64, error) {
@@ -129,7 +225,30 @@ func parseContentRangeTotal(header string) (uint64, error) {
 	return value, nil
 }
 
-func DownloadFileChunkAsync(sourceUrl string, destinationPath string, startOffset uint64, endOffset uint64, httpClient *http.Client) (chan uint64, chan error) {
+// ChunkRequest describes a ranged download into a .part file.
+type ChunkRequest struct {
+	URL             string
+	DestinationPath string
+	StartOffset     uint64
+	EndOffset       uint64
+	// IfRange is sent as If-Range; a full response from the server is then reported
+	// as a *RemoteFileChangedError.
+	IfRange string
+	// Header holds extra headers sent with the request, such as cookies. It cannot override Range
+	// and If-Range.
+	Header http.Header
+	// Stream fetches the whole file without a Range header, for servers that do not support them.
+	// StartOffset must be 0 and the destination file is always written from the start.
+	Stream bool
+	// Claim, if set, is called before writing n bytes at offset (relative to StartOffset)
+	// and returns how many of them may be written. Returning less than n moves the end
+	// of the chunk, which lets the scheduler hand the rest of the range to another worker.
+	Claim func(offset uint64, n uint64) uint64
+}
+
+// DownloadFileChunkAsync downloads the range of chunkReq, appending to a partial destination
+// file if present. Progress is reported on the first channel, the outcome on the second.
+func DownloadFileChunkAsync(ctx context.Context, chunkReq ChunkRequest, httpClient *http.Client) (chan uint64, chan error) {
 	bytesDownloadedCh := make(chan uint64)
 	errorCh := make(chan error, 1)
 
@@ -141,6 +260,7 @@ func DownloadFileChunkAsync(sourceUrl string, destinationPath string, startOffse
 			httpClient = &http.Client{}
 		}
 
+		startOffset, endOffset := chunkReq.StartOffset, chunkReq.EndOffset
 		if endOffset < startOffset {
 			errorCh <- fmt.Errorf("invalid range: %d-%d", startOffset, endOffset)
 			return
@@ -148,11 +268,11 @@ func DownloadFileChunkAsync(sourceUrl string, destinationPath string, startOffse
 
 		expectedSize := endOffset - startOffset + 1
 		var existingSize uint64
-		if exists, err := FileExists(destinationPath); err != nil {
+		if exists, err := FileExists(chunkReq.DestinationPath); err != nil {
 			errorCh <- fmt.Errorf("cannot check destination file: %s", err)
 			return
-		} else if exists {
-			size, err := GetFileSize(destinationPath)
+		} else if exists && !chunkReq.Stream {
+			size, err := GetFileSize(chunkReq.DestinationPath)
 			if err != nil {
 				errorCh <- fmt.Errorf("cannot get destination file size: %s", err)
 				return
@@ -170,27 +290,53 @@ func DownloadFileChunkAsync(sourceUrl string, destinationPath string, startOffse
 		}
 
 		rangeStart := startOffset + existingSize
-		req, _ := http.NewRequest("GET", sourceUrl, nil)
-		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", rangeStart, endOffset))
+		req, _ := http.NewRequestWithContext(ctx, "GET", chunkReq.URL, nil)
 		req.Header.Set("User-Agent", "kerbetor")
+		setHeader(req, chunkReq.Header)
+		if !chunkReq.Stream {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", rangeStart, endOffset))
+			if chunkReq.IfRange != "" {
+				req.Header.Set("If-Range", chunkReq.IfRange)
+			}
+		}
 
 		resp, err := httpClient.Do(req)
 		if err != nil {
+			if ctx.Err() != nil {
+				errorCh <- ctx.Err()
+				return
+			}
 			errorCh <- fmt.Errorf("error downloading file chunk %d-%d: %s", rangeStart, endOffset, err)
 			return
 		}
 		defer resp.Body.Close()
 
-		if resp.StatusCode != http.StatusPartialContent {
+		if chunkReq.Stream {
+			if resp.StatusCode != http.StatusOK {
+				errorCh <- fmt.Errorf("unexpected status %d", resp.StatusCode)
+				return
+			}
+			if size, ok := parseContentLength(resp.Header.Get("Content-Length")); ok && size != expectedSize {
+				errorCh <- &RemoteFileChangedError{URL: chunkReq.URL, Reason: fmt.Sprintf("size changed from %d to %d", expectedSize, size)}
+				return
+			}
+		} else if resp.StatusCode == http.StatusOK {
+			if chunkReq.IfRange != "" && !ignoredRange(resp.Header, chunkReq.IfRange) {
+				errorCh <- &RemoteFileChangedError{URL: chunkReq.URL, Reason: "server ignored If-Range " + chunkReq.IfRange}
+				return
+			}
+			errorCh <- ErrRangeNotSupported
+			return
+		} else if resp.StatusCode != http.StatusPartialContent {
 			errorCh <- fmt.Errorf("server did not honor range request (status %d)", resp.StatusCode)
 			return
 		}
 
 		var destinationFile *os.File
 		if existingSize > 0 {
-			destinationFile, err = os.OpenFile(destinationPath, os.O_WRONLY|os.O_APPEND, 0644)
+			destinationFile, err = os.OpenFile(chunkReq.DestinationPath, os.O_WRONLY|os.O_APPEND, 0644)
 		} else {
-			destinationFile, err = os.OpenFile(destinationPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+			destinationFile, err = os.OpenFile(chunkReq.DestinationPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
 		}
 		if err != nil {
 			errorCh <- fmt.Errorf("error creating destination file: %s", err)
@@ -203,18 +349,25 @@ func DownloadFileChunkAsync(sourceUrl string, destinationPath string, startOffse
 		buf := make([]byte, 32*1024)
 		downloaded := existingSize
 		lastUpdate := time.Now()
-		for {
+		for downloaded < expectedSize {
 			n, readErr := resp.Body.Read(buf)
 			if n > 0 {
-				remaining := expectedSize - downloaded
-				if uint64(n) > remaining {
-					n = int(remaining)
+				allowed := uint64(n)
+				if remaining := expectedSize - downloaded; allowed > remaining {
+					allowed = remaining
+				}
+				if chunkReq.Claim != nil {
+					if claimed := chunkReq.Claim(downloaded, allowed); claimed < allowed {
+						// the end of the chunk was moved by the scheduler
+						allowed = claimed
+						expectedSize = downloaded + claimed
+					}
 				}
-				if _, writeErr := destinationFile.Write(buf[:n]); writeErr != nil {
+				if _, writeErr := destinationFile.Write(buf[:allowed]); writeErr != nil {
 					errorCh <- fmt.Errorf("error writing destination file: %s", writeErr)
 					return
 				}
-				downloaded += uint64(n)
+				downloaded += allowed
 				if time.Since(lastUpdate) >= DownloadedBytesRefreshRate {
 					bytesDownloadedCh <- downloaded
 					lastUpdate = time.Now()
@@ -224,12 +377,13 @@ func DownloadFileChunkAsync(sourceUrl string, destinationPath string, startOffse
 				if readErr == io.EOF {
 					break
 				}
+				if ctx.Err() != nil {
+					errorCh <- ctx.Err()
+					return
+				}
 				errorCh <- fmt.Errorf("error downloading file chunk %d-%d: %s", rangeStart, endOffset, readErr)
 				return
 			}
-			if downloaded == expectedSize {
-				break
-			}
 		}
 
 		if downloaded != expectedSize {
@@ -243,3 +397,45 @@ func DownloadFileChunkAsync(sourceUrl string, destinationPath string, startOffse
 
 	return bytesDownloadedCh, errorCh
 }
+
+// fetchRange downloads the bytes start to end of sourceUrl into memory. It is meant for small
+// ranges, such as pieces that failed verification.
+func fetchRange(ctx context.Context, sourceUrl string, header http.Header, ifRange string, start uint64, end uint64, httpClient *http.Client) ([]byte, error) {
+	req, _ := http.NewRequestWithContext(ctx, "GET", sourceUrl, nil)
+	req.Header.Set("User-Agent", "kerbetor")
+	setHeader(req, header)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	if ifRange != "" {
+		req.Header.Set("If-Range", ifRange)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("error downloading range %d-%d: %s", start, end, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		if ifRange != "" && !ignoredRange(resp.Header, ifRange) {
+			return nil, &RemoteFileChangedError{URL: sourceUrl, Reason: "server ignored If-Range " + ifRange}
+		}
+		return nil, ErrRangeNotSupported
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("server did not honor range request (status %d)", resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, int64(end-start+1)))
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("error downloading range %d-%d: %s", start, end, err)
+	}
+	if uint64(len(data)) != end-start+1 {
+		return nil, fmt.Errorf("incomplete range download: %d/%d", len(data), end-start+1)
+	}
+	return data, nil
+}
@@ -0,0 +1,33 @@
+package kerbetor
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestDownloadWithoutRangesOrSize(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// ignores Range, and flushing before writing the body makes it chunked, without a length
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodGet {
+			w.(http.Flusher).Flush()
+			w.Write([]byte("a file of unknown size"))
+		}
+	}))
+	defer server.Close()
+
+	_, err := getRemoteFileInfo(context.Background(), server.URL+"/file.bin", nil, nil)
+	if !errors.Is(err, ErrUnknownSize) || !errors.Is(err, ErrRangeNotSupported) {
+		t.Fatalf("probe: got %v, want ErrUnknownSize and ErrRangeNotSupported", err)
+	}
+
+	output := filepath.Join(t.TempDir(), "file.bin")
+	_, err = NewDownloader(WithTorCircuits(0)).Download(context.Background(), server.URL+"/file.bin", output)
+	if !errors.Is(err, ErrUnknownSize) || !errors.Is(err, ErrRangeNotSupported) {
+		t.Fatalf("download: got %v, want ErrUnknownSize and ErrRangeNotSupported", err)
+	}
+}
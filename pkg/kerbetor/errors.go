@@ -0,0 +1,31 @@
+package kerbetor
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrRemoteFileChanged matches every *RemoteFileChangedError with errors.Is.
+var ErrRemoteFileChanged = errors.New("remote file has changed")
+
+// ErrRangeNotSupported is returned when a server answers range requests with the whole file.
+var ErrRangeNotSupported = errors.New("server does not support range requests")
+
+// ErrUnknownSize is returned when a server sends neither the size of the file nor a range of it,
+// so that the download could not be checked for completeness.
+var ErrUnknownSize = errors.New("file size unknown")
+
+// RemoteFileChangedError reports that the remote representation is no longer the one
+// the work dir was started with.
+type RemoteFileChangedError struct {
+	URL    string
+	Reason string
+}
+
+func (e *RemoteFileChangedError) Error() string {
+	return fmt.Sprintf("remote file %s has changed: %s", e.URL, e.Reason)
+}
+
+func (e *RemoteFileChangedError) Is(target error) bool {
+	return target == ErrRemoteFileChanged
+}
@@ -0,0 +1,90 @@
+package kerbetor
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ConnectExternalTor creates numTorCircuits instances on the SOCKS endpoints of an already running
+// tor, spread round-robin over config.SOCKSAddrs. Every instance uses its own SOCKS credentials so
+// that tor (IsolateSOCKSAuth, enabled by default) builds a separate circuit for it.
+// When config.ControlAddr is set, kerbetor waits for tor to be bootstrapped and uses the control
+// port to inspect circuits. The external tor is never stopped by kerbetor.
+func ConnectExternalTor(ctx context.Context, numTorCircuits uint, config TorConfig, logger logrus.FieldLogger) ([]*TorInstance, error) {
+	for _, addr := range config.SOCKSAddrs {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("invalid tor SOCKS address %q: %s", addr, err)
+		}
+	}
+
+	if config.ControlAddr != "" {
+		control, err := dialExternalControl(ctx, config)
+		if err != nil {
+			return nil, err
+		}
+		bootstrapCtx := ctx
+		if config.BootstrapTimeout > 0 {
+			var cancel context.CancelFunc
+			bootstrapCtx, cancel = context.WithTimeout(ctx, config.BootstrapTimeout)
+			defer cancel()
+		}
+		err = waitForTorBootstrap(bootstrapCtx, control, config.ControlAddr, config, nil, func(line string) {
+			logger.Warn("[TorInstance ", config.ControlAddr, "] ", line)
+		}, logger)
+		control.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	instances := make([]*TorInstance, 0, numTorCircuits)
+	for i := uint(0); i < numTorCircuits; i++ {
+		socksAddr := config.SOCKSAddrs[int(i)%len(config.SOCKSAddrs)]
+		instance := &TorInstance{
+			name:      fmt.Sprintf("%s#%d", socksAddr, i),
+			socksAddr: socksAddr,
+			socksAuth: newSOCKSAuth(),
+			config:    config,
+		}
+		if config.ControlAddr != "" {
+			control, err := dialExternalControl(ctx, config)
+			if err != nil {
+				for _, instance := range instances {
+					instance.Close()
+				}
+				return nil, err
+			}
+			instance.control = control
+		}
+		instances = append(instances, instance)
+	}
+	logger.Debug("Using external tor at ", strings.Join(config.SOCKSAddrs, ", "), " with ", numTorCircuits, " isolated circuit(s)")
+	return instances, nil
+}
+
+func dialExternalControl(ctx context.Context, config TorConfig) (*ControlConn, error) {
+	control, err := DialControl(ctx, config.ControlAddr)
+	if err != nil {
+		return nil, err
+	}
+	if err := control.Authenticate(config.ControlPassword); err != nil {
+		control.Close()
+		return nil, fmt.Errorf("cannot authenticate to tor control port %s: %s", config.ControlAddr, err)
+	}
+	return control, nil
+}
+
+// newSOCKSAuth returns random SOCKS credentials. tor ignores their value but isolates streams
+// using different credentials on different circuits.
+func newSOCKSAuth() *url.Userinfo {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return url.UserPassword("kerbetor-"+hex.EncodeToString(buf[:8]), hex.EncodeToString(buf[8:]))
+}
@@ -0,0 +1,684 @@
+package kerbetor
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// JobStatus is the state of a queued download.
+type JobStatus string
+
+const (
+	JobQueued    JobStatus = "queued"
+	JobActive    JobStatus = "active"
+	JobPaused    JobStatus = "paused"
+	JobCompleted JobStatus = "completed"
+	JobFailed    JobStatus = "failed"
+	JobCancelled JobStatus = "cancelled"
+)
+
+// JobsFileName is the file, in the state directory of a JobManager, holding the job queue.
+const JobsFileName = "jobs.json"
+
+// ErrJobNotFound is returned for unknown job IDs.
+var ErrJobNotFound = errors.New("job not found")
+
+// ErrOutsideDownloadDir is returned when the output file of a job would not be inside the
+// download directory of the JobManager.
+var ErrOutsideDownloadDir = errors.New("output path is outside the download directory")
+
+// JobStateError is returned when an operation is not allowed in the current state of a job.
+type JobStateError struct {
+	ID     string
+	Status JobStatus
+	Op     string
+}
+
+func (e *JobStateError) Error() string {
+	return fmt.Sprintf("cannot %s job %s: job is %s", e.Op, e.ID, e.Status)
+}
+
+// JobRequest describes a download to add to a JobManager.
+type JobRequest struct {
+	URL string `json:"url"`
+	// Mirrors are other URLs serving the same file, see WithMirrors.
+	Mirrors []string `json:"mirrors,omitempty"`
+	// Dir is the directory of the output file, relative to the download directory of the manager,
+	// or an absolute path inside it. The download directory when empty.
+	Dir string `json:"dir,omitempty"`
+	// Out is the output file name, taken from the URL when empty.
+	Out       string     `json:"out,omitempty"`
+	Priority  int        `json:"priority,omitempty"`
+	Checksums []Checksum `json:"checksums,omitempty"`
+	// Paused adds the job paused, it starts once resumed.
+	Paused bool `json:"paused,omitempty"`
+}
+
+// Job is a snapshot of a download managed by a JobManager.
+type Job struct {
+	ID        string     `json:"id"`
+	URL       string     `json:"url"`
+	Mirrors   []string   `json:"mirrors,omitempty"`
+	Output    string     `json:"output"`
+	Priority  int        `json:"priority"`
+	Checksums []Checksum `json:"checksums,omitempty"`
+	Status    JobStatus  `json:"status"`
+	Error     string     `json:"error,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+
+	TotalBytes      uint64 `json:"total_bytes"`
+	DownloadedBytes uint64 `json:"downloaded_bytes"`
+	// Speed is the current download speed in bytes per second.
+	Speed uint64 `json:"speed"`
+}
+
+type jobsFile struct {
+	Version int    `json:"version"`
+	Jobs    []*Job `json:"jobs"`
+}
+
+type managedJob struct {
+	Job
+	cancel   context.CancelFunc
+	done     chan struct{}
+	progress *jobProgress
+	// status the job moves to once its download is stopped
+	stopAs JobStatus
+}
+
+// JobManager runs a persistent queue of downloads on a shared circuit pool. Jobs with a higher
+// priority start first; at most maxActive jobs download at the same time. The queue is saved
+// in the state directory after every change, so that it survives restarts: active jobs are
+// resumed from their work directories.
+type JobManager struct {
+	mu          sync.Mutex
+	jobs        map[string]*managedJob
+	stateDir    string
+	downloadDir string
+	maxActive   int
+	opts        []Option
+	pool        *CircuitPool
+	logger      logrus.FieldLogger
+	subscribers map[chan Job]struct{}
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	closing bool
+	wg      sync.WaitGroup
+}
+
+// NewJobManager loads the queue saved in stateDir and starts the queued jobs. Jobs download into
+// downloadDir by default, with the Downloader options opts. pool may be nil to let each download
+// create its own circuits.
+func NewJobManager(stateDir string, downloadDir string, maxActive int, pool *CircuitPool, logger logrus.FieldLogger, opts ...Option) (*JobManager, error) {
+	if maxActive < 1 {
+		return nil, fmt.Errorf("number of active jobs must be at least 1")
+	}
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return nil, fmt.Errorf("cannot create state dir: %s", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &JobManager{
+		jobs:        make(map[string]*managedJob),
+		subscribers: make(map[chan Job]struct{}),
+		stateDir:    stateDir,
+		downloadDir: downloadDir,
+		maxActive:   maxActive,
+		opts:        opts,
+		pool:        pool,
+		logger:      logger,
+		ctx:         ctx,
+		cancel:      cancel,
+	}
+	if err := m.load(); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.scheduleLocked()
+	return m, nil
+}
+
+func (m *JobManager) load() error {
+	content, err := os.ReadFile(filepath.Join(m.stateDir, JobsFileName))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read job queue: %s", err)
+	}
+	var saved jobsFile
+	if err := json.Unmarshal(content, &saved); err != nil {
+		return fmt.Errorf("cannot parse job queue: %s", err)
+	}
+	for _, job := range saved.Jobs {
+		if job.Status == JobActive {
+			// interrupted by the previous shutdown
+			job.Status = JobQueued
+		}
+		job.Speed = 0
+		m.jobs[job.ID] = &managedJob{Job: *job}
+	}
+	return nil
+}
+
+// saveLocked writes the queue to the state directory, atomically.
+func (m *JobManager) saveLocked() {
+	saved := jobsFile{Version: 1, Jobs: make([]*Job, 0, len(m.jobs))}
+	for _, job := range m.sortedLocked() {
+		snapshot := job.snapshot()
+		saved.Jobs = append(saved.Jobs, &snapshot)
+	}
+	content, err := json.MarshalIndent(saved, "", "  ")
+	if err == nil {
+		jobsPath := filepath.Join(m.stateDir, JobsFileName)
+		tmpPath := jobsPath + ".tmp"
+		if err = os.WriteFile(tmpPath, content, 0600); err == nil {
+			err = os.Rename(tmpPath, jobsPath)
+		}
+	}
+	if err != nil {
+		m.logger.Warn("Cannot save job queue: ", err)
+	}
+}
+
+// Add queues a new download.
+func (m *JobManager) Add(req JobRequest) (Job, error) {
+	if _, err := url.ParseRequestURI(req.URL); err != nil {
+		return Job{}, fmt.Errorf("invalid url %q: %s", req.URL, err)
+	}
+	for _, mirror := range req.Mirrors {
+		if _, err := url.ParseRequestURI(mirror); err != nil {
+			return Job{}, fmt.Errorf("invalid mirror url %q: %s", mirror, err)
+		}
+	}
+	// checksums of API requests are only checked once the whole file is downloaded otherwise
+	checksums := make([]Checksum, 0, len(req.Checksums))
+	for _, checksum := range req.Checksums {
+		normalized, err := NewChecksum(checksum.Algorithm, checksum.Digest)
+		if err != nil {
+			return Job{}, err
+		}
+		checksums = append(checksums, normalized)
+	}
+	out := req.Out
+	if out == "" {
+		out = fileNameFromURL(req.URL)
+	}
+	if out == "" {
+		return Job{}, fmt.Errorf("cannot derive a file name from %s, set the output name", req.URL)
+	}
+	output, err := m.outputPath(req.Dir, out)
+	if err != nil {
+		return Job{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closing {
+		return Job{}, errors.New("job manager is shutting down")
+	}
+	for _, job := range m.jobs {
+		if job.Output == output && !job.finished() {
+			return Job{}, fmt.Errorf("job %s already downloads to %s", job.ID, output)
+		}
+	}
+
+	status := JobQueued
+	if req.Paused {
+		status = JobPaused
+	}
+	now := time.Now().UTC()
+	job := &managedJob{Job: Job{
+		ID:        newJobID(),
+		URL:       req.URL,
+		Mirrors:   req.Mirrors,
+		Output:    output,
+		Priority:  req.Priority,
+		Checksums: checksums,
+		Status:    status,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}}
+	m.jobs[job.ID] = job
+	m.logger.Info("Queued job ", job.ID, ": ", job.URL)
+	m.scheduleLocked()
+	m.saveLocked()
+	return job.snapshot(), nil
+}
+
+// outputPath returns the absolute path of the file out in dir, with symbolic links resolved, and
+// fails with ErrOutsideDownloadDir if it is not inside the download directory.
+func (m *JobManager) outputPath(dir string, out string) (string, error) {
+	root, err := filepath.Abs(m.downloadDir)
+	if err != nil {
+		return "", fmt.Errorf("invalid download dir: %s", err)
+	}
+	if root, err = resolveSymlinks(root); err != nil {
+		return "", fmt.Errorf("invalid download dir: %s", err)
+	}
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(root, dir)
+	}
+	output, err := resolveSymlinks(filepath.Join(dir, out))
+	if err != nil {
+		return "", fmt.Errorf("invalid output path: %s", err)
+	}
+	rel, err := filepath.Rel(root, output)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%w: %s", ErrOutsideDownloadDir, filepath.Join(dir, out))
+	}
+	return output, nil
+}
+
+// resolveSymlinks resolves the symbolic links of the longest existing prefix of the clean absolute
+// path, so that links cannot lead the rest of the path out of a directory.
+func resolveSymlinks(path string) (string, error) {
+	existing, rest := path, ""
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			resolved, err := filepath.EvalSymlinks(existing)
+			if err != nil {
+				return "", fmt.Errorf("cannot resolve %s: %s", existing, err)
+			}
+			return filepath.Join(resolved, rest), nil
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return path, nil
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = parent
+	}
+}
+
+// Jobs returns every job, in queue order: active jobs first, then by priority.
+func (m *JobManager) Jobs() []Job {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	jobs := make([]Job, 0, len(m.jobs))
+	for _, job := range m.sortedLocked() {
+		jobs = append(jobs, job.snapshot())
+	}
+	return jobs
+}
+
+// Job returns the job with the given ID.
+func (m *JobManager) Job(id string) (Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		return Job{}, fmt.Errorf("%w: %s", ErrJobNotFound, id)
+	}
+	return job.snapshot(), nil
+}
+
+// Pause stops a queued or active job, keeping its work directory so that it can be resumed.
+func (m *JobManager) Pause(id string) (Job, error) {
+	return m.stop(id, JobPaused, "pause")
+}
+
+// Cancel stops a job and removes its partial data.
+func (m *JobManager) Cancel(id string) (Job, error) {
+	return m.stop(id, JobCancelled, "cancel")
+}
+
+func (m *JobManager) stop(id string, status JobStatus, op string) (Job, error) {
+	m.mu.Lock()
+	job, ok := m.jobs[id]
+	if !ok {
+		m.mu.Unlock()
+		return Job{}, fmt.Errorf("%w: %s", ErrJobNotFound, id)
+	}
+	switch {
+	case job.Status == JobActive:
+		job.stopAs = status
+		job.cancel()
+		done := job.done
+		m.mu.Unlock()
+		// wait for the download to checkpoint and release its circuits
+		<-done
+		m.mu.Lock()
+	case job.Status == JobQueued || (job.Status == JobPaused && status == JobCancelled) || (job.Status == JobFailed && status == JobCancelled):
+		m.setStatusLocked(job, status, nil)
+	default:
+		m.mu.Unlock()
+		return Job{}, &JobStateError{ID: id, Status: job.Status, Op: op}
+	}
+	defer m.mu.Unlock()
+	if status == JobCancelled {
+		m.removeWorkDir(job)
+	}
+	m.saveLocked()
+	return job.snapshot(), nil
+}
+
+// Resume queues again a paused or failed job.
+func (m *JobManager) Resume(id string) (Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		return Job{}, fmt.Errorf("%w: %s", ErrJobNotFound, id)
+	}
+	if job.Status != JobPaused && job.Status != JobFailed {
+		return Job{}, &JobStateError{ID: id, Status: job.Status, Op: "resume"}
+	}
+	m.setStatusLocked(job, JobQueued, nil)
+	m.scheduleLocked()
+	m.saveLocked()
+	return job.snapshot(), nil
+}
+
+// SetPriority changes the priority of a job. It affects the order in which queued jobs start,
+// active jobs are not interrupted.
+func (m *JobManager) SetPriority(id string, priority int) (Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		return Job{}, fmt.Errorf("%w: %s", ErrJobNotFound, id)
+	}
+	job.Priority = priority
+	job.UpdatedAt = time.Now().UTC()
+	m.saveLocked()
+	return job.snapshot(), nil
+}
+
+// Remove forgets a job that is not queued or active. Its output file is kept.
+func (m *JobManager) Remove(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrJobNotFound, id)
+	}
+	if job.Status == JobQueued || job.Status == JobActive {
+		return &JobStateError{ID: id, Status: job.Status, Op: "remove"}
+	}
+	delete(m.jobs, id)
+	m.saveLocked()
+	return nil
+}
+
+// SetMaxActive changes the number of jobs downloading at the same time. Active jobs beyond the
+// new limit keep downloading until they finish.
+func (m *JobManager) SetMaxActive(maxActive int) error {
+	if maxActive < 1 {
+		return fmt.Errorf("number of active jobs must be at least 1")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.maxActive = maxActive
+	m.scheduleLocked()
+	return nil
+}
+
+func (m *JobManager) MaxActive() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.maxActive
+}
+
+// DownloadDir returns the default directory of the downloaded files.
+func (m *JobManager) DownloadDir() string {
+	return m.downloadDir
+}
+
+// Subscribe returns a channel receiving a snapshot of every job whose status changes, and a
+// function ending the subscription. Changes are dropped while the channel is full.
+func (m *JobManager) Subscribe() (<-chan Job, func()) {
+	ch := make(chan Job, 64)
+	m.mu.Lock()
+	m.subscribers[ch] = struct{}{}
+	m.mu.Unlock()
+	return ch, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		delete(m.subscribers, ch)
+	}
+}
+
+// Pool returns the circuit pool shared by the jobs, nil if there is none.
+func (m *JobManager) Pool() *CircuitPool {
+	return m.pool
+}
+
+// Close stops the active jobs, which are resumed by the next JobManager using the same state
+// directory, and waits for them. It does not close the circuit pool.
+func (m *JobManager) Close() {
+	m.mu.Lock()
+	m.closing = true
+	m.mu.Unlock()
+
+	m.cancel()
+	m.wg.Wait()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.saveLocked()
+}
+
+// scheduleLocked starts queued jobs, highest priority first, while there are free slots.
+func (m *JobManager) scheduleLocked() {
+	if m.closing {
+		return
+	}
+	active := 0
+	for _, job := range m.jobs {
+		if job.Status == JobActive {
+			active++
+		}
+	}
+	for _, job := range m.sortedLocked() {
+		if active >= m.maxActive {
+			return
+		}
+		if job.Status == JobQueued {
+			m.startLocked(job)
+			active++
+		}
+	}
+}
+
+func (m *JobManager) startLocked(job *managedJob) {
+	ctx, cancel := context.WithCancel(m.ctx)
+	job.cancel = cancel
+	job.done = make(chan struct{})
+	job.stopAs = ""
+	job.progress = &jobProgress{}
+	m.setStatusLocked(job, JobActive, nil)
+	m.logger.Info("Starting job ", job.ID, ": ", job.URL)
+
+	opts := append([]Option{}, m.opts...)
+	opts = append(opts, WithLogger(m.logger.WithField("job", job.ID)), WithProgress(job.progress))
+	if m.pool != nil {
+		opts = append(opts, WithCircuitPool(m.pool))
+	}
+	for _, checksum := range job.Checksums {
+		opts = append(opts, WithChecksum(checksum))
+	}
+	if len(job.Mirrors) > 0 {
+		opts = append(opts, WithMirrors(job.Mirrors...))
+	}
+	downloader := NewDownloader(opts...)
+	remoteUrl, output := job.URL, job.Output
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		defer close(job.done)
+		defer cancel()
+
+		if err := os.MkdirAll(filepath.Dir(output), 0755); err != nil {
+			m.finish(job, fmt.Errorf("cannot create output directory: %s", err))
+			return
+		}
+		_, err := downloader.Download(ctx, remoteUrl, output)
+		m.finish(job, err)
+	}()
+}
+
+// finish records the outcome of the download of job and starts the next queued jobs.
+func (m *JobManager) finish(job *managedJob, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	job.TotalBytes, job.DownloadedBytes = job.progress.sizes()
+	job.Speed = 0
+	switch {
+	case err == nil:
+		m.setStatusLocked(job, JobCompleted, nil)
+		job.DownloadedBytes = job.TotalBytes
+		m.logger.Info("Job ", job.ID, " completed: ", job.Output)
+	case job.stopAs != "":
+		m.setStatusLocked(job, job.stopAs, nil)
+		m.logger.Info("Job ", job.ID, " ", job.stopAs)
+	case m.closing:
+		// resumed on the next start
+		m.setStatusLocked(job, JobQueued, nil)
+	default:
+		m.setStatusLocked(job, JobFailed, err)
+		m.logger.Error("Job ", job.ID, " failed: ", err)
+	}
+	m.scheduleLocked()
+	m.saveLocked()
+}
+
+func (m *JobManager) setStatusLocked(job *managedJob, status JobStatus, err error) {
+	job.Status = status
+	job.Error = ""
+	if err != nil {
+		job.Error = err.Error()
+	}
+	job.UpdatedAt = time.Now().UTC()
+	for ch := range m.subscribers {
+		select {
+		case ch <- job.snapshot():
+		default:
+		}
+	}
+}
+
+func (m *JobManager) removeWorkDir(job *managedJob) {
+	if err := os.RemoveAll(job.Output + WorkDirSuffix); err != nil {
+		m.logger.Warn("Cannot remove work dir of job ", job.ID, ": ", err)
+	}
+}
+
+// sortedLocked returns the jobs with active ones first, then by decreasing priority and
+// creation time.
+func (m *JobManager) sortedLocked() []*managedJob {
+	jobs := make([]*managedJob, 0, len(m.jobs))
+	for _, job := range m.jobs {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		a, b := jobs[i], jobs[j]
+		if (a.Status == JobActive) != (b.Status == JobActive) {
+			return a.Status == JobActive
+		}
+		if a.Priority != b.Priority {
+			return a.Priority > b.Priority
+		}
+		return a.CreatedAt.Before(b.CreatedAt)
+	})
+	return jobs
+}
+
+func (j *managedJob) finished() bool {
+	return j.Status == JobCompleted || j.Status == JobCancelled
+}
+
+// snapshot returns a copy of the job with live progress.
+func (j *managedJob) snapshot() Job {
+	job := j.Job
+	job.Checksums = append([]Checksum(nil), j.Checksums...)
+	job.Mirrors = append([]string(nil), j.Mirrors...)
+	if j.Status == JobActive && j.progress != nil {
+		job.TotalBytes, job.DownloadedBytes = j.progress.sizes()
+		job.Speed = j.progress.speed()
+	}
+	return job
+}
+
+// jobProgress is the ProgressSink of a job, it keeps the sizes and speed of the download.
+type jobProgress struct {
+	NopProgress
+	mu             sync.Mutex
+	total          uint64
+	downloaded     uint64
+	bytesPerSecond float64
+	lastUpdate     time.Time
+}
+
+func (p *jobProgress) DownloadStarted(url string, total uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.total = total
+}
+
+func (p *jobProgress) DownloadProgress(downloaded uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	if !p.lastUpdate.IsZero() && downloaded >= p.downloaded {
+		if elapsed := now.Sub(p.lastUpdate).Seconds(); elapsed > 0 {
+			sample := float64(downloaded-p.downloaded) / elapsed
+			p.bytesPerSecond = throughputSmoothing*sample + (1-throughputSmoothing)*p.bytesPerSecond
+		}
+	}
+	p.downloaded, p.lastUpdate = downloaded, now
+}
+
+func (p *jobProgress) sizes() (uint64, uint64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.total, p.downloaded
+}
+
+func (p *jobProgress) speed() uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if time.Since(p.lastUpdate) > 2*time.Second {
+		return 0
+	}
+	return uint64(p.bytesPerSecond)
+}
+
+// newJobID returns 16 random hex digits.
+func newJobID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+func fileNameFromURL(remoteUrl string) string {
+	parsedURL, err := url.Parse(remoteUrl)
+	if err != nil {
+		return ""
+	}
+	base := path.Base(parsedURL.Path)
+	if base == "" || base == "." || base == "/" {
+		return ""
+	}
+	return base
+}
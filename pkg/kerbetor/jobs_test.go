@@ -0,0 +1,84 @@
+package kerbetor
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestJobOutputPath(t *testing.T) {
+	root := t.TempDir()
+	if resolved, err := filepath.EvalSymlinks(root); err == nil {
+		root = resolved
+	}
+	outside := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "escape")); err != nil {
+		t.Fatal(err)
+	}
+	m := &JobManager{downloadDir: root}
+
+	for _, test := range []struct {
+		dir, out, want string
+	}{
+		{"", "file.bin", filepath.Join(root, "file.bin")},
+		{"sub", "file.bin", filepath.Join(root, "sub", "file.bin")},
+		{"new/dir", "file.bin", filepath.Join(root, "new", "dir", "file.bin")},
+		{filepath.Join(root, "sub"), "file.bin", filepath.Join(root, "sub", "file.bin")},
+		{"sub", "../file.bin", filepath.Join(root, "file.bin")},
+	} {
+		got, err := m.outputPath(test.dir, test.out)
+		if err != nil || got != test.want {
+			t.Errorf("outputPath(%q, %q) = %q, %v, want %q", test.dir, test.out, got, err, test.want)
+		}
+	}
+
+	for _, test := range []struct {
+		dir, out string
+	}{
+		{"", "../../.bashrc"},
+		{"..", "file.bin"},
+		{outside, "file.bin"},
+		{"/etc", "passwd"},
+		{"", "."},
+		{"escape", "file.bin"},
+		{"", "escape/file.bin"},
+	} {
+		if got, err := m.outputPath(test.dir, test.out); !errors.Is(err, ErrOutsideDownloadDir) {
+			t.Errorf("outputPath(%q, %q) = %q, %v, want ErrOutsideDownloadDir", test.dir, test.out, got, err)
+		}
+	}
+}
+
+func TestJobChecksums(t *testing.T) {
+	m, err := NewJobManager(t.TempDir(), t.TempDir(), 1, nil, logrus.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	digest := strings.Repeat("AB", 32)
+	job, err := m.Add(JobRequest{URL: "http://example.onion/file.bin", Paused: true, Checksums: []Checksum{{Algorithm: "SHA256", Digest: " " + digest}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Checksum{Algorithm: "sha256", Digest: strings.ToLower(digest)}); len(job.Checksums) != 1 || job.Checksums[0] != want {
+		t.Errorf("got checksums %v, want %v", job.Checksums, want)
+	}
+
+	for _, checksum := range []Checksum{
+		{Algorithm: "crc32", Digest: "00000000"},
+		{Algorithm: "sha256", Digest: "abcd"},
+		{Algorithm: "md5", Digest: strings.Repeat("zz", 16)},
+	} {
+		if _, err := m.Add(JobRequest{URL: "http://example.onion/other.bin", Paused: true, Checksums: []Checksum{checksum}}); err == nil {
+			t.Errorf("checksum %v accepted", checksum)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package kerbetor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// LockFileName is the lock file, in a work directory or a tor data directory, held by the
+	// kerbetor process using the directory. It records the PID and host of that process.
+	LockFileName = "lock.ktor"
+	// how often a locked directory is checked while waiting for it
+	lockPollInterval = time.Second
+)
+
+// LockOwner identifies the process holding a directory lock.
+type LockOwner struct {
+	PID       int       `json:"pid"`
+	Host      string    `json:"host"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+func (o *LockOwner) String() string {
+	if o.PID == 0 {
+		return "unknown process"
+	}
+	return fmt.Sprintf("pid %d on %s since %s", o.PID, o.Host, o.StartedAt.Local().Format(time.DateTime))
+}
+
+// Alive reports whether the owner process is still running. Processes of other hosts cannot be
+// checked and are assumed to be running.
+func (o *LockOwner) Alive() bool {
+	hostname, _ := os.Hostname()
+	if o.Host != hostname {
+		return true
+	}
+	return processAlive(o.PID)
+}
+
+// DirLockedError is returned by LockDir when another process holds the directory.
+type DirLockedError struct {
+	Dir   string
+	Owner *LockOwner
+}
+
+func (e *DirLockedError) Error() string {
+	return fmt.Sprintf("%s is in use by another kerbetor (%s)", e.Dir, e.Owner)
+}
+
+// DirLock is an exclusive advisory lock (flock, LockFileEx on Windows) on a directory.
+type DirLock struct {
+	file *os.File
+	// flocked is false on file systems without lock support, where only the owner record is kept
+	flocked bool
+}
+
+// LockDir takes the lock of dir, creating the directory if needed. When another process holds
+// it, LockDir returns a *DirLockedError, or waits until it is released if wait is set. A lock
+// left behind by a process that died is stale and taken over.
+func LockDir(ctx context.Context, dir string, wait bool, logger logrus.FieldLogger) (*DirLock, error) {
+	waiting := false
+	for {
+		lock, owner, err := tryLockDir(dir, logger)
+		if err != nil {
+			return nil, err
+		}
+		if lock != nil {
+			return lock, nil
+		}
+		if !wait {
+			return nil, &DirLockedError{Dir: dir, Owner: owner}
+		}
+		if !waiting {
+			logger.Info("Waiting for ", dir, ", in use by another kerbetor (", owner, ")")
+			waiting = true
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(lockPollInterval):
+		}
+	}
+}
+
+// tryLockDir takes the lock of dir without waiting. When another process holds it, it returns
+// the owner of the lock instead.
+func tryLockDir(dir string, logger logrus.FieldLogger) (*DirLock, *LockOwner, error) {
+	lockPath := filepath.Join(dir, LockFileName)
+	for {
+		// the previous owner may have removed the directory once done
+		if err := os.Mkdir(dir, os.ModePerm); err != nil && !os.IsExist(err) {
+			return nil, nil, fmt.Errorf("cannot create directory %s: %s", dir, err)
+		}
+		file, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot open lock file: %s", err)
+		}
+		locked, err := tryLockFile(file)
+		flocked := err == nil
+		previous := readLockOwner(file)
+		if err != nil {
+			// the file system does not support locks, rely on the recorded owner
+			logger.Debug("Cannot lock ", lockPath, ": ", err, ". Relying on the recorded owner")
+			locked = previous == nil || previous.PID == os.Getpid() || !previous.Alive()
+		}
+		if !locked {
+			file.Close()
+			if previous == nil {
+				// the owner has not written its record yet
+				previous = &LockOwner{}
+			}
+			return nil, previous, nil
+		}
+
+		// the lock file may have been removed with its directory while we were opening it
+		if fileInfo, err := file.Stat(); err == nil {
+			if pathInfo, err := os.Stat(lockPath); err != nil || !os.SameFile(fileInfo, pathInfo) {
+				unlockFile(file)
+				file.Close()
+				if err != nil && !os.IsNotExist(err) {
+					return nil, nil, fmt.Errorf("cannot lock %s: %s", dir, err)
+				}
+				continue
+			}
+		}
+
+		// a record left in a file nobody holds belongs to a process that did not release it
+		if previous != nil && flocked {
+			logger.Warn("Taking over stale lock of ", dir, " left by ", previous)
+		}
+		lock := &DirLock{file: file, flocked: flocked}
+		if err := lock.writeOwner(); err != nil {
+			lock.Unlock()
+			return nil, nil, err
+		}
+		return lock, nil, nil
+	}
+}
+
+func (l *DirLock) writeOwner() error {
+	hostname, _ := os.Hostname()
+	content, err := json.Marshal(LockOwner{PID: os.Getpid(), Host: hostname, StartedAt: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+	if err := l.file.Truncate(0); err != nil {
+		return fmt.Errorf("cannot write lock file: %s", err)
+	}
+	if _, err := l.file.WriteAt(append(content, '\n'), 0); err != nil {
+		return fmt.Errorf("cannot write lock file: %s", err)
+	}
+	return nil
+}
+
+// Unlock clears the owner record and releases the lock. The lock file is kept, removing it
+// would let a process waiting on the old file and one creating a new file both take the lock.
+// Unlock can be called more than once.
+func (l *DirLock) Unlock() {
+	if l.file == nil {
+		return
+	}
+	l.file.Truncate(0)
+	if l.flocked {
+		unlockFile(l.file)
+	}
+	l.file.Close()
+	l.file = nil
+}
+
+// DirOwner returns the process holding the lock of dir, nil when the directory is not in use.
+func DirOwner(dir string) (*LockOwner, error) {
+	file, err := os.OpenFile(filepath.Join(dir, LockFileName), os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot open lock file: %s", err)
+	}
+	defer file.Close()
+
+	owner := readLockOwner(file)
+	locked, err := tryLockFile(file)
+	if err != nil {
+		// the file system does not support locks, rely on the recorded owner
+		if owner != nil && owner.Alive() {
+			return owner, nil
+		}
+		return nil, nil
+	}
+	if locked {
+		unlockFile(file)
+		return nil, nil
+	}
+	if owner == nil {
+		owner = &LockOwner{}
+	}
+	return owner, nil
+}
+
+// readLockOwner returns the owner recorded in a lock file, nil if there is none.
+func readLockOwner(file *os.File) *LockOwner {
+	content, err := io.ReadAll(io.NewSectionReader(file, 0, 4096))
+	if err != nil || len(bytes.TrimSpace(content)) == 0 {
+		return nil
+	}
+	var owner LockOwner
+	if err := json.Unmarshal(content, &owner); err != nil || owner.PID == 0 {
+		return nil
+	}
+	return &owner
+}
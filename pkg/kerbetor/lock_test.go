@@ -0,0 +1,155 @@
+package kerbetor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func newTestLockLogger() logrus.FieldLogger {
+	logger := logrus.New()
+	logger.Out = io.Discard
+	return logger
+}
+
+// deadPID returns the PID of a process that has exited.
+func deadPID(t *testing.T) int {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	return cmd.Process.Pid
+}
+
+func writeLockOwner(t *testing.T, dir string, owner LockOwner) {
+	t.Helper()
+	content, err := json.Marshal(owner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, LockFileName), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLockOwnerAlive(t *testing.T) {
+	hostname, _ := os.Hostname()
+	for _, test := range []struct {
+		name  string
+		owner LockOwner
+		alive bool
+	}{
+		{"this process", LockOwner{PID: os.Getpid(), Host: hostname}, true},
+		{"dead process", LockOwner{PID: deadPID(t), Host: hostname}, false},
+		{"other host", LockOwner{PID: deadPID(t), Host: hostname + ".other"}, true},
+	} {
+		if alive := test.owner.Alive(); alive != test.alive {
+			t.Errorf("%s: got alive %t, want %t", test.name, alive, test.alive)
+		}
+	}
+}
+
+func TestLockDirTakesOverStaleLock(t *testing.T) {
+	dir := t.TempDir()
+	hostname, _ := os.Hostname()
+	writeLockOwner(t, dir, LockOwner{PID: deadPID(t), Host: hostname, StartedAt: time.Now().Add(-time.Hour)})
+
+	if owner, err := DirOwner(dir); err != nil || owner != nil {
+		t.Fatalf("got owner %v, %v of a stale lock, want none", owner, err)
+	}
+	lock, err := LockDir(context.Background(), dir, false, newTestLockLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Unlock()
+	if owner, err := DirOwner(dir); err != nil || owner == nil || owner.PID != os.Getpid() {
+		t.Errorf("got owner %v, %v, want this process", owner, err)
+	}
+}
+
+func TestLockDirRefusesHeldLock(t *testing.T) {
+	dir := t.TempDir()
+	lock, err := LockDir(context.Background(), dir, false, newTestLockLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Unlock()
+
+	// held by a live process of this host
+	var lockedErr *DirLockedError
+	if _, err := LockDir(context.Background(), dir, false, newTestLockLogger()); !errors.As(err, &lockedErr) {
+		t.Fatalf("got %v, want a DirLockedError", err)
+	}
+	if lockedErr.Dir != dir || lockedErr.Owner.PID != os.Getpid() {
+		t.Errorf("got %+v owned by %v, want this process", lockedErr, lockedErr.Owner)
+	}
+
+	// held by a process of another host sharing the directory
+	writeLockOwner(t, dir, LockOwner{PID: deadPID(t), Host: "other.host", StartedAt: time.Now()})
+	if _, err := LockDir(context.Background(), dir, false, newTestLockLogger()); !errors.As(err, &lockedErr) || lockedErr.Owner.Host != "other.host" {
+		t.Fatalf("got %v, want a DirLockedError of other.host", err)
+	}
+	if owner, err := DirOwner(dir); err != nil || owner == nil || owner.Host != "other.host" {
+		t.Errorf("got owner %v, %v, want other.host", owner, err)
+	}
+
+	lock.Unlock()
+	if owner, err := DirOwner(dir); err != nil || owner != nil {
+		t.Errorf("got owner %v, %v after unlock, want none", owner, err)
+	}
+}
+
+func TestLockDirWait(t *testing.T) {
+	dir := t.TempDir()
+	lock, err := LockDir(context.Background(), dir, false, newTestLockLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		lock *DirLock
+		err  error
+	}
+	acquired := make(chan result, 1)
+	go func() {
+		lock, err := LockDir(context.Background(), dir, true, newTestLockLogger())
+		acquired <- result{lock, err}
+	}()
+	select {
+	case r := <-acquired:
+		t.Fatalf("got %v, %v while the lock is held", r.lock, r.err)
+	case <-time.After(lockPollInterval / 2):
+	}
+
+	lock.Unlock()
+	select {
+	case r := <-acquired:
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		r.lock.Unlock()
+	case <-time.After(5 * lockPollInterval):
+		t.Fatal("lock not acquired after release")
+	}
+
+	// waiting stops with the context
+	lock, err = LockDir(context.Background(), dir, false, newTestLockLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), lockPollInterval/2)
+	defer cancel()
+	if _, err := LockDir(ctx, dir, true, newTestLockLogger()); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got %v, want context.DeadlineExceeded", err)
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !windows
+
+package kerbetor
+
+import (
+	"os"
+	"syscall"
+)
+
+// tryLockFile takes an exclusive lock on file without blocking. It returns false when another
+// process holds the lock, and an error when the file system does not support locks.
+func tryLockFile(file *os.File) (bool, error) {
+	err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func unlockFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+}
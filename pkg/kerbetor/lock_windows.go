@@ -0,0 +1,28 @@
+//go:build windows
+
+package kerbetor
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// Windows locks are mandatory for the locked range: lock a byte far past the owner record, so
+// that the record stays readable.
+const lockOffsetHigh = 0x7fffffff
+
+// tryLockFile takes an exclusive lock on file without blocking. It returns false when another
+// process holds the lock, and an error when the file system does not support locks.
+func tryLockFile(file *os.File) (bool, error) {
+	overlapped := &windows.Overlapped{OffsetHigh: lockOffsetHigh}
+	err := windows.LockFileEx(windows.Handle(file.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, overlapped)
+	if err == windows.ERROR_LOCK_VIOLATION {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func unlockFile(file *os.File) error {
+	return windows.UnlockFileEx(windows.Handle(file.Fd()), 0, 1, 0, &windows.Overlapped{OffsetHigh: lockOffsetHigh})
+}
@@ -1,127 +1,454 @@
 package kerbetor
 
 import (
+	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"math"
+	"hash"
 	"net/http"
+	"os"
 	"sync"
 	"time"
 
 	"github.com/dustin/go-humanize"
 	"github.com/sirupsen/logrus"
-	"github.com/vbauerster/mpb/v8"
 )
 
+// maxDownloadRestarts bounds how many times a download starts over when the remote file changes.
+const maxDownloadRestarts = 3
+
+// Downloader downloads remote files in chunks, optionally through TOR circuits.
+// A Downloader can be reused for several downloads.
+type Downloader struct {
+	chunkSize     uint64
+	chunkCount    uint
+	wholeFileSize uint64
+	workers       uint
+	torCircuits   uint
+	torConfig     TorConfig
+	pool          *CircuitPool
+	clientFactory HTTPClientFactory
+	header        http.Header
+	mirrors       []string
+	fileSize      uint64
+	pieces        *PieceHashes
+	logger        logrus.FieldLogger
+	progress      ProgressSink
+
+	restartOnChange bool
+	checksums       []Checksum
+	checksumSidecar bool
+	waitForLock     bool
+}
+
+// ChunkResult is the outcome of a single chunk.
+type ChunkResult struct {
+	Index       int
+	StartOffset uint64
+	EndOffset   uint64
+	Status      ChunkStatus
+	Bytes       uint64
+	Attempts    int
+	Err         error
+}
+
+// DownloadResult summarizes a call to Downloader.Download.
+type DownloadResult struct {
+	URL             string
+	DestinationPath string
+	FileSize        uint64
+	// Bytes is the amount of data transferred during this call, excluding
+	// chunks that were already on disk from a previous run.
+	Bytes    uint64
+	Duration time.Duration
+	Chunks   []ChunkResult
+	// Checksums holds the hex digests computed while merging, by algorithm.
+	Checksums map[string]string
+}
+
+func NewDownloader(opts ...Option) *Downloader {
+	d := &Downloader{
+		chunkSize:     DefaultChunkSize,
+		workers:       DefaultWorkers,
+		torCircuits:   DefaultTorCircuits,
+		torConfig:     TorConfig{BootstrapTimeout: DefaultTorBootstrapTimeout, Mode: TorModeProcess},
+		clientFactory: defaultHTTPClientFactory,
+		logger:        logrus.StandardLogger(),
+		progress:      NopProgress{},
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d
+}
+
+// ConcurrentFileDownload downloads remoteUrl to destinationPath drawing progress bars on the terminal.
 func ConcurrentFileDownload(remoteUrl string, destinationPath string, chunkSize uint64, maxConcurrentDownloads uint, numTorCircuits uint, chunkCount uint) error {
-	// create tor circuits
-	var circuits []*TorInstance
-	var mainHttpClient *http.Client
-
-	if numTorCircuits > 0 {
-		logrus.Info("Creating TOR circuits...")
-		var err error
-		circuits, err = CreateTorCircuits(numTorCircuits)
+	d := NewDownloader(
+		WithChunkSize(chunkSize),
+		WithChunkCount(chunkCount),
+		WithWorkers(maxConcurrentDownloads),
+		WithTorCircuits(numTorCircuits),
+		WithProgress(NewBarProgress(nil)),
+	)
+	_, err := d.Download(context.Background(), remoteUrl, destinationPath)
+	return err
+}
+
+// Download fetches remoteUrl into destinationPath. Cancelling ctx stops every worker and TOR instance;
+// chunks already on disk are kept in the work directory so that a later call can resume them.
+func (d *Downloader) Download(ctx context.Context, remoteUrl string, destinationPath string) (result *DownloadResult, err error) {
+	startTime := time.Now()
+	result = &DownloadResult{URL: remoteUrl, DestinationPath: destinationPath}
+	defer func() {
+		result.Duration = time.Since(startTime)
+	}()
+
+	if d.workers == 0 {
+		return result, fmt.Errorf("number of workers cannot be 0")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// create tor circuits, unless a warm pool was provided
+	pool := d.pool
+	if pool == nil && d.torCircuits > 0 {
+		d.logger.Info("Creating TOR circuits...")
+		circuits, err := CreateTorCircuits(ctx, d.torCircuits, d.torConfig, d.logger)
 		if err != nil {
-			return fmt.Errorf("cannot create tor circuits. %s", err)
+			return result, fmt.Errorf("cannot create tor circuits. %s", err)
 		}
+		pool = NewCircuitPool(circuits, d.clientFactory, d.logger)
+		defer pool.Close()
+	}
+
+	defer func() {
+		d.progress.DownloadFinished(err)
+	}()
 
-		for _, circuit := range circuits {
-			defer circuit.Close()
+	stream := false
+	for restarts := 0; ; restarts++ {
+		err = d.fetch(ctx, pool, remoteUrl, destinationPath, stream, result)
+		if errors.Is(err, ErrRangeNotSupported) && !errors.Is(err, ErrUnknownSize) && !stream {
+			// found out by the chunks, when the probe was skipped or the server advertised ranges
+			d.logger.Warn(err, ". Downloading in a single stream ...")
+			stream = true
+			*result = DownloadResult{URL: remoteUrl, DestinationPath: destinationPath}
+			continue
+		}
+		if !errors.Is(err, ErrRemoteFileChanged) || !d.restartOnChange || restarts >= maxDownloadRestarts {
+			return result, err
+		}
+		d.logger.Warn(err, ". Restarting download from scratch ...")
+		if err := os.RemoveAll(destinationPath + WorkDirSuffix); err != nil {
+			return result, fmt.Errorf("cannot remove work dir: %s", err)
 		}
+		*result = DownloadResult{URL: remoteUrl, DestinationPath: destinationPath}
+	}
+}
+
+// fetch downloads remoteUrl once. With stream, or when the server does not support ranges, the
+// file is downloaded in a single chunk by a single worker, from the start on every attempt.
+func (d *Downloader) fetch(parentCtx context.Context, pool *CircuitPool, remoteUrl string, destinationPath string, stream bool, result *DownloadResult) (err error) {
+	ctx, abort := context.WithCancelCause(parentCtx)
+	defer abort(nil)
 
-		mainHttpClient = circuits[0].GetTorHttpClient()
-	} else {
-		mainHttpClient = &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment}}
+	// get remote file size from the download URL and its mirrors
+	urls := append([]string{remoteUrl}, d.mirrors...)
+	var remoteInfo *RemoteFileInfo
+	var mirrors []*mirror
+	if d.fileSize > 0 {
+		// the size was declared, e.g. by a metalink: nothing to probe
+		remoteInfo = &RemoteFileInfo{Size: d.fileSize}
+		for _, sourceUrl := range urls {
+			mirrors = append(mirrors, &mirror{url: sourceUrl})
+		}
+	} else if remoteInfo, mirrors, err = d.probeMirrors(ctx, pool, urls); err != nil {
+		return err
+	}
+	if remoteInfo.NoRanges && !stream {
+		d.logger.Warn("Server does not support range requests, downloading in a single stream")
+		stream = true
+	}
+	if stream {
+		mirrors = mirrors[:1]
 	}
+	if len(urls) > 1 {
+		d.logger.Info("Downloading from ", len(mirrors), " of ", len(urls), " mirrors")
+	}
+	fileSize := remoteInfo.Size
+	result.FileSize = fileSize
+	d.logger.Info("Remote file size: ", humanize.Bytes(uint64(fileSize)))
 
-	// get remote file size
-	logrus.Debug("Getting remote file size ...")
-	fileSize, err := GetRemoteFileSize(remoteUrl, mainHttpClient)
-	if err != nil {
-		return fmt.Errorf("cannot get remote file size. %s", err)
+	var pieces *pieceVerifier
+	if d.pieces != nil && !stream {
+		if pieces, err = newPieceVerifier(d.pieces, fileSize); err != nil {
+			return fmt.Errorf("cannot use piece hashes. %s", err)
+		}
 	}
-	logrus.Info("Remote file size: ", humanize.Bytes(uint64(fileSize)))
 
-	if chunkCount > 0 {
-		chunkSize = (fileSize + uint64(chunkCount) - 1) / uint64(chunkCount)
-		logrus.Info("Computed chunk size: ", humanize.Bytes(uint64(chunkSize)))
+	chunkSize := d.chunkSize
+	workerCount := d.workers
+	if stream {
+		chunkSize = fileSize
+		workerCount = 1
+	} else if fileSize > 0 && fileSize <= d.wholeFileSize {
+		// small files are not worth splitting, they take a single circuit
+		chunkSize = fileSize
+		d.logger.Debug("Downloading whole file in a single chunk")
+	} else if d.chunkCount > 0 {
+		chunkSize = (fileSize + uint64(d.chunkCount) - 1) / uint64(d.chunkCount)
+		d.logger.Info("Computed chunk size: ", humanize.Bytes(uint64(chunkSize)))
 	} else if chunkSize == 0 {
 		return fmt.Errorf("chunk size cannot be 0")
 	}
+	if pieces != nil && chunkSize%d.pieces.Length != 0 {
+		// chunks made of whole pieces can be verified as soon as they are downloaded
+		chunkSize += d.pieces.Length - chunkSize%d.pieces.Length
+		d.logger.Debug("Chunk size rounded up to ", humanize.Bytes(chunkSize), " to hold whole pieces")
+	}
+
+	// create work dir and lock it against other kerbetor runs
+	workDir := destinationPath + WorkDirSuffix
+	workDirLock, err := LockDir(ctx, workDir, d.waitForLock, d.logger)
+	if err != nil {
+		return err
+	}
+	defer workDirLock.Unlock()
+	if stream {
+		// nothing can be resumed without ranges
+		if err := clearWorkDir(workDir); err != nil {
+			return fmt.Errorf("cannot clear work dir. %s", err)
+		}
+	}
 
 	// create chunk controller
-	logrus.Debug("Creating chunk controller...")
-	// create work dir
-	workDir := destinationPath + ".ktor"
-	chunkController, err := NewChunkController(remoteUrl, workDir, fileSize, chunkSize)
+	d.logger.Debug("Creating chunk controller...")
+	chunkController, err := NewChunkController(remoteUrl, workDir, remoteInfo, chunkSize, d.logger)
 	if err != nil {
+		if errors.Is(err, ErrRemoteFileChanged) {
+			return err
+		}
 		return fmt.Errorf("cannot create chunk controller. %s", err)
 	}
+	initialSize := chunkController.GetDownloadedSize()
+	// the reference may have been probed with other validators when the download started
+	mirrors[0].ifRange = chunkController.IfRange()
+	mirrorSet := newMirrorSet(mirrors, d.logger)
 
-	// create download workers
-	var workersWG sync.WaitGroup
+	d.progress.DownloadStarted(remoteUrl, fileSize)
 
-	// create progress bar manager
-	progressbars := mpb.New(mpb.WithWidth(64), mpb.WithWaitGroup(&workersWG), mpb.WithRefreshRate(180*time.Millisecond))
-	mainBar := NewProgressBar(progressbars, "#### Total ...", fileSize, math.MaxInt)
+	// report overall progress and checkpoint metadata until workers are done
+	progressDone := make(chan struct{})
+	defer close(progressDone)
 	go func() {
+		ticker := time.NewTicker(DownloadedBytesRefreshRate)
+		defer ticker.Stop()
+		checkpointTicker := time.NewTicker(MetadataCheckpointInterval)
+		defer checkpointTicker.Stop()
 		for {
-			mainBar.SetCurrent(int64(chunkController.GetDownloadedSize()))
-			time.Sleep(DownloadedBytesRefreshRate)
+			select {
+			case <-ticker.C:
+				d.progress.DownloadProgress(chunkController.GetDownloadedSize())
+			case <-checkpointTicker.C:
+				if err := chunkController.Checkpoint(); err != nil {
+					d.logger.Warn("Cannot checkpoint metadata: ", err)
+				}
+			case <-progressDone:
+				return
+			}
 		}
 	}()
 
-	logrus.Debug("Creating ", maxConcurrentDownloads, " download workers...")
-	workers := make([]*TorInstanceWorker, maxConcurrentDownloads)
+	// create download workers
+	var workersWG sync.WaitGroup
+	d.logger.Debug("Creating ", workerCount, " download workers...")
+	workers := make([]*TorInstanceWorker, workerCount)
 	var i uint
-	for i = 0; i < maxConcurrentDownloads; i++ {
-		if numTorCircuits > 0 {
-			workers[i] = &TorInstanceWorker{workerIndex: i, torInstance: circuits[i%numTorCircuits], inChunkCh: make(chan *Chunk)}
-		} else {
-			workers[i] = &TorInstanceWorker{workerIndex: i, torInstance: nil, inChunkCh: make(chan *Chunk)}
+	for i = 0; i < workerCount; i++ {
+		workers[i] = &TorInstanceWorker{workerIndex: i, mirrors: mirrorSet, header: d.header, stream: stream, pieces: pieces, pool: pool, controller: chunkController, abort: abort, logger: d.logger, progress: d.progress}
+		if pool == nil {
+			workers[i].httpClient = d.clientFactory(nil)
 		}
 
 		workersWG.Add(1)
-		go workers[i].DownloadWorker(&workersWG, progressbars)
+		go workers[i].DownloadWorker(ctx, &workersWG)
 	}
 
-	logrus.Debug("Sending chunks to workers ...")
-	// send chunks to workers
-	for i = 0; ; i++ {
-		workerIndex := i % maxConcurrentDownloads
-		chunk := chunkController.GetNextEmptyChunk()
-		if chunk == nil {
-			break
-		}
-		workers[workerIndex].inChunkCh <- chunk
-	}
+	d.logger.Debug("Waiting for workers to finish ...")
+	workersWG.Wait()
 
-	// close channels and wait for workers to finish
-	logrus.Debug("Closing channels ...")
-	for i = 0; i < maxConcurrentDownloads; i++ {
-		close(workers[i].inChunkCh)
+	if err := chunkController.Checkpoint(); err != nil {
+		d.logger.Warn("Cannot checkpoint metadata: ", err)
 	}
 
-	workersWG.Wait()
-	logrus.Debug("Waiting for workers to finish ...")
-
+	result.Bytes = chunkController.GetDownloadedSize() - initialSize
 	flag := false
 	for _, chunk := range *chunkController.chunks {
-		logrus.Debug("Chunk: ", chunk.chunkPath, " status: ", chunk.status)
+		d.logger.Debug("Chunk: ", chunk.chunkPath, " status: ", chunk.status)
+		chunkBytes := chunk.bytesDownloaded
+		if chunk.status == ChunkStatusCompleted {
+			chunkBytes = chunk.endOffset - chunk.startOffset + 1
+		}
+		result.Chunks = append(result.Chunks, ChunkResult{
+			Index:       chunk.index,
+			StartOffset: chunk.startOffset,
+			EndOffset:   chunk.endOffset,
+			Status:      chunk.status,
+			Bytes:       chunkBytes,
+			Attempts:    chunk.attempts,
+			Err:         chunk.lastErr,
+		})
 		if chunk.status != ChunkStatusCompleted {
-			logrus.Errorf("Chunk %s was not downloaded", chunk.chunkPath)
+			if ctx.Err() == nil {
+				d.logger.Errorf("Chunk %s was not downloaded", chunk.chunkPath)
+			}
 			flag = true
 		}
 	}
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
 	if flag {
 		return fmt.Errorf("some chunks were not downloaded")
 	}
+	if pieces != nil {
+		// pieces across chunk boundaries, and those of chunks downloaded by a previous run
+		d.logger.Info("Verifying pieces ...")
+		if err := workers[0].repairPieces(ctx, 0, fileSize-1); err != nil {
+			if ctx.Err() != nil {
+				return context.Cause(ctx)
+			}
+			return fmt.Errorf("cannot verify pieces. %s", err)
+		}
+	}
 
-	mainBar.Abort(true)
-	logrus.Info("Merging chunks ...")
-	_, err = chunkController.MergeChunks(destinationPath)
+	digests, err := d.newDigests()
+	if err != nil {
+		return err
+	}
+	d.logger.Info("Merging chunks ...")
+	hashes := make([]hash.Hash, 0, len(digests))
+	for _, h := range digests {
+		hashes = append(hashes, h)
+	}
+	_, err = chunkController.MergeChunks(destinationPath, hashes...)
 	if err != nil {
 		return fmt.Errorf("cannot merge chunks. %s", err)
 	}
+
+	result.Checksums = make(map[string]string, len(digests))
+	for algorithm, h := range digests {
+		result.Checksums[algorithm] = hex.EncodeToString(h.Sum(nil))
+	}
+	for _, checksum := range d.checksums {
+		if actual := result.Checksums[checksum.Algorithm]; actual != checksum.Digest {
+			// keep the work dir so that the chunks can be inspected or merged again
+			os.Remove(destinationPath)
+			return &ChecksumMismatchError{Path: destinationPath, Algorithm: checksum.Algorithm, Expected: checksum.Digest, Actual: actual}
+		}
+		d.logger.Info("Checksum verified: ", checksum.Algorithm, " ", checksum.Digest)
+	}
+	if d.checksumSidecar {
+		if err := WriteChecksumSidecar(destinationPath, "sha256", result.Checksums["sha256"]); err != nil {
+			return err
+		}
+	}
+
+	workDirLock.Unlock()
+	if err := chunkController.RemoveWorkDir(); err != nil {
+		d.logger.Warn("Cannot remove work dir: ", err)
+	}
 	return nil
 }
+
+// probeMirrors gets the remote file info of the download URL and its mirrors. The first URL
+// answering is the reference, mirrors serving another file are not used.
+func (d *Downloader) probeMirrors(ctx context.Context, pool *CircuitPool, urls []string) (*RemoteFileInfo, []*mirror, error) {
+	d.logger.Debug("Getting remote file size ...")
+	infos, probeErrs := d.probe(ctx, pool, urls)
+	var remoteInfo *RemoteFileInfo
+	var mirrors, noRangeMirrors []*mirror
+	for i, sourceUrl := range urls {
+		if probeErrs[i] != nil {
+			if len(urls) > 1 && ctx.Err() == nil {
+				d.logger.Warn("Skipping ", sourceUrl, ": ", probeErrs[i])
+			}
+			continue
+		}
+		if remoteInfo == nil {
+			remoteInfo = infos[i]
+		} else if err := sameRemoteFile(remoteInfo, infos[i]); err != nil {
+			d.logger.Warn("Skipping mirror ", sourceUrl, ": ", err)
+			continue
+		}
+		m := &mirror{url: sourceUrl, ifRange: infos[i].IfRange()}
+		if infos[i].NoRanges {
+			noRangeMirrors = append(noRangeMirrors, m)
+		} else {
+			mirrors = append(mirrors, m)
+		}
+	}
+	if remoteInfo == nil {
+		return nil, nil, fmt.Errorf("cannot get remote file size. %w", probeErrs[0])
+	}
+	if len(mirrors) == 0 {
+		// the file can only be streamed
+		remoteInfo.NoRanges = true
+		return remoteInfo, noRangeMirrors, nil
+	}
+	// mirrors without ranges could only serve the whole file
+	for _, m := range noRangeMirrors {
+		d.logger.Warn("Skipping mirror ", m.url, ": ", ErrRangeNotSupported)
+	}
+	remoteInfo.NoRanges = false
+	return remoteInfo, mirrors, nil
+}
+
+// probe gets the remote file info of every URL concurrently, each on a circuit of pool.
+func (d *Downloader) probe(ctx context.Context, pool *CircuitPool, urls []string) ([]*RemoteFileInfo, []error) {
+	infos := make([]*RemoteFileInfo, len(urls))
+	errs := make([]error, len(urls))
+	var wg sync.WaitGroup
+	for i := range urls {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var circuit *TorInstance
+			var httpClient *http.Client
+			if pool != nil {
+				if circuit, errs[i] = pool.Acquire(); errs[i] != nil {
+					return
+				}
+				httpClient = pool.Client(circuit)
+			} else {
+				httpClient = d.clientFactory(nil)
+			}
+			probeStart := time.Now()
+			infos[i], errs[i] = getRemoteFileInfo(ctx, urls[i], d.header, httpClient)
+			if circuit != nil {
+				pool.Release(circuit, 0, time.Since(probeStart), errs[i])
+			}
+		}(i)
+	}
+	wg.Wait()
+	return infos, errs
+}
+
+// newDigests returns the hashes to compute while merging, by algorithm.
+func (d *Downloader) newDigests() (map[string]hash.Hash, error) {
+	digests := make(map[string]hash.Hash)
+	for _, checksum := range d.checksums {
+		h, err := checksum.NewHash()
+		if err != nil {
+			return nil, err
+		}
+		digests[checksum.Algorithm] = h
+	}
+	if _, ok := digests["sha256"]; d.checksumSidecar && !ok {
+		digests["sha256"], _ = newHash("sha256")
+	}
+	return digests, nil
+}
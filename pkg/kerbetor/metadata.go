@@ -0,0 +1,181 @@
+package kerbetor
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	MetadataFileName = "metadata.ktor"
+	MetadataVersion  = 1
+	// WorkDirSuffix is appended to the output path to name the work directory of a download.
+	WorkDirSuffix = ".ktor"
+)
+
+var ErrMetadataNotFound = errors.New("metadata not found")
+
+type ChunkMetadata struct {
+	Index           int         `json:"index"`
+	StartOffset     uint64      `json:"start_offset"`
+	EndOffset       uint64      `json:"end_offset"`
+	Status          ChunkStatus `json:"status"`
+	BytesDownloaded uint64      `json:"bytes_downloaded"`
+	// SHA256 is the hex digest of the .part file, recorded once the chunk is completed.
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// WorkDirMetadata is the JSON manifest stored in a download work directory.
+type WorkDirMetadata struct {
+	Version         int             `json:"version"`
+	KerbetorVersion string          `json:"kerbetor_version"`
+	URL             string          `json:"url"`
+	FileSize        uint64          `json:"file_size"`
+	ChunkSize       uint64          `json:"chunk_size"`
+	ETag            string          `json:"etag,omitempty"`
+	LastModified    string          `json:"last_modified,omitempty"`
+	CreatedAt       time.Time       `json:"created_at"`
+	UpdatedAt       time.Time       `json:"updated_at"`
+	Chunks          []ChunkMetadata `json:"chunks"`
+
+	// Migrated is set when the metadata was read from a legacy metadata.ktor file.
+	Migrated bool `json:"-"`
+}
+
+func (s ChunkStatus) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *ChunkStatus) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "not-started":
+		*s = ChunkStatusNotStarted
+	case "in-progress":
+		*s = ChunkStatusInProgress
+	case "completed":
+		*s = ChunkStatusCompleted
+	case "error":
+		*s = ChunkStatusError
+	default:
+		return fmt.Errorf("unknown chunk status: %s", text)
+	}
+	return nil
+}
+
+func NewWorkDirMetadata(remoteUrl string, info *RemoteFileInfo, chunkSize uint64) *WorkDirMetadata {
+	now := time.Now().UTC()
+	return &WorkDirMetadata{
+		Version:         MetadataVersion,
+		KerbetorVersion: Version,
+		URL:             remoteUrl,
+		FileSize:        info.Size,
+		ChunkSize:       chunkSize,
+		ETag:            info.ETag,
+		LastModified:    info.LastModified,
+		CreatedAt:       now,
+		UpdatedAt:       now,
+	}
+}
+
+// LoadWorkDirMetadata reads the metadata of workPath. Legacy three-line files are converted
+// on the fly; the caller is expected to save the result to complete the migration.
+func LoadWorkDirMetadata(workPath string) (*WorkDirMetadata, error) {
+	metadataPath := filepath.Join(workPath, MetadataFileName)
+	content, err := os.ReadFile(metadataPath)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, ErrMetadataNotFound
+		}
+		return nil, fmt.Errorf("cannot read file %s: %s", metadataPath, err)
+	}
+
+	trimmed := bytes.TrimSpace(content)
+	if len(trimmed) > 0 && trimmed[0] != '{' {
+		return parseLegacyMetadata(metadataPath, string(trimmed))
+	}
+
+	var metadata WorkDirMetadata
+	if err := json.Unmarshal(trimmed, &metadata); err != nil {
+		return nil, fmt.Errorf("cannot parse file %s: %s", metadataPath, err)
+	}
+	if metadata.Version > MetadataVersion {
+		return nil, fmt.Errorf("metadata version %d is newer than supported version %d", metadata.Version, MetadataVersion)
+	}
+	return &metadata, nil
+}
+
+func parseLegacyMetadata(metadataPath string, content string) (*WorkDirMetadata, error) {
+	lines := strings.Split(content, "\n")
+	if len(lines) < 3 {
+		return nil, fmt.Errorf("invalid legacy metadata file %s", metadataPath)
+	}
+	fileSize, err := strconv.ParseUint(strings.TrimSpace(lines[1]), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid file size in %s: %s", metadataPath, err)
+	}
+	chunkSize, err := strconv.ParseUint(strings.TrimSpace(lines[2]), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid chunk size in %s: %s", metadataPath, err)
+	}
+
+	metadata := NewWorkDirMetadata(strings.TrimSpace(lines[0]), &RemoteFileInfo{Size: fileSize}, chunkSize)
+	if info, err := os.Stat(metadataPath); err == nil {
+		metadata.CreatedAt = info.ModTime().UTC()
+	}
+	metadata.Migrated = true
+	return metadata, nil
+}
+
+// Save atomically writes the metadata to workPath.
+func (m *WorkDirMetadata) Save(workPath string) error {
+	m.Version = MetadataVersion
+	m.KerbetorVersion = Version
+	m.UpdatedAt = time.Now().UTC()
+
+	content, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("cannot encode metadata: %s", err)
+	}
+
+	metadataPath := filepath.Join(workPath, MetadataFileName)
+	tmpPath := metadataPath + ".tmp"
+	if err := os.WriteFile(tmpPath, append(content, '\n'), 0644); err != nil {
+		return fmt.Errorf("cannot write to file %s: %s", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, metadataPath); err != nil {
+		return fmt.Errorf("cannot write to file %s: %s", metadataPath, err)
+	}
+	return nil
+}
+
+// Matches checks that the metadata describes the same download. A change of the remote
+// representation is reported as a *RemoteFileChangedError.
+func (m *WorkDirMetadata) Matches(remoteUrl string, info *RemoteFileInfo, chunkSize uint64) error {
+	if m.URL != remoteUrl {
+		return fmt.Errorf("remote URL is different")
+	}
+	if m.FileSize != info.Size {
+		return &RemoteFileChangedError{URL: remoteUrl, Reason: fmt.Sprintf("size changed from %d to %d", m.FileSize, info.Size)}
+	}
+	if m.ETag != "" && info.ETag != "" && m.ETag != info.ETag {
+		return &RemoteFileChangedError{URL: remoteUrl, Reason: fmt.Sprintf("ETag changed from %s to %s", m.ETag, info.ETag)}
+	}
+	if m.LastModified != "" && info.LastModified != "" && m.LastModified != info.LastModified {
+		return &RemoteFileChangedError{URL: remoteUrl, Reason: fmt.Sprintf("Last-Modified changed from %s to %s", m.LastModified, info.LastModified)}
+	}
+	if m.ChunkSize != chunkSize {
+		return fmt.Errorf("chunk size is different")
+	}
+	return nil
+}
+
+// IfRange returns the validator to send with ranged requests for this download.
+func (m *WorkDirMetadata) IfRange() string {
+	return (&RemoteFileInfo{ETag: m.ETag, LastModified: m.LastModified}).IfRange()
+}
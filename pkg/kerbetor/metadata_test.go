@@ -0,0 +1,132 @@
+package kerbetor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+// writeLegacyWorkDir writes a work directory as left by kerbetor before the JSON metadata: a
+// three-line metadata.ktor and one .part file per chunk holding the given prefix of the chunk.
+func writeLegacyWorkDir(t *testing.T, workPath string, remoteUrl string, content []byte, chunkSize uint64, downloaded []uint64) {
+	t.Helper()
+	if err := os.Mkdir(workPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	legacy := fmt.Sprintf("%s\n%d\n%d\n", remoteUrl, len(content), chunkSize)
+	if err := os.WriteFile(filepath.Join(workPath, MetadataFileName), []byte(legacy), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for idx, n := range downloaded {
+		if n == 0 {
+			continue
+		}
+		start := uint64(idx) * chunkSize
+		part := filepath.Join(workPath, fmt.Sprintf("%d.part", idx))
+		if err := os.WriteFile(part, content[start:start+n], 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestResumeLegacyWorkDir(t *testing.T) {
+	const chunkSize = MinSplitSize
+	const fileSize = 3*chunkSize + 100
+	content := make([]byte, fileSize)
+	rand.New(rand.NewSource(2)).Read(content)
+	dir := t.TempDir()
+	workPath := filepath.Join(dir, "file.bin"+WorkDirSuffix)
+	// chunk 0 complete, chunk 1 partial, chunk 2 missing, last chunk partial
+	writeLegacyWorkDir(t, workPath, testChunkURL, content, chunkSize, []uint64{chunkSize, chunkSize / 3, 0, 40})
+
+	metadata, err := LoadWorkDirMetadata(workPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !metadata.Migrated || metadata.URL != testChunkURL || metadata.FileSize != fileSize || metadata.ChunkSize != chunkSize {
+		t.Fatalf("got legacy metadata %+v", metadata)
+	}
+
+	c := newTestChunkController(t, workPath, fileSize, chunkSize)
+	if got, want := c.GetDownloadedSize(), uint64(chunkSize+chunkSize/3+40); got != want {
+		t.Errorf("got %d bytes downloaded after migration, want %d", got, want)
+	}
+	migrated, err := LoadWorkDirMetadata(workPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migrated.Migrated || len(migrated.Chunks) != 4 || migrated.ETag != `"v1"` {
+		t.Errorf("metadata not migrated to JSON: %+v", migrated)
+	}
+
+	for chunk := c.NextChunk(context.Background()); chunk != nil; chunk = c.NextChunk(context.Background()) {
+		start, end := c.ChunkRange(chunk)
+		file, err := os.OpenFile(chunk.chunkPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Write(content[start+chunk.bytesDownloaded : end+1])
+		file.Close()
+		if err := c.CompleteChunk(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	output := filepath.Join(dir, "file.bin")
+	if _, err := c.MergeChunks(output); err != nil {
+		t.Fatal(err)
+	}
+	merged, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(merged, content) {
+		t.Error("merged file differs from the original")
+	}
+}
+
+func TestLegacyWorkDirMismatch(t *testing.T) {
+	const chunkSize = MinSplitSize
+	const fileSize = 2*chunkSize + 10
+	content := make([]byte, fileSize)
+	logger := logrus.New()
+	logger.Out = io.Discard
+
+	for _, test := range []struct {
+		name      string
+		url       string
+		size      uint64
+		chunkSize uint64
+		changed   bool
+	}{
+		{"url", "http://example.onion/other.bin", fileSize, chunkSize, false},
+		{"size", testChunkURL, fileSize + 1, chunkSize, true},
+		{"chunk size", testChunkURL, fileSize, 2 * chunkSize, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			workPath := filepath.Join(t.TempDir(), "file.bin"+WorkDirSuffix)
+			writeLegacyWorkDir(t, workPath, testChunkURL, content, chunkSize, []uint64{chunkSize / 2})
+
+			_, err := NewChunkController(test.url, workPath, &RemoteFileInfo{Size: test.size}, test.chunkSize, logger)
+			if err == nil {
+				t.Fatal("legacy work directory of another download accepted")
+			}
+			var changedErr *RemoteFileChangedError
+			if errors.As(err, &changedErr) != test.changed {
+				t.Errorf("got error %v, RemoteFileChangedError expected: %t", err, test.changed)
+			}
+			// the rejected work directory is left as it was
+			if metadata, err := LoadWorkDirMetadata(workPath); err != nil || !metadata.Migrated {
+				t.Errorf("legacy metadata rewritten: %+v, %v", metadata, err)
+			}
+		})
+	}
+}
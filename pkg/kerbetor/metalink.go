@@ -0,0 +1,173 @@
+package kerbetor
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Metalink is a metalink document, in the RFC 5854 format (.meta4) or the older Metalink 3.0
+// format (.metalink).
+type Metalink struct {
+	Files []MetalinkFile
+}
+
+// MetalinkFile is a file described by a metalink.
+type MetalinkFile struct {
+	// Name is the path of the file, relative to the download directory.
+	Name string
+	// Size is 0 when the metalink does not declare it.
+	Size uint64
+	// URLs are the http and https URLs of the file, most preferred first.
+	URLs []string
+	// Checksum is the strongest supported whole-file hash, nil if there is none.
+	Checksum *Checksum
+	// Pieces is nil when the metalink has no piece hashes with a supported algorithm.
+	Pieces *PieceHashes
+}
+
+// hash algorithms of whole-file hashes, strongest first
+var metalinkHashPreference = []string{"sha512", "sha256", "sha1", "md5"}
+
+type metalinkXML struct {
+	Files   []metalinkFileXML `xml:"file"`
+	FilesV3 []metalinkFileXML `xml:"files>file"`
+}
+
+type metalinkFileXML struct {
+	Name     string              `xml:"name,attr"`
+	Size     string              `xml:"size"`
+	Hashes   []metalinkHashXML   `xml:"hash"`
+	HashesV3 []metalinkHashXML   `xml:"verification>hash"`
+	Pieces   []metalinkPiecesXML `xml:"pieces"`
+	PiecesV3 []metalinkPiecesXML `xml:"verification>pieces"`
+	URLs     []metalinkURLXML    `xml:"url"`
+	URLsV3   []metalinkURLXML    `xml:"resources>url"`
+}
+
+type metalinkHashXML struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+type metalinkPiecesXML struct {
+	Type   string            `xml:"type,attr"`
+	Length uint64            `xml:"length,attr"`
+	Hashes []metalinkHashXML `xml:"hash"`
+}
+
+type metalinkURLXML struct {
+	// Priority ranks RFC 5854 URLs, 1 first. 0 when missing.
+	Priority int `xml:"priority,attr"`
+	// Preference ranks Metalink 3.0 URLs, 100 first.
+	Preference int `xml:"preference,attr"`
+	// Type is the protocol of Metalink 3.0 URLs, such as "http" or "bittorrent" for links to
+	// .torrent files.
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+// ParseMetalink reads a metalink document. URLs of other protocols than http and https, and
+// hashes of unsupported algorithms, are ignored.
+func ParseMetalink(r io.Reader) (*Metalink, error) {
+	var doc metalinkXML
+	if err := xml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, fmt.Errorf("invalid metalink: %s", err)
+	}
+	metalink := &Metalink{}
+	for _, fileXML := range append(doc.Files, doc.FilesV3...) {
+		file, err := fileXML.parse()
+		if err != nil {
+			return nil, err
+		}
+		metalink.Files = append(metalink.Files, *file)
+	}
+	if len(metalink.Files) == 0 {
+		return nil, fmt.Errorf("invalid metalink: no file")
+	}
+	return metalink, nil
+}
+
+func (f *metalinkFileXML) parse() (*MetalinkFile, error) {
+	name := filepath.Clean(filepath.FromSlash(strings.TrimSpace(f.Name)))
+	if f.Name == "" || filepath.IsAbs(name) || filepath.VolumeName(name) != "" || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+		return nil, fmt.Errorf("invalid metalink: unsafe file name %q", f.Name)
+	}
+	file := &MetalinkFile{Name: name}
+
+	if size := strings.TrimSpace(f.Size); size != "" {
+		value, err := strconv.ParseUint(size, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid metalink: invalid size of %s: %q", name, size)
+		}
+		file.Size = value
+	}
+
+	// RFC 5854 URLs by priority, those without one last, then Metalink 3.0 URLs by preference
+	urls := append([]metalinkURLXML{}, f.URLs...)
+	sort.SliceStable(urls, func(i, j int) bool { return urlPriority(urls[i]) < urlPriority(urls[j]) })
+	urlsV3 := append([]metalinkURLXML{}, f.URLsV3...)
+	sort.SliceStable(urlsV3, func(i, j int) bool { return urlsV3[i].Preference > urlsV3[j].Preference })
+	for _, u := range append(urls, urlsV3...) {
+		value := strings.TrimSpace(u.Value)
+		if urlType := strings.ToLower(strings.TrimSpace(u.Type)); urlType != "" && urlType != "http" && urlType != "https" {
+			continue
+		}
+		if parsed, err := url.Parse(value); err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") {
+			file.URLs = append(file.URLs, value)
+		}
+	}
+	if len(file.URLs) == 0 {
+		return nil, fmt.Errorf("invalid metalink: no http or https URL for %s", name)
+	}
+
+	hashes := make(map[string]string)
+	for _, h := range append(f.Hashes, f.HashesV3...) {
+		hashes[metalinkHashAlgorithm(h.Type)] = strings.TrimSpace(h.Value)
+	}
+	for _, algorithm := range metalinkHashPreference {
+		if digest, ok := hashes[algorithm]; ok {
+			checksum, err := NewChecksum(algorithm, digest)
+			if err != nil {
+				return nil, fmt.Errorf("invalid metalink: %s", err)
+			}
+			file.Checksum = &checksum
+			break
+		}
+	}
+
+	for _, pieces := range append(f.Pieces, f.PiecesV3...) {
+		algorithm := metalinkHashAlgorithm(pieces.Type)
+		if _, err := newHash(algorithm); err != nil {
+			continue
+		}
+		if pieces.Length == 0 || len(pieces.Hashes) == 0 {
+			return nil, fmt.Errorf("invalid metalink: invalid pieces of %s", name)
+		}
+		file.Pieces = &PieceHashes{Algorithm: algorithm, Length: pieces.Length}
+		for _, h := range pieces.Hashes {
+			file.Pieces.Hashes = append(file.Pieces.Hashes, strings.ToLower(strings.TrimSpace(h.Value)))
+		}
+		break
+	}
+	return file, nil
+}
+
+func urlPriority(u metalinkURLXML) int {
+	if u.Priority <= 0 {
+		return math.MaxInt
+	}
+	return u.Priority
+}
+
+// metalinkHashAlgorithm returns the name of a metalink hash type ("sha-256" in RFC 5854, "sha256"
+// in Metalink 3.0) as used by Checksum.
+func metalinkHashAlgorithm(hashType string) string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimSpace(hashType)), "-", "")
+}
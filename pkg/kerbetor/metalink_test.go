@@ -0,0 +1,142 @@
+package kerbetor
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const (
+	testSHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	testSHA1   = "da39a3ee5e6b4b0d3255bfef95601890afd80709"
+	testMD5    = "d41d8cd98f00b204e9800998ecf8427e"
+)
+
+func TestParseMetalink(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		doc  string
+		want []MetalinkFile
+	}{
+		{
+			name: "rfc 5854",
+			doc: `<?xml version="1.0" encoding="UTF-8"?>
+<metalink xmlns="urn:ietf:params:xml:ns:metalink">
+  <file name="dir/file.bin">
+    <size>1048577</size>
+    <hash type="md5">` + testMD5 + `</hash>
+    <hash type="sha-256">` + strings.ToUpper(testSHA256) + `</hash>
+    <pieces length="524288" type="sha-1">
+      <hash>` + testSHA1 + `</hash>
+      <hash>` + testSHA1 + `</hash>
+      <hash>` + strings.ToUpper(testSHA1) + `</hash>
+    </pieces>
+    <url>http://c.onion/file.bin</url>
+    <url priority="2">https://b.onion/file.bin</url>
+    <url priority="1">http://a.onion/file.bin</url>
+    <url priority="1">ftp://ftp.example.org/file.bin</url>
+  </file>
+  <file name="other.bin">
+    <url> http://a.onion/other.bin </url>
+  </file>
+</metalink>`,
+			want: []MetalinkFile{
+				{
+					Name:     "dir/file.bin",
+					Size:     1048577,
+					URLs:     []string{"http://a.onion/file.bin", "https://b.onion/file.bin", "http://c.onion/file.bin"},
+					Checksum: &Checksum{Algorithm: "sha256", Digest: testSHA256},
+					Pieces:   &PieceHashes{Algorithm: "sha1", Length: 524288, Hashes: []string{testSHA1, testSHA1, testSHA1}},
+				},
+				{Name: "other.bin", URLs: []string{"http://a.onion/other.bin"}},
+			},
+		},
+		{
+			name: "metalink 3.0",
+			doc: `<?xml version="1.0" encoding="UTF-8"?>
+<metalink version="3.0" xmlns="http://www.metalinker.org/">
+  <files>
+    <file name="file.bin">
+      <size>42</size>
+      <verification>
+        <hash type="sha1">` + testSHA1 + `</hash>
+        <hash type="md5">` + testMD5 + `</hash>
+        <pieces length="32" type="sha1">
+          <hash piece="0">` + testSHA1 + `</hash>
+          <hash piece="1">` + testSHA1 + `</hash>
+        </pieces>
+      </verification>
+      <resources>
+        <url type="http" preference="10">http://c.onion/file.bin</url>
+        <url type="http" preference="100">http://a.onion/file.bin</url>
+        <url type="bittorrent" preference="100">http://a.onion/file.bin.torrent</url>
+        <url type="https" preference="50">https://b.onion/file.bin</url>
+      </resources>
+    </file>
+  </files>
+</metalink>`,
+			want: []MetalinkFile{
+				{
+					Name:     "file.bin",
+					Size:     42,
+					URLs:     []string{"http://a.onion/file.bin", "https://b.onion/file.bin", "http://c.onion/file.bin"},
+					Checksum: &Checksum{Algorithm: "sha1", Digest: testSHA1},
+					Pieces:   &PieceHashes{Algorithm: "sha1", Length: 32, Hashes: []string{testSHA1, testSHA1}},
+				},
+			},
+		},
+		{
+			name: "unsupported hashes",
+			doc: `<metalink xmlns="urn:ietf:params:xml:ns:metalink">
+  <file name="file.bin">
+    <hash type="crc32">00000000</hash>
+    <pieces length="1024" type="tiger"><hash>00</hash></pieces>
+    <url>http://a.onion/file.bin</url>
+  </file>
+</metalink>`,
+			want: []MetalinkFile{{Name: "file.bin", URLs: []string{"http://a.onion/file.bin"}}},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			metalink, err := ParseMetalink(strings.NewReader(test.doc))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range test.want {
+				test.want[i].Name = filepath.FromSlash(test.want[i].Name)
+			}
+			if !reflect.DeepEqual(metalink.Files, test.want) {
+				t.Errorf("got %+v, want %+v", metalink.Files, test.want)
+			}
+		})
+	}
+}
+
+func TestParseMetalinkInvalid(t *testing.T) {
+	file := func(name string, body string) string {
+		return `<metalink xmlns="urn:ietf:params:xml:ns:metalink"><file name="` + name + `">` + body + `</file></metalink>`
+	}
+	const source = `<url>http://a.onion/file.bin</url>`
+
+	for _, test := range []struct {
+		name string
+		doc  string
+	}{
+		{"parent directory", file("../file.bin", source)},
+		{"parent directory inside", file("dir/../../file.bin", source)},
+		{"parent directory only", file("..", source)},
+		{"absolute path", file("/etc/passwd", source)},
+		{"empty name", file("", source)},
+		{"no file", `<metalink xmlns="urn:ietf:params:xml:ns:metalink"></metalink>`},
+		{"no http url", file("file.bin", `<url>ftp://a.onion/file.bin</url>`)},
+		{"invalid size", file("file.bin", `<size>-1</size>`+source)},
+		{"invalid digest", file("file.bin", `<hash type="sha-256">abcd</hash>`+source)},
+		{"pieces without length", file("file.bin", `<pieces type="sha-1"><hash>`+testSHA1+`</hash></pieces>`+source)},
+		{"not xml", "file.bin"},
+	} {
+		if metalink, err := ParseMetalink(strings.NewReader(test.doc)); err == nil {
+			t.Errorf("%s: got %+v, want an error", test.name, metalink.Files)
+		}
+	}
+}
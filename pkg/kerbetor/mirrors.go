@@ -0,0 +1,171 @@
+package kerbetor
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// a mirror failing this many chunks in a row is dropped
+	maxMirrorErrorsInARow = 3
+	// a mirror slower than this fraction of the fastest one is dropped
+	slowMirrorRatio = 0.2
+	// chunks a mirror must complete before it can be found slow
+	slowMirrorSamples = 2
+)
+
+// mirror is a URL serving the file of a download.
+type mirror struct {
+	url string
+	// ifRange is the validator this mirror reported for the file
+	ifRange string
+
+	active       int
+	throughput   float64
+	samples      int
+	errorsInARow int
+	dropped      bool
+}
+
+// sameRemoteFile checks that a mirror reporting info serves the file described by reference:
+// same size, and same ETag and Last-Modified when both report them.
+func sameRemoteFile(reference *RemoteFileInfo, info *RemoteFileInfo) error {
+	if info.Size != reference.Size {
+		return fmt.Errorf("size %d differs from %d", info.Size, reference.Size)
+	}
+	if reference.ETag != "" && info.ETag != "" && info.ETag != reference.ETag {
+		return fmt.Errorf("ETag %s differs from %s", info.ETag, reference.ETag)
+	}
+	if reference.LastModified != "" && info.LastModified != "" && info.LastModified != reference.LastModified {
+		return fmt.Errorf("Last-Modified %s differs from %s", info.LastModified, reference.LastModified)
+	}
+	return nil
+}
+
+// mirrorSet spreads the chunks of a download across the URLs serving the file, favouring the
+// fastest ones, and drops the mirrors that keep failing or crawl. The last mirror is never
+// dropped: its errors fail the chunks as without mirrors.
+type mirrorSet struct {
+	mu      sync.Mutex
+	mirrors []*mirror
+	logger  logrus.FieldLogger
+}
+
+func newMirrorSet(mirrors []*mirror, logger logrus.FieldLogger) *mirrorSet {
+	return &mirrorSet{mirrors: mirrors, logger: logger}
+}
+
+// Acquire returns the mirror the next chunk should be fetched from: the one with the best
+// throughput per active chunk, avoiding those that just failed. Every successful Acquire must be
+// followed by a Release or a Cancel. The last mirror is never dropped, so it only fails when the
+// set was created empty.
+func (s *mirrorSet) Acquire() (*mirror, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var best *mirror
+	var bestScore float64
+	fastest := s.fastestLocked(nil)
+	for _, m := range s.mirrors {
+		if m.dropped {
+			continue
+		}
+		throughput := m.throughput
+		if m.samples == 0 {
+			// untested mirrors are tried as if they were the fastest
+			throughput = fastest + 1
+		}
+		score := throughput / float64(m.active+1) / float64(m.errorsInARow+1)
+		if best == nil || score > bestScore {
+			best, bestScore = m, score
+		}
+	}
+	if best == nil {
+		return nil, fmt.Errorf("no mirror left")
+	}
+	best.active++
+	return best, nil
+}
+
+// Cancel gives back m when nothing was fetched from it, without recording an outcome.
+func (s *mirrorSet) Cancel(m *mirror) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m.active--
+}
+
+// Release records the outcome of a chunk fetched from m. It drops m when it failed too many
+// chunks in a row or is much slower than the other mirrors.
+func (s *mirrorSet) Release(m *mirror, bytes uint64, elapsed time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m.active--
+	if bytes > 0 && elapsed >= minThroughputSampleTime {
+		sample := float64(bytes) / elapsed.Seconds()
+		if m.samples == 0 {
+			m.throughput = sample
+		} else {
+			m.throughput = throughputSmoothing*sample + (1-throughputSmoothing)*m.throughput
+		}
+		m.samples++
+	}
+	if err != nil {
+		m.errorsInARow++
+		if m.errorsInARow >= maxMirrorErrorsInARow {
+			s.dropLocked(m, fmt.Sprintf("%d errors in a row, last: %s", m.errorsInARow, err))
+		}
+		return
+	}
+	m.errorsInARow = 0
+	if fastest := s.fastestLocked(m); m.samples >= slowMirrorSamples && m.throughput < slowMirrorRatio*fastest {
+		s.dropLocked(m, fmt.Sprintf("too slow (%.0f KiB/s)", m.throughput/1024))
+	}
+}
+
+// Drop stops using m, unless it is the last mirror left. It reports whether m was dropped.
+func (s *mirrorSet) Drop(m *mirror, reason string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropLocked(m, reason)
+}
+
+// Alternatives reports whether other mirrors than m are still in use.
+func (s *mirrorSet) Alternatives(m *mirror) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, other := range s.mirrors {
+		if other != m && !other.dropped {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *mirrorSet) dropLocked(m *mirror, reason string) bool {
+	if m.dropped {
+		return true
+	}
+	for _, other := range s.mirrors {
+		if other != m && !other.dropped {
+			m.dropped = true
+			s.logger.Warn("Dropping mirror ", m.url, ": ", reason)
+			return true
+		}
+	}
+	return false
+}
+
+// fastestLocked returns the best throughput among the mirrors in use, excluding except.
+func (s *mirrorSet) fastestLocked(except *mirror) float64 {
+	var fastest float64
+	for _, m := range s.mirrors {
+		if m != except && !m.dropped && m.samples > 0 && m.throughput > fastest {
+			fastest = m.throughput
+		}
+	}
+	return fastest
+}
@@ -0,0 +1,193 @@
+package kerbetor
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// HTTPClientFactory returns the HTTP client used to talk to the remote server.
+// circuit is nil when the download does not go through TOR.
+type HTTPClientFactory func(circuit *TorInstance) *http.Client
+
+// Option configures a Downloader.
+type Option func(*Downloader)
+
+const (
+	DefaultChunkSize   = 100 * 1024 * 1024
+	DefaultWorkers     = 3
+	DefaultTorCircuits = 1
+)
+
+// WithChunkSize sets the size of each chunk.
+func WithChunkSize(chunkSize uint64) Option {
+	return func(d *Downloader) {
+		d.chunkSize = chunkSize
+	}
+}
+
+// WithChunkCount splits the file in chunkCount chunks. It overrides WithChunkSize.
+func WithChunkCount(chunkCount uint) Option {
+	return func(d *Downloader) {
+		d.chunkCount = chunkCount
+	}
+}
+
+// WithWholeFileSize downloads files up to size in a single chunk instead of splitting them.
+// It overrides WithChunkSize and WithChunkCount for those files.
+func WithWholeFileSize(size uint64) Option {
+	return func(d *Downloader) {
+		d.wholeFileSize = size
+	}
+}
+
+// WithWorkers sets the number of chunks downloaded concurrently.
+func WithWorkers(workers uint) Option {
+	return func(d *Downloader) {
+		d.workers = workers
+	}
+}
+
+// WithTorCircuits sets the number of TOR circuits. 0 disables TOR.
+func WithTorCircuits(numTorCircuits uint) Option {
+	return func(d *Downloader) {
+		d.torCircuits = numTorCircuits
+	}
+}
+
+// WithBootstrapTimeout sets how long each tor process may take to bootstrap. 0 means no limit.
+func WithBootstrapTimeout(timeout time.Duration) Option {
+	return func(d *Downloader) {
+		d.torConfig.BootstrapTimeout = timeout
+	}
+}
+
+// WithTorMode sets how tor processes are started, TorModeProcess or TorModeShared.
+func WithTorMode(mode string) Option {
+	return func(d *Downloader) {
+		d.torConfig.Mode = mode
+	}
+}
+
+// WithTorCacheDir sets the directory caching tor directory information between runs.
+// Empty disables the cache.
+func WithTorCacheDir(cacheDir string) Option {
+	return func(d *Downloader) {
+		d.torConfig.CacheDir = cacheDir
+	}
+}
+
+// WithExternalTor makes the Downloader use an already running tor instead of starting its own
+// processes. controlAddr and controlPassword are optional.
+func WithExternalTor(socksAddrs []string, controlAddr string, controlPassword string) Option {
+	return func(d *Downloader) {
+		d.torConfig.SOCKSAddrs = socksAddrs
+		d.torConfig.ControlAddr = controlAddr
+		d.torConfig.ControlPassword = controlPassword
+	}
+}
+
+// WithCircuitPool makes the Downloader use circuits from an existing pool instead of creating
+// its own, so that several downloads can share bootstrapped circuits. The pool is not closed
+// when the download ends.
+func WithCircuitPool(pool *CircuitPool) Option {
+	return func(d *Downloader) {
+		d.pool = pool
+	}
+}
+
+// WithHeader sends the extra HTTP headers header, such as cookies or an authorization, with every
+// request of the download.
+func WithHeader(header http.Header) Option {
+	return func(d *Downloader) {
+		d.header = header
+	}
+}
+
+// WithMirrors sets other URLs serving the same file. Mirrors reporting another size, ETag or
+// Last-Modified than the download URL are skipped; chunks are spread across the download URL and
+// the others, dropping those that keep failing or are much slower. The work dir is kept under the
+// download URL, even when it cannot be reached.
+func WithMirrors(mirrors ...string) Option {
+	return func(d *Downloader) {
+		d.mirrors = mirrors
+	}
+}
+
+// WithFileSize sets the size of the file when it is known in advance, such as from a metalink.
+// The download URL and its mirrors are then not probed, and all of them are used. Without a probe
+// there is no ETag or Last-Modified to check on resume nor to send in If-Range, so a file changed
+// on the server between two runs is only detected by a checksum or WithPieceHashes.
+func WithFileSize(size uint64) Option {
+	return func(d *Downloader) {
+		d.fileSize = size
+	}
+}
+
+// WithPieceHashes verifies each chunk against the piece hashes of the file as soon as it is
+// downloaded, and downloads only the pieces that do not match again. The chunk size is rounded
+// up to a multiple of the piece length.
+func WithPieceHashes(pieces *PieceHashes) Option {
+	return func(d *Downloader) {
+		d.pieces = pieces
+	}
+}
+
+// WithHTTPClientFactory overrides how HTTP clients are built for each circuit.
+func WithHTTPClientFactory(factory HTTPClientFactory) Option {
+	return func(d *Downloader) {
+		d.clientFactory = factory
+	}
+}
+
+// WithLogger sets the logger used by the Downloader.
+func WithLogger(logger logrus.FieldLogger) Option {
+	return func(d *Downloader) {
+		d.logger = logger
+	}
+}
+
+// WithProgress sets the sink receiving progress notifications.
+func WithProgress(progress ProgressSink) Option {
+	return func(d *Downloader) {
+		d.progress = progress
+	}
+}
+
+func defaultHTTPClientFactory(circuit *TorInstance) *http.Client {
+	if circuit != nil {
+		return circuit.GetTorHttpClient()
+	}
+	return &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment}}
+}
+
+// WithRestartOnChange makes the Downloader discard the work dir and start over when the
+// remote file changes, instead of failing with a *RemoteFileChangedError.
+func WithRestartOnChange(restart bool) Option {
+	return func(d *Downloader) {
+		d.restartOnChange = restart
+	}
+}
+
+// WithChecksum verifies the merged file against checksum. It can be given several times.
+func WithChecksum(checksum Checksum) Option {
+	return func(d *Downloader) {
+		d.checksums = append(d.checksums, checksum)
+	}
+}
+
+// WithWaitForLock makes the Downloader wait for the work dir when another kerbetor is using it,
+// instead of failing with a *DirLockedError.
+func WithWaitForLock(wait bool) Option {
+	return func(d *Downloader) {
+		d.waitForLock = wait
+	}
+}
+
+// WithChecksumSidecar writes a <file>.sha256 file next to each successful download.
+func WithChecksumSidecar(write bool) Option {
+	return func(d *Downloader) {
+		d.checksumSidecar = write
+	}
+}
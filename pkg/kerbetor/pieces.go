@@ -0,0 +1,157 @@
+package kerbetor
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// PieceHashes are the hex digests of the consecutive pieces of a file, as published in
+// metalinks. Every piece is Length bytes long, except the last one.
+type PieceHashes struct {
+	Algorithm string   `json:"algorithm"`
+	Length    uint64   `json:"length"`
+	Hashes    []string `json:"hashes"`
+}
+
+// pieceVerifier checks downloaded ranges against the piece hashes of the file, remembering the
+// pieces already found good.
+type pieceVerifier struct {
+	pieces   PieceHashes
+	fileSize uint64
+
+	mu       sync.Mutex
+	verified []bool
+}
+
+func newPieceVerifier(pieces *PieceHashes, fileSize uint64) (*pieceVerifier, error) {
+	h, err := newHash(pieces.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	if pieces.Length == 0 {
+		return nil, fmt.Errorf("invalid piece length 0")
+	}
+	count := (fileSize + pieces.Length - 1) / pieces.Length
+	if uint64(len(pieces.Hashes)) != count {
+		return nil, fmt.Errorf("%d piece hashes for %d pieces of %d bytes", len(pieces.Hashes), count, pieces.Length)
+	}
+	for i, digest := range pieces.Hashes {
+		if decoded, err := hex.DecodeString(digest); err != nil || len(decoded) != h.Size() {
+			return nil, fmt.Errorf("invalid %s digest of piece %d: %s", pieces.Algorithm, i, digest)
+		}
+	}
+	return &pieceVerifier{pieces: *pieces, fileSize: fileSize, verified: make([]bool, count)}, nil
+}
+
+// Range returns the offsets of the first and last byte of piece.
+func (v *pieceVerifier) Range(piece int) (uint64, uint64) {
+	start := uint64(piece) * v.pieces.Length
+	end := start + v.pieces.Length - 1
+	if end >= v.fileSize {
+		end = v.fileSize - 1
+	}
+	return start, end
+}
+
+// Verify hashes the pieces lying entirely within start-end that were not found good yet, reading
+// them from the chunks of c, and returns those that do not match.
+func (v *pieceVerifier) Verify(c *ChunkController, start uint64, end uint64) ([]int, error) {
+	var bad []int
+	for piece := int((start + v.pieces.Length - 1) / v.pieces.Length); piece < len(v.pieces.Hashes); piece++ {
+		pieceStart, pieceEnd := v.Range(piece)
+		if pieceEnd > end {
+			break
+		}
+		v.mu.Lock()
+		verified := v.verified[piece]
+		v.mu.Unlock()
+		if verified {
+			continue
+		}
+
+		h, _ := newHash(v.pieces.Algorithm)
+		if err := c.readRange(pieceStart, pieceEnd, h); err != nil {
+			return nil, err
+		}
+		if hex.EncodeToString(h.Sum(nil)) != v.pieces.Hashes[piece] {
+			bad = append(bad, piece)
+			continue
+		}
+		v.mu.Lock()
+		v.verified[piece] = true
+		v.mu.Unlock()
+	}
+	return bad, nil
+}
+
+// readRange copies the bytes start to end of the file from the chunks covering them to w.
+func (c *ChunkController) readRange(start uint64, end uint64, w io.Writer) error {
+	for _, chunk := range c.chunksInRange(start, end) {
+		chunkStart, chunkEnd := c.ChunkRange(chunk)
+		from, to := start, end
+		if from < chunkStart {
+			from = chunkStart
+		}
+		if to > chunkEnd {
+			to = chunkEnd
+		}
+		file, err := os.Open(chunk.chunkPath)
+		if err != nil {
+			return fmt.Errorf("cannot open file %s: %s", chunk.chunkPath, err)
+		}
+		_, err = io.Copy(w, io.NewSectionReader(file, int64(from-chunkStart), int64(to-from+1)))
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("cannot read file %s: %s", chunk.chunkPath, err)
+		}
+	}
+	return nil
+}
+
+// writeRange overwrites the file from offset start with data, in the completed chunks covering
+// it, and records the new hashes of those chunks.
+func (c *ChunkController) writeRange(start uint64, data []byte) error {
+	end := start + uint64(len(data)) - 1
+	for _, chunk := range c.chunksInRange(start, end) {
+		chunkStart, chunkEnd := c.ChunkRange(chunk)
+		from, to := start, end
+		if from < chunkStart {
+			from = chunkStart
+		}
+		if to > chunkEnd {
+			to = chunkEnd
+		}
+		file, err := os.OpenFile(chunk.chunkPath, os.O_WRONLY, 0644)
+		if err != nil {
+			return fmt.Errorf("cannot open file %s: %s", chunk.chunkPath, err)
+		}
+		_, err = file.WriteAt(data[from-start:to-start+1], int64(from-chunkStart))
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("cannot write file %s: %s", chunk.chunkPath, err)
+		}
+		// a resume compares the part with the hash recorded in the metadata
+		if err := c.CompleteChunk(chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chunksInRange returns the chunks overlapping the bytes start to end of the file.
+func (c *ChunkController) chunksInRange(start uint64, end uint64) []*Chunk {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var chunks []*Chunk
+	for _, chunk := range *c.chunks {
+		if chunk.startOffset <= end && chunk.endOffset >= start {
+			chunks = append(chunks, chunk)
+		}
+	}
+	return chunks
+}
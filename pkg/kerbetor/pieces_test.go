@@ -0,0 +1,88 @@
+package kerbetor
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestRepairCorruptPiece(t *testing.T) {
+	const pieceLength = 64 * 1024
+	const fileSize = 4*pieceLength + 1000
+	content := make([]byte, fileSize)
+	rand.New(rand.NewSource(3)).Read(content)
+	pieces := &PieceHashes{Algorithm: "sha256", Length: pieceLength}
+	for start := 0; start < fileSize; start += pieceLength {
+		end := start + pieceLength
+		if end > fileSize {
+			end = fileSize
+		}
+		digest := sha256.Sum256(content[start:end])
+		pieces.Hashes = append(pieces.Hashes, hex.EncodeToString(digest[:]))
+	}
+
+	// the server corrupts piece 2 in every response but those asking for that piece alone
+	corrupted := append([]byte{}, content...)
+	corrupted[2*pieceLength+10] ^= 0xff
+	pieceRange := fmt.Sprintf("bytes=%d-%d", 2*pieceLength, 3*pieceLength-1)
+	var repairs atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served := corrupted
+		if r.Header.Get("Range") == pieceRange {
+			repairs.Add(1)
+			served = content
+		}
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(served))
+	}))
+	defer server.Close()
+
+	logger := logrus.New()
+	logger.Out = io.Discard
+	output := filepath.Join(t.TempDir(), "file.bin")
+	_, err := NewDownloader(WithTorCircuits(0), WithWorkers(2), WithChunkSize(2*pieceLength), WithPieceHashes(pieces), WithLogger(logger)).
+		Download(context.Background(), server.URL+"/file.bin", output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	downloaded, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(downloaded, content) {
+		t.Error("downloaded file differs from the original")
+	}
+	if got := repairs.Load(); got != 1 {
+		t.Errorf("piece fetched again %d times, want once", got)
+	}
+}
+
+func TestPieceVerifierInvalidHashes(t *testing.T) {
+	digest := hex.EncodeToString(make([]byte, sha256.Size))
+	for _, test := range []struct {
+		name   string
+		pieces PieceHashes
+	}{
+		{"unsupported algorithm", PieceHashes{Algorithm: "tiger", Length: 10, Hashes: []string{digest, digest}}},
+		{"zero length", PieceHashes{Algorithm: "sha256", Hashes: []string{digest, digest}}},
+		{"missing piece", PieceHashes{Algorithm: "sha256", Length: 10, Hashes: []string{digest}}},
+		{"extra piece", PieceHashes{Algorithm: "sha256", Length: 10, Hashes: []string{digest, digest, digest}}},
+		{"short digest", PieceHashes{Algorithm: "sha256", Length: 10, Hashes: []string{digest, "abcd"}}},
+	} {
+		if _, err := newPieceVerifier(&test.pieces, 15); err == nil {
+			t.Errorf("%s: piece hashes accepted", test.name)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package kerbetor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	circuitCheckInterval    = 15 * time.Second
+	slowCircuitRatio        = 0.3
+	slowCircuitChecks       = 3
+	maxCircuitErrorsInARow  = 3
+	throughputSmoothing     = 0.3
+	minThroughputSampleTime = time.Second
+)
+
+// ErrNoCircuits is returned by CircuitPool.Acquire when the pool has no circuit.
+var ErrNoCircuits = errors.New("no tor circuit in the pool")
+
+// CircuitStats is a snapshot of the measurements of one circuit.
+type CircuitStats struct {
+	Name string `json:"name"`
+	// Throughput is a moving average in bytes per second, 0 until the first chunk completes.
+	Throughput float64 `json:"throughput"`
+	Bytes      uint64  `json:"bytes"`
+	Successes  int     `json:"successes"`
+	Errors     int     `json:"errors"`
+	Active     int     `json:"active"`
+	Renewals   int     `json:"renewals"`
+}
+
+type poolCircuit struct {
+	circuit *TorInstance
+	client  *http.Client
+	// proxy the client was built for, the client is rebuilt when the circuit's proxy changes
+	clientProxy string
+
+	active       int
+	throughput   float64
+	samples      int
+	bytes        uint64
+	successes    int
+	errors       int
+	errorsInARow int
+	slowChecks   int
+	renewals     int
+	renewing     bool
+}
+
+// CircuitPool hands TOR circuits to workers, favouring the fastest ones, and renews
+// circuits that are persistently slow or failing.
+// The pool owns its circuits and closes them in Close.
+type CircuitPool struct {
+	mu            sync.Mutex
+	circuits      []*poolCircuit
+	clientFactory HTTPClientFactory
+	logger        logrus.FieldLogger
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewCircuitPool(circuits []*TorInstance, clientFactory HTTPClientFactory, logger logrus.FieldLogger) *CircuitPool {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &CircuitPool{clientFactory: clientFactory, logger: logger, ctx: ctx, cancel: cancel}
+	for _, circuit := range circuits {
+		p.circuits = append(p.circuits, &poolCircuit{circuit: circuit})
+	}
+	p.wg.Add(1)
+	go p.monitor()
+	return p
+}
+
+// NewTorCircuitPool creates numTorCircuits circuits as configured by config and returns them in a
+// pool using the default HTTP clients. The pool can be shared by downloads with WithCircuitPool.
+func NewTorCircuitPool(ctx context.Context, numTorCircuits uint, config TorConfig, logger logrus.FieldLogger) (*CircuitPool, error) {
+	circuits, err := CreateTorCircuits(ctx, numTorCircuits, config, logger)
+	if err != nil {
+		return nil, err
+	}
+	return NewCircuitPool(circuits, defaultHTTPClientFactory, logger), nil
+}
+
+// Close stops the monitoring and closes every circuit.
+func (p *CircuitPool) Close() {
+	p.cancel()
+	p.wg.Wait()
+	p.mu.Lock()
+	for _, pc := range p.circuits {
+		pc.dropClientLocked()
+	}
+	p.mu.Unlock()
+	for _, pc := range p.circuits {
+		pc.circuit.Close()
+	}
+}
+
+// Len returns the number of circuits in the pool.
+func (p *CircuitPool) Len() int {
+	return len(p.circuits)
+}
+
+// Acquire returns the circuit a worker should use for its next chunk: the one with the best
+// throughput per active download. Circuits without measurements yet are assumed to be average,
+// circuits whose tor is down are skipped. Every successful Acquire must be followed by a Release.
+// It returns ErrNoCircuits when the pool is empty.
+func (p *CircuitPool) Acquire() (*TorInstance, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	median, _ := p.medianThroughputLocked()
+	if median == 0 {
+		median = 1
+	}
+	var best *poolCircuit
+	var bestScore float64
+	for _, pc := range p.circuits {
+		if pc.renewing || !pc.circuit.Alive() {
+			continue
+		}
+		throughput := pc.throughput
+		if pc.samples == 0 {
+			throughput = median
+		}
+		score := throughput / float64(pc.active+1)
+		if best == nil || score > bestScore {
+			best, bestScore = pc, score
+		}
+	}
+	if best == nil {
+		// every circuit is being renewed or restarted, use the least busy one anyway
+		for _, pc := range p.circuits {
+			if best == nil || pc.active < best.active {
+				best = pc
+			}
+		}
+	}
+	if best == nil {
+		return nil, ErrNoCircuits
+	}
+	best.active++
+	return best.circuit, nil
+}
+
+// Release records the outcome of a chunk downloaded on circuit.
+func (p *CircuitPool) Release(circuit *TorInstance, bytes uint64, elapsed time.Duration, err error) {
+	p.mu.Lock()
+	pc := p.findLocked(circuit)
+	if pc == nil {
+		p.mu.Unlock()
+		return
+	}
+	pc.active--
+	pc.bytes += bytes
+	if bytes > 0 && elapsed >= minThroughputSampleTime {
+		sample := float64(bytes) / elapsed.Seconds()
+		if pc.samples == 0 {
+			pc.throughput = sample
+		} else {
+			pc.throughput = throughputSmoothing*sample + (1-throughputSmoothing)*pc.throughput
+		}
+		pc.samples++
+	}
+	if err != nil {
+		pc.errors++
+		pc.errorsInARow++
+	} else {
+		pc.successes++
+		pc.errorsInARow = 0
+	}
+	renew := pc.errorsInARow >= maxCircuitErrorsInARow && !pc.renewing
+	if renew {
+		pc.renewing = true
+	}
+	p.mu.Unlock()
+
+	if renew {
+		p.logger.Warn("[TorInstance ", circuit.Name(), "] ", maxCircuitErrorsInARow, " errors in a row, renewing circuit")
+		p.startRenewal(pc)
+	}
+}
+
+// Available reports whether at least one circuit has its tor running.
+func (p *CircuitPool) Available() bool {
+	for _, pc := range p.circuits {
+		if pc.circuit.Alive() {
+			return true
+		}
+	}
+	return false
+}
+
+// Client returns the HTTP client bound to circuit.
+func (p *CircuitPool) Client(circuit *TorInstance) *http.Client {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pc := p.findLocked(circuit)
+	if pc == nil {
+		return p.clientFactory(circuit)
+	}
+	proxy := circuit.ProxyURL().String()
+	if pc.client == nil || pc.clientProxy != proxy {
+		pc.dropClientLocked()
+		pc.client, pc.clientProxy = p.clientFactory(circuit), proxy
+	}
+	return pc.client
+}
+
+// dropClientLocked closes the idle connections of the HTTP client of the circuit, which would
+// otherwise keep using the old tor circuit, and forgets the client.
+func (pc *poolCircuit) dropClientLocked() {
+	if pc.client != nil {
+		pc.client.CloseIdleConnections()
+		pc.client = nil
+	}
+}
+
+// Stats returns the measurements of every circuit.
+func (p *CircuitPool) Stats() []CircuitStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stats := make([]CircuitStats, 0, len(p.circuits))
+	for _, pc := range p.circuits {
+		stats = append(stats, CircuitStats{
+			Name:       pc.circuit.Name(),
+			Throughput: pc.throughput,
+			Bytes:      pc.bytes,
+			Successes:  pc.successes,
+			Errors:     pc.errors,
+			Active:     pc.active,
+			Renewals:   pc.renewals,
+		})
+	}
+	return stats
+}
+
+// monitor periodically compares the circuits and renews those that stay far below the
+// median throughput, until the pool is closed.
+func (p *CircuitPool) monitor() {
+	defer p.wg.Done()
+	ticker := time.NewTicker(circuitCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.checkSlowCircuits()
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
+
+func (p *CircuitPool) checkSlowCircuits() {
+	p.mu.Lock()
+	median, measured := p.medianThroughputLocked()
+	var slow []*poolCircuit
+	for _, pc := range p.circuits {
+		if measured < 2 || pc.samples == 0 || pc.renewing {
+			continue
+		}
+		if pc.throughput < median*slowCircuitRatio {
+			pc.slowChecks++
+		} else {
+			pc.slowChecks = 0
+		}
+		if pc.slowChecks >= slowCircuitChecks {
+			pc.renewing = true
+			slow = append(slow, pc)
+		}
+	}
+	p.mu.Unlock()
+
+	for _, pc := range slow {
+		p.logger.Info(fmt.Sprintf("[TorInstance %s] Circuit is slow (%s/s, median %s/s), renewing it", pc.circuit.Name(), humanize.Bytes(uint64(pc.throughput)), humanize.Bytes(uint64(median))))
+		p.startRenewal(pc)
+	}
+}
+
+func (p *CircuitPool) startRenewal(pc *poolCircuit) {
+	if p.ctx.Err() != nil {
+		// the pool is closing
+		return
+	}
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		p.renew(pc)
+	}()
+}
+
+func (p *CircuitPool) renew(pc *poolCircuit) {
+	err := pc.circuit.RenewCircuit(p.ctx, p.logger)
+	if err == nil {
+		if circuits, circuitsErr := pc.circuit.Circuits(); circuitsErr == nil {
+			for _, c := range circuits {
+				p.logger.Debug("[TorInstance ", pc.circuit.Name(), "] Circuit ", c.ID, " ", c.Status, " ", strings.Join(c.Path, ","))
+			}
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pc.renewing = false
+	if err != nil {
+		p.logger.Warn("[TorInstance ", pc.circuit.Name(), "] Cannot renew circuit: ", err)
+		return
+	}
+	pc.renewals++
+	pc.dropClientLocked()
+	pc.throughput = 0
+	pc.samples = 0
+	pc.errorsInARow = 0
+	pc.slowChecks = 0
+}
+
+// medianThroughputLocked returns the median throughput of the circuits with measurements
+// and how many circuits were measured.
+func (p *CircuitPool) medianThroughputLocked() (float64, int) {
+	var values []float64
+	for _, pc := range p.circuits {
+		if pc.samples > 0 {
+			values = append(values, pc.throughput)
+		}
+	}
+	if len(values) == 0 {
+		return 0, 0
+	}
+	sort.Float64s(values)
+	mid := len(values) / 2
+	if len(values)%2 == 0 {
+		return (values[mid-1] + values[mid]) / 2, len(values)
+	}
+	return values[mid], len(values)
+}
+
+func (p *CircuitPool) findLocked(circuit *TorInstance) *poolCircuit {
+	for _, pc := range p.circuits {
+		if pc.circuit == circuit {
+			return pc
+		}
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+
+package kerbetor
+
+import (
+	"errors"
+	"syscall"
+)
+
+// processAlive reports whether a process with the given PID exists.
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	// EPERM: the process exists but belongs to another user
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
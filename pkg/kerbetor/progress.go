@@ -1,10 +1,138 @@
 package kerbetor
 
 import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
 	"github.com/vbauerster/mpb/v8"
 	"github.com/vbauerster/mpb/v8/decor"
 )
 
+// ProgressSink receives progress notifications while a Downloader runs.
+// Methods may be called concurrently from several workers.
+type ProgressSink interface {
+	DownloadStarted(remoteUrl string, totalSize uint64)
+	DownloadProgress(downloaded uint64)
+	ChunkStarted(workerIndex uint, chunkIndex int, chunkSize uint64, downloaded uint64)
+	ChunkProgress(workerIndex uint, chunkIndex int, downloaded uint64)
+	ChunkFinished(workerIndex uint, chunkIndex int, err error)
+	DownloadFinished(err error)
+}
+
+// NopProgress discards every progress notification.
+type NopProgress struct{}
+
+func (NopProgress) DownloadStarted(string, uint64)         {}
+func (NopProgress) DownloadProgress(uint64)                {}
+func (NopProgress) ChunkStarted(uint, int, uint64, uint64) {}
+func (NopProgress) ChunkProgress(uint, int, uint64)        {}
+func (NopProgress) ChunkFinished(uint, int, error)         {}
+func (NopProgress) DownloadFinished(error)                 {}
+
+// BarProgress draws mpb progress bars: one for the whole file and one per busy worker.
+type BarProgress struct {
+	p       *mpb.Progress
+	ownsP   bool
+	mu      sync.Mutex
+	mainBar *mpb.Bar
+	bars    map[uint]*mpb.Bar
+	// name labels the file bar; when set, only the file bar is drawn
+	name string
+}
+
+// NewProgressContainer returns the mpb container progress bars are drawn on.
+func NewProgressContainer() *mpb.Progress {
+	return mpb.New(mpb.WithWidth(64), mpb.WithRefreshRate(180*time.Millisecond))
+}
+
+// NewBarProgress returns a ProgressSink drawing on p. If p is nil a new mpb container is created
+// and waited for when the download finishes.
+func NewBarProgress(p *mpb.Progress) *BarProgress {
+	ownsP := false
+	if p == nil {
+		p = NewProgressContainer()
+		ownsP = true
+	}
+	return &BarProgress{p: p, ownsP: ownsP, bars: make(map[uint]*mpb.Bar)}
+}
+
+// NewFileBarProgress returns a ProgressSink drawing a single bar labelled name on p, so that the
+// downloads of several files can share the container. p must be waited for by the caller.
+func NewFileBarProgress(p *mpb.Progress, name string) *BarProgress {
+	return &BarProgress{p: p, bars: make(map[uint]*mpb.Bar), name: name}
+}
+
+func (b *BarProgress) DownloadStarted(remoteUrl string, totalSize uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.mainBar != nil {
+		// the download started over
+		b.mainBar.Abort(true)
+	}
+	if b.name != "" {
+		b.mainBar = NewProgressBar(b.p, b.name, totalSize, 0)
+		return
+	}
+	b.mainBar = NewProgressBar(b.p, "#### Total ...", totalSize, math.MaxInt)
+}
+
+func (b *BarProgress) DownloadProgress(downloaded uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.mainBar != nil {
+		b.mainBar.SetCurrent(int64(downloaded))
+	}
+}
+
+func (b *BarProgress) ChunkStarted(workerIndex uint, chunkIndex int, chunkSize uint64, downloaded uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.name != "" {
+		return
+	}
+	bar := NewProgressBar(b.p, fmt.Sprintf("[W%d] Chunk #%d ...", workerIndex, chunkIndex), chunkSize, int(workerIndex))
+	if downloaded > 0 {
+		bar.SetCurrent(int64(downloaded))
+	}
+	b.bars[workerIndex] = bar
+}
+
+func (b *BarProgress) ChunkProgress(workerIndex uint, chunkIndex int, downloaded uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if bar, ok := b.bars[workerIndex]; ok {
+		bar.SetCurrent(int64(downloaded))
+	}
+}
+
+func (b *BarProgress) ChunkFinished(workerIndex uint, chunkIndex int, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if bar, ok := b.bars[workerIndex]; ok {
+		bar.Abort(true)
+		delete(b.bars, workerIndex)
+	}
+}
+
+func (b *BarProgress) DownloadFinished(err error) {
+	b.mu.Lock()
+	for workerIndex, bar := range b.bars {
+		bar.Abort(true)
+		delete(b.bars, workerIndex)
+	}
+	if b.mainBar != nil {
+		b.mainBar.Abort(true)
+		b.mainBar = nil
+	}
+	b.mu.Unlock()
+
+	if b.ownsP {
+		b.p.Wait()
+	}
+}
+
 func NewProgressBar(p *mpb.Progress, barName string, totalSize uint64, priority int) *mpb.Bar {
 	return p.AddBar(
 		int64(totalSize),
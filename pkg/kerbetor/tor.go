@@ -2,21 +2,108 @@ package kerbetor
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	// TorBootstrapPollInterval is how often the bootstrap progress of a starting tor is queried.
+	TorBootstrapPollInterval = 500 * time.Millisecond
+	// DefaultTorBootstrapTimeout is how long tor may take to bootstrap before giving up.
+	DefaultTorBootstrapTimeout = 3 * time.Minute
+	// TorDataDirPrefix starts the name of the temporary data directories of the tor processes.
+	TorDataDirPrefix = "ktor-tor-data"
+	// number of tor warning/error lines kept to explain failures
+	torLogTailSize = 5
+	// how long tor may take to exit after SIGTERM before it is killed
+	torStopGracePeriod = 5 * time.Second
+	// how long to wait for a killed tor to exit before removing its data directory
+	torExitTimeout = 5 * time.Second
+)
+
+const (
+	// TorModeProcess starts one tor process per circuit.
+	TorModeProcess = "process"
+	// TorModeShared starts a single tor process with one isolated SOCKS port per circuit,
+	// so that bootstrap is paid once regardless of the number of circuits.
+	TorModeShared = "shared"
+)
+
+// TorConfig configures how kerbetor reaches TOR.
+type TorConfig struct {
+	// BootstrapTimeout bounds the time tor may take to bootstrap. 0 means no limit.
+	BootstrapTimeout time.Duration
+	// Mode is how tor processes are started: TorModeProcess (the default) or TorModeShared.
+	Mode string
+	// CacheDir keeps the tor directory information between runs to speed up the bootstrap,
+	// see DefaultTorCacheDir. Empty disables the cache.
+	CacheDir string
+
+	// SOCKSAddrs are the SOCKS endpoints (host:port) of an already running tor. When set,
+	// no tor process is started and circuits are spread over these endpoints.
+	SOCKSAddrs []string
+	// ControlAddr is the control port (host:port) of the already running tor, optional.
+	ControlAddr string
+	// ControlPassword is used when the control port requires password authentication.
+	ControlPassword string
+}
+
+// TorInstance is a TOR circuit used by the workers: an isolated stream group on a SOCKS
+// endpoint, either of a tor process started by kerbetor or of an external tor daemon.
 type TorInstance struct {
-	cmd  *exec.Cmd
-	port int
+	mu sync.Mutex
+	// socksAuth isolates the streams of this instance on a tor shared with other instances
+	// (IsolateSOCKSAuth). nil when the instance has its own tor process.
+	socksAuth *url.Userinfo
+	config    TorConfig
+
+	// tor is the tor started by kerbetor, possibly shared with other instances, and portIndex
+	// the SOCKS port of this instance. nil for an external tor that must be left running.
+	tor       *managedTor
+	portIndex int
+
+	// endpoint of an external tor
+	name      string
+	socksAddr string
+	control   *ControlConn
+}
+
+// torProcess is a tor daemon started by kerbetor.
+// runningTors are the tor processes started and not stopped yet, see KillTorProcesses.
+var (
+	runningTorsMu sync.Mutex
+	runningTors   = make(map[*torProcess]struct{})
+)
+
+type torProcess struct {
+	cmd         *exec.Cmd
+	socksPorts  []int
+	controlPort int
+	control     *ControlConn
+	dataDir     string
+	dataDirLock *DirLock
+
+	// exited is closed when the process terminates, exitErr is then the result of Wait.
+	exited  chan struct{}
+	exitErr error
+
+	mu sync.Mutex
+	// last warning and error lines logged by tor
+	logTail []string
 }
 
 // look for a free port to listen on
@@ -30,7 +117,14 @@ func GetFreePort() (int, error) {
 	return l.Addr().(*net.TCPAddr).Port, nil
 }
 
-func CreateTorCircuits(numTorCircuits uint) ([]*TorInstance, error) {
+func CreateTorCircuits(ctx context.Context, numTorCircuits uint, config TorConfig, logger logrus.FieldLogger) ([]*TorInstance, error) {
+	if len(config.SOCKSAddrs) > 0 {
+		return ConnectExternalTor(ctx, numTorCircuits, config, logger)
+	}
+	if config.Mode == TorModeShared {
+		return CreateSharedTorCircuits(ctx, numTorCircuits, config, logger)
+	}
+
 	outTorInstances := make(chan *TorInstance, numTorCircuits)
 	outErrors := make(chan error, numTorCircuits)
 
@@ -41,9 +135,10 @@ func CreateTorCircuits(numTorCircuits uint) ([]*TorInstance, error) {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			c, e := CreateTorCircuit()
+			c, e := CreateTorCircuit(ctx, config, logger)
 			if e != nil {
 				outErrors <- e
+				return
 			}
 
 			outTorInstances <- c
@@ -72,80 +167,408 @@ func CreateTorCircuits(numTorCircuits uint) ([]*TorInstance, error) {
 			c.Close()
 		}
 
-		return nil, fmt.Errorf("failed to create Tor circuit(s): %v", strings.Join(errMsgs, ", "))
+		return nil, fmt.Errorf("failed to create Tor circuit(s): %v", strings.Join(errMsgs, "; "))
 	}
 
 	return torCircuits, nil
 }
 
-func CreateTorCircuit() (*TorInstance, error) {
+// CreateTorCircuit starts a tor process and waits until it has bootstrapped. On failure the
+// process is stopped and the returned error includes the last warnings logged by tor.
+// The process is supervised and restarted if it crashes.
+func CreateTorCircuit(ctx context.Context, config TorConfig, logger logrus.FieldLogger) (*TorInstance, error) {
+	tor, err := startManagedTor(ctx, config, 1, logger)
+	if err != nil {
+		return nil, err
+	}
+	return &TorInstance{config: config, tor: tor}, nil
+}
+
+// CreateSharedTorCircuits starts a single tor process with one SOCKS port per circuit. Streams on
+// different SOCKS ports never share a circuit; every instance also uses its own SOCKS credentials
+// so that it can switch circuits without affecting the others.
+func CreateSharedTorCircuits(ctx context.Context, numTorCircuits uint, config TorConfig, logger logrus.FieldLogger) ([]*TorInstance, error) {
+	if numTorCircuits == 0 {
+		return nil, nil
+	}
+	tor, err := startManagedTor(ctx, config, int(numTorCircuits), logger)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Tor circuit(s): %s", err)
+	}
+	tor.refs = int(numTorCircuits)
+
+	instances := make([]*TorInstance, 0, numTorCircuits)
+	for i := 0; i < int(numTorCircuits); i++ {
+		instances = append(instances, &TorInstance{config: config, socksAuth: newSOCKSAuth(), tor: tor, portIndex: i})
+	}
+	return instances, nil
+}
+
+func startTorProcess(ctx context.Context, config TorConfig, numSOCKSPorts int, logger logrus.FieldLogger) (*torProcess, error) {
 	// check if tor executable is available in PATH
 	_, err := exec.LookPath("tor")
 	if err != nil {
 		return nil, fmt.Errorf("tor executable not found in PATH")
 	}
 
-	// look for a free port to listen on
-	listenPort, err := GetFreePort()
+	// look for free ports for the SOCKS proxies and the control port
+	socksPorts := make([]int, numSOCKSPorts)
+	for i := range socksPorts {
+		socksPorts[i], err = GetFreePort()
+		if err != nil {
+			return nil, fmt.Errorf("cannot find free port to listen on: %s", err)
+		}
+	}
+	listenPort := socksPorts[0]
+	controlPort, err := GetFreePort()
 	if err != nil {
 		return nil, fmt.Errorf("cannot find free port to listen on: %s", err)
 	}
 
 	// generate temp directory for tor data
-	torDataDir, err := ioutil.TempDir("", "ktor-tor-data")
+	torDataDir, err := ioutil.TempDir("", TorDataDirPrefix)
 	if err != nil {
 		return nil, fmt.Errorf("cannot create temporary directory for tor data: %s", err)
 	}
-	// start tor with SOCKS proxy on localhost:listenPort
-	torCmd := exec.Command("tor", "--SOCKSPort", fmt.Sprintf("localhost:%d", listenPort), "--DataDirectory", torDataDir)
+	dataDirLock, err := LockDir(ctx, torDataDir, false, logger)
+	if err != nil {
+		os.RemoveAll(torDataDir)
+		return nil, err
+	}
+	if config.CacheDir != "" {
+		seeded, err := seedTorDataDir(config.CacheDir, torDataDir)
+		if err != nil {
+			logger.Warn(err)
+		} else if seeded > 0 {
+			logger.Debug("[TorInstance ", listenPort, "] Seeded tor data dir with ", seeded, " cached file(s) from ", config.CacheDir)
+		}
+	}
+	// start tor with SOCKS proxies on localhost:socksPorts and a cookie authenticated control port.
+	// The first --SOCKSPort replaces the default port, the others are added with "+".
+	var torArgs []string
+	for i, port := range socksPorts {
+		option := "--SOCKSPort"
+		if i > 0 {
+			option = "+SOCKSPort"
+		}
+		torArgs = append(torArgs, option, fmt.Sprintf("localhost:%d", port))
+	}
+	torArgs = append(torArgs,
+		"--ControlPort", fmt.Sprintf("localhost:%d", controlPort),
+		"--CookieAuthentication", "1",
+		"--DataDirectory", torDataDir)
+	torCmd := exec.Command("tor", torArgs...)
+	torCmd.SysProcAttr = torSysProcAttr()
 	torOut, err := torCmd.StdoutPipe()
 	if err != nil {
+		dataDirLock.Unlock()
+		os.RemoveAll(torDataDir)
 		return nil, fmt.Errorf("Cannot create pipe to tor stdout. %s", err)
 	}
 
-	torCmd.Start()
+	if err := torCmd.Start(); err != nil {
+		dataDirLock.Unlock()
+		os.RemoveAll(torDataDir)
+		return nil, fmt.Errorf("cannot start tor: %s", err)
+	}
+	process := &torProcess{cmd: torCmd, socksPorts: socksPorts, controlPort: controlPort, dataDir: torDataDir, dataDirLock: dataDirLock, exited: make(chan struct{})}
+	runningTorsMu.Lock()
+	runningTors[process] = struct{}{}
+	runningTorsMu.Unlock()
 
-	scanner := bufio.NewScanner(torOut)
-	for scanner.Scan() {
-		lastScannedLine := scanner.Text()
-		logrus.Debug(fmt.Sprintf("[TorInstance %d] %s", listenPort, lastScannedLine))
+	// log tor output as debug messages, keeping the last warnings to explain failures
+	go func() {
+		scanner := bufio.NewScanner(torOut)
+		for scanner.Scan() {
+			line := scanner.Text()
+			logger.Debug(fmt.Sprintf("[TorInstance %d] %s", listenPort, line))
+			if strings.Contains(line, "[warn]") || strings.Contains(line, "[err]") {
+				process.recordWarning(line)
+			}
+		}
+		process.exitErr = torCmd.Wait()
+		close(process.exited)
+	}()
 
-		// check if last scanned line contains "Bootstrapped 100%"
-		if strings.Contains(lastScannedLine, "Bootstrapped 100%") {
-			logrus.Debug("[TorInstance ", listenPort, "] Tor circuit bootstrap completed. Listening on port ", listenPort)
+	bootstrapCtx := ctx
+	if config.BootstrapTimeout > 0 {
+		var cancel context.CancelFunc
+		bootstrapCtx, cancel = context.WithTimeout(ctx, config.BootstrapTimeout)
+		defer cancel()
+	}
+	if err := process.waitForBootstrap(bootstrapCtx, config, logger); err != nil {
+		process.stop()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, process.withLogTail(err)
+	}
+	logger.Debug("[TorInstance ", listenPort, "] Tor circuit bootstrap completed. Listening on port(s) ", socksPorts)
+
+	if config.CacheDir != "" {
+		if err := saveTorCache(torDataDir, config.CacheDir); err != nil {
+			logger.Warn(err)
+		}
+	}
+
+	return process, nil
+}
+
+// waitForBootstrap connects to the control port as soon as tor opens it, then waits until tor
+// reports a completed bootstrap.
+func (p *torProcess) waitForBootstrap(ctx context.Context, config TorConfig, logger logrus.FieldLogger) error {
+	ticker := time.NewTicker(TorBootstrapPollInterval)
+	defer ticker.Stop()
+
+	controlAddr := fmt.Sprintf("localhost:%d", p.controlPort)
+	for p.control == nil {
+		control, err := DialControl(ctx, controlAddr)
+		if err == nil {
+			if err = control.AuthenticateCookie(filepath.Join(p.dataDir, "control_auth_cookie")); err != nil {
+				control.Close()
+				return err
+			}
+			p.control = control
 			break
 		}
+
+		select {
+		case <-ticker.C:
+		case <-p.exited:
+			return fmt.Errorf("tor exited during bootstrap: %v", p.exitErr)
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return fmt.Errorf("tor did not open its control port within %s", config.BootstrapTimeout)
+			}
+			return ctx.Err()
+		}
 	}
 
-	// continue to log tor output as debug messages
-	go func() {
-		for scanner.Scan() {
-			logrus.Debug(fmt.Sprintf("[TorInstance %d] %s", listenPort, scanner.Text()))
+	err := waitForTorBootstrap(ctx, p.control, fmt.Sprint(p.socksPorts[0]), config, p.exited, p.recordWarning, logger)
+	if err != nil && p.hasExited() {
+		return fmt.Errorf("tor exited during bootstrap: %v", p.exitErr)
+	}
+	return err
+}
+
+func (p *torProcess) hasExited() bool {
+	select {
+	case <-p.exited:
+		return true
+	default:
+		return false
+	}
+}
+
+// waitForTorBootstrap polls the bootstrap progress of tor until it completes. exited may be
+// nil when the tor process is not ours.
+func waitForTorBootstrap(ctx context.Context, control *ControlConn, name string, config TorConfig, exited <-chan struct{}, recordWarning func(string), logger logrus.FieldLogger) error {
+	ticker := time.NewTicker(TorBootstrapPollInterval)
+	defer ticker.Stop()
+
+	lastProgress := -1
+	for {
+		phase, err := control.BootstrapPhase()
+		if err != nil {
+			return fmt.Errorf("cannot get tor bootstrap status: %s", err)
 		}
+		if phase.Warning != "" {
+			recordWarning(fmt.Sprintf("bootstrap %s: %s", phase.Severity, phase.Warning))
+		}
+		if phase.Progress != lastProgress {
+			logger.Debug(fmt.Sprintf("[TorInstance %s] Bootstrapped %d%% (%s): %s", name, phase.Progress, phase.Tag, phase.Summary))
+			lastProgress = phase.Progress
+		}
+		if phase.Progress == 100 {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-exited:
+			return errors.New("tor exited during bootstrap")
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return fmt.Errorf("tor did not bootstrap within %s (stuck at %d%%)", config.BootstrapTimeout, lastProgress)
+			}
+			return ctx.Err()
+		}
+	}
+}
+
+func (p *torProcess) recordWarning(line string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.logTail) > 0 && p.logTail[len(p.logTail)-1] == line {
+		return
+	}
+	p.logTail = append(p.logTail, line)
+	if len(p.logTail) > torLogTailSize {
+		p.logTail = p.logTail[1:]
+	}
+}
+
+// withLogTail adds the last warnings logged by tor to err.
+func (p *torProcess) withLogTail(err error) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.logTail) == 0 {
+		return err
+	}
+	return fmt.Errorf("%s. Last tor messages: %s", err, strings.Join(p.logTail, " | "))
+}
+
+// stop asks tor to exit with SIGTERM, kills it if it is still running after a grace period,
+// then removes its data directory. The process is reaped by the goroutine reading its output.
+func (p *torProcess) stop() {
+	defer func() {
+		runningTorsMu.Lock()
+		delete(runningTors, p)
+		runningTorsMu.Unlock()
 	}()
+	if p.control != nil {
+		p.control.Close()
+	}
+	if p.hasExited() {
+		p.dataDirLock.Unlock()
+		os.RemoveAll(p.dataDir)
+		return
+	}
+
+	if err := p.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		// signals other than kill are not supported on windows
+		p.cmd.Process.Kill()
+	}
+	select {
+	case <-p.exited:
+	case <-time.After(torStopGracePeriod):
+		p.cmd.Process.Kill()
+		select {
+		case <-p.exited:
+		case <-time.After(torExitTimeout):
+		}
+	}
+	p.dataDirLock.Unlock()
+	os.RemoveAll(p.dataDir)
+}
 
-	torInstance := &TorInstance{cmd: torCmd, port: listenPort}
-	return torInstance, nil
+// KillTorProcesses kills every tor started by kerbetor that is still running and removes its data
+// directory, without the graceful shutdown of stop. It is meant for a forced exit: tor runs in its
+// own process group and would not get the terminal's signal.
+func KillTorProcesses() {
+	runningTorsMu.Lock()
+	defer runningTorsMu.Unlock()
+	for p := range runningTors {
+		p.cmd.Process.Kill()
+	}
+	for p := range runningTors {
+		select {
+		case <-p.exited:
+		case <-time.After(torExitTimeout):
+		}
+		os.RemoveAll(p.dataDir)
+	}
 }
 
+// Close stops the tor process of the instance once no other instance shares it.
+// An external tor is left running.
 func (t *TorInstance) Close() {
-	t.cmd.Process.Kill()
+	if t.tor != nil {
+		t.tor.release()
+	} else if t.control != nil {
+		t.control.Close()
+	}
+}
+
+// Name identifies the instance in logs.
+func (t *TorInstance) Name() string {
+	if t.tor != nil {
+		return fmt.Sprint(t.tor.socksPort(t.portIndex))
+	}
+	return t.name
+}
+
+// Alive reports whether the tor behind the instance is running. It is false while a crashed
+// tor is being restarted.
+func (t *TorInstance) Alive() bool {
+	return t.tor == nil || t.tor.alive()
+}
+
+func (t *TorInstance) controlConn() *ControlConn {
+	if t.tor != nil {
+		return t.tor.control()
+	}
+	return t.control
+}
+
+// ProxyURL returns the SOCKS proxy of the instance, including its isolation credentials.
+// It changes when the instance switches circuits or tor is restarted.
+func (t *TorInstance) ProxyURL() *url.URL {
+	socksAddr := t.socksAddr
+	if t.tor != nil {
+		socksAddr = fmt.Sprintf("localhost:%d", t.tor.socksPort(t.portIndex))
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return &url.URL{Scheme: "socks5", Host: socksAddr, User: t.socksAuth}
+}
+
+// RenewCircuit gives the instance a fresh TOR circuit. Instances isolated by SOCKS credentials
+// switch to new credentials. Otherwise tor is asked for a new identity through the control port,
+// falling back to restarting tor when that fails and the process is ours.
+// Downloads in flight on a replaced process fail and are retried by the caller.
+func (t *TorInstance) RenewCircuit(ctx context.Context, logger logrus.FieldLogger) error {
+	t.mu.Lock()
+	if t.socksAuth != nil {
+		t.socksAuth = newSOCKSAuth()
+		t.mu.Unlock()
+		logger.Debug("[TorInstance ", t.Name(), "] Switched to new SOCKS credentials")
+		return nil
+	}
+	t.mu.Unlock()
+
+	if control := t.controlConn(); control != nil {
+		err := control.NewNym()
+		if err == nil {
+			logger.Debug("[TorInstance ", t.Name(), "] Switched to new circuits")
+			return nil
+		}
+		if t.tor == nil {
+			return err
+		}
+		logger.Debug("[TorInstance ", t.Name(), "] Cannot switch circuits through the control port, restarting tor: ", err)
+	}
+	if t.tor == nil {
+		return fmt.Errorf("cannot renew circuit of external tor %s without a control port", t.Name())
+	}
+	if !t.tor.alive() {
+		return fmt.Errorf("tor %s is down", t.Name())
+	}
+	return t.tor.restart(ctx)
+}
+
+// Circuits returns the circuits tor has currently open.
+func (t *TorInstance) Circuits() ([]CircuitInfo, error) {
+	control := t.controlConn()
+	if control == nil {
+		return nil, fmt.Errorf("tor instance %s has no control connection", t.Name())
+	}
+	return control.CircuitStatus()
 }
 
 func (t *TorInstance) GetTorHttpClient() *http.Client {
-	proxyUrl, _ := url.Parse(fmt.Sprintf("socks5://localhost:%d", t.port))
-	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyUrl)}}
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(t.ProxyURL())}}
 	return client
 }
 
-func (t *TorInstance) TorGetRemoteFileSize(sourceUrl string) (uint64, error) {
-	return GetRemoteFileSize(sourceUrl, t.GetTorHttpClient())
+func (t *TorInstance) TorGetRemoteFileSize(ctx context.Context, sourceUrl string) (uint64, error) {
+	return GetRemoteFileSize(ctx, sourceUrl, t.GetTorHttpClient())
 }
 
-func (t *TorInstance) TorDownloadFileChunk(sourceUrl string, destinationPath string, startOffset int64, endOffset int64) (int64, error) {
-	return DownloadFileChunk(sourceUrl, destinationPath, startOffset, endOffset, t.GetTorHttpClient())
+func (t *TorInstance) TorDownloadFileChunk(ctx context.Context, sourceUrl string, destinationPath string, startOffset int64, endOffset int64) (int64, error) {
+	return DownloadFileChunk(ctx, sourceUrl, destinationPath, startOffset, endOffset, t.GetTorHttpClient())
 }
 
-func (t *TorInstance) TorDownloadFileChunkAsync(sourceUrl string, destinationPath string, startOffset uint64, endOffset uint64) (chan uint64, chan error) {
-	return DownloadFileChunkAsync(sourceUrl, destinationPath, startOffset, endOffset, t.GetTorHttpClient())
+func (t *TorInstance) TorDownloadFileChunkAsync(ctx context.Context, chunkReq ChunkRequest) (chan uint64, chan error) {
+	return DownloadFileChunkAsync(ctx, chunkReq, t.GetTorHttpClient())
 }
@@ -0,0 +1,11 @@
+//go:build windows
+
+package kerbetor
+
+import "syscall"
+
+// torSysProcAttr starts tor in its own process group, so that a Ctrl-C in the console reaches
+// kerbetor only and kerbetor decides when tor stops.
+func torSysProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
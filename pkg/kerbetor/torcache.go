@@ -0,0 +1,87 @@
+package kerbetor
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// torCacheFiles are the files of a tor data directory shared through the cache. They hold public
+// directory information that lets tor skip most of the bootstrap; keys and state stay private
+// to each instance.
+var torCacheFiles = []string{
+	"cached-certs",
+	"cached-consensus",
+	"cached-microdesc-consensus",
+	"cached-microdescs",
+	"cached-microdescs.new",
+}
+
+// DefaultTorCacheDir returns the per-user directory caching tor directory information,
+// $XDG_CACHE_HOME/kerbetor/tor on Linux.
+func DefaultTorCacheDir() (string, error) {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cacheDir, "kerbetor", "tor"), nil
+}
+
+// seedTorDataDir copies the cached directory information into a new tor data directory.
+func seedTorDataDir(cacheDir string, dataDir string) (int, error) {
+	seeded := 0
+	for _, name := range torCacheFiles {
+		err := copyFileAtomic(filepath.Join(cacheDir, name), filepath.Join(dataDir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return seeded, fmt.Errorf("cannot seed tor data dir from cache: %s", err)
+		}
+		seeded++
+	}
+	return seeded, nil
+}
+
+// saveTorCache stores the directory information of a bootstrapped tor in the cache.
+// Files are replaced atomically, so concurrent tor processes can share the cache.
+func saveTorCache(dataDir string, cacheDir string) error {
+	if err := os.MkdirAll(cacheDir, 0700); err != nil {
+		return fmt.Errorf("cannot create tor cache dir: %s", err)
+	}
+	for _, name := range torCacheFiles {
+		err := copyFileAtomic(filepath.Join(dataDir, name), filepath.Join(cacheDir, name))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("cannot update tor cache: %s", err)
+		}
+	}
+	return nil
+}
+
+func copyFileAtomic(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), filepath.Base(dst)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package kerbetor
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// maxTorRestarts is how many times in a row kerbetor tries to restart a crashed tor.
+	maxTorRestarts  = 3
+	torRestartDelay = 2 * time.Second
+)
+
+// managedTor supervises a tor started by kerbetor: tor is restarted when it crashes and stopped
+// gracefully once the last instance using it is closed.
+type managedTor struct {
+	config        TorConfig
+	numSOCKSPorts int
+	logger        logrus.FieldLogger
+
+	mu sync.Mutex
+	// process is nil while a crashed tor is being restarted, or after giving up.
+	process    *torProcess
+	socksPorts []int
+	refs       int
+	// stopped is set by stop, a tor started afterwards by restart must not be kept
+	stopped bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+func startManagedTor(ctx context.Context, config TorConfig, numSOCKSPorts int, logger logrus.FieldLogger) (*managedTor, error) {
+	process, err := startTorProcess(ctx, config, numSOCKSPorts, logger)
+	if err != nil {
+		return nil, err
+	}
+	m := &managedTor{
+		config:        config,
+		numSOCKSPorts: numSOCKSPorts,
+		logger:        logger,
+		process:       process,
+		socksPorts:    process.socksPorts,
+		refs:          1,
+		done:          make(chan struct{}),
+	}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	go m.supervise()
+	return m, nil
+}
+
+// supervise restarts tor when it exits on its own, until the managedTor is stopped.
+func (m *managedTor) supervise() {
+	defer close(m.done)
+	for {
+		m.mu.Lock()
+		process := m.process
+		m.mu.Unlock()
+		if process == nil {
+			return
+		}
+
+		select {
+		case <-process.exited:
+		case <-m.ctx.Done():
+			return
+		}
+
+		m.mu.Lock()
+		crashed := m.process == process
+		if crashed {
+			m.process = nil
+		}
+		m.mu.Unlock()
+		if !crashed {
+			// replaced by restart
+			continue
+		}
+
+		m.logger.Warn(process.withLogTail(fmt.Errorf("[TorInstance %d] tor exited unexpectedly: %v", process.socksPorts[0], process.exitErr)))
+		process.stop()
+		if !m.relaunch() {
+			return
+		}
+	}
+}
+
+// relaunch starts a new tor after a crash, retrying a few times.
+func (m *managedTor) relaunch() bool {
+	for attempt := 1; attempt <= maxTorRestarts; attempt++ {
+		process, err := startTorProcess(m.ctx, m.config, m.numSOCKSPorts, m.logger)
+		if err == nil {
+			m.mu.Lock()
+			m.process, m.socksPorts = process, process.socksPorts
+			m.mu.Unlock()
+			m.logger.Info("[TorInstance ", process.socksPorts[0], "] Restarted crashed tor")
+			return true
+		}
+		if m.ctx.Err() != nil {
+			return false
+		}
+		m.logger.Warn("Cannot restart tor (attempt ", attempt, "/", maxTorRestarts, "): ", err)
+
+		select {
+		case <-time.After(torRestartDelay * time.Duration(attempt)):
+		case <-m.ctx.Done():
+			return false
+		}
+	}
+	m.logger.Error("Giving up restarting tor after ", maxTorRestarts, " attempts")
+	return false
+}
+
+// restart replaces the running tor with a new process.
+func (m *managedTor) restart(ctx context.Context) error {
+	renewed, err := startTorProcess(ctx, m.config, m.numSOCKSPorts, m.logger)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	if m.stopped {
+		// stop ran while the new tor was starting, nobody would ever stop it
+		m.mu.Unlock()
+		renewed.stop()
+		return fmt.Errorf("tor was stopped while restarting")
+	}
+	old := m.process
+	m.process, m.socksPorts = renewed, renewed.socksPorts
+	m.mu.Unlock()
+
+	if old != nil {
+		m.logger.Debug("[TorInstance ", old.socksPorts[0], "] Replaced by tor process listening on port ", renewed.socksPorts[0])
+		old.stop()
+	}
+	return nil
+}
+
+// alive reports whether tor is running.
+func (m *managedTor) alive() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.process != nil
+}
+
+func (m *managedTor) socksPort(index int) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.socksPorts[index]
+}
+
+func (m *managedTor) control() *ControlConn {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.process == nil {
+		return nil
+	}
+	return m.process.control
+}
+
+// release stops tor once no instance uses it anymore.
+func (m *managedTor) release() {
+	m.mu.Lock()
+	m.refs--
+	last := m.refs <= 0
+	m.mu.Unlock()
+	if last {
+		m.stop()
+	}
+}
+
+func (m *managedTor) stop() {
+	m.cancel()
+	<-m.done
+
+	m.mu.Lock()
+	m.stopped = true
+	process := m.process
+	m.process = nil
+	m.mu.Unlock()
+	if process != nil {
+		process.stop()
+	}
+}
@@ -1,7 +1,10 @@
 package kerbetor
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
+	"io"
 	"os"
 )
 
@@ -23,3 +26,18 @@ func GetFileSize(filePath string) (uint64, error) {
 	}
 	return uint64(info.Size()), nil
 }
+
+// HashFile returns the hex SHA-256 digest of filePath.
+func HashFile(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,5 @@
+package kerbetor
+
+// Version is the kerbetor release, overridden at build time with
+// -ldflags "-X github.com/asabellico/kerbetor/pkg/kerbetor.Version=...".
+var Version = "dev"
@@ -0,0 +1,208 @@
+package kerbetor
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// dialTestWebsocket performs the websocket handshake with the aria2 RPC server.
+func dialTestWebsocket(t *testing.T, rpc *httptest.Server) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", rpc.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	key := "dGhlIHNhbXBsZSBub25jZQ=="
+	conn.Write([]byte("GET " + Aria2RPCPath + " HTTP/1.1\r\nHost: kerbetor\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(sum[:]) {
+		t.Fatalf("bad handshake response: %d %v", resp.StatusCode, resp.Header)
+	}
+	return conn, reader
+}
+
+// writeClientFrame sends a frame masked as clients must, unless masked is false.
+func writeClientFrame(t *testing.T, conn net.Conn, opcode byte, fin bool, masked bool, payload []byte) {
+	t.Helper()
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	frame := []byte{first}
+	maskBit := byte(0)
+	if masked {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, maskBit|126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	default:
+		frame = append(frame, maskBit|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(len(payload)))
+	}
+	data := append([]byte{}, payload...)
+	if masked {
+		mask := []byte{0x12, 0x34, 0x56, 0x78}
+		frame = append(frame, mask...)
+		for i := range data {
+			data[i] ^= mask[i%4]
+		}
+	}
+	if _, err := conn.Write(append(frame, data...)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readServerFrame reads an unmasked frame sent by the server.
+func readServerFrame(t *testing.T, reader *bufio.Reader) (byte, []byte) {
+	t.Helper()
+	var header [2]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		t.Fatal(err)
+	}
+	if header[0]&0x80 == 0 || header[1]&0x80 != 0 {
+		t.Fatalf("got frame header %x, want a final unmasked frame", header)
+	}
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		io.ReadFull(reader, ext[:])
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		io.ReadFull(reader, ext[:])
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		t.Fatal(err)
+	}
+	return header[0] & 0x0f, payload
+}
+
+// readRPCResponse reads frames until a JSON-RPC response, skipping notifications.
+func readRPCResponse(t *testing.T, reader *bufio.Reader) testAria2Response {
+	t.Helper()
+	for {
+		opcode, payload := readServerFrame(t, reader)
+		if opcode != websocketText {
+			t.Fatalf("got opcode %d, want a text frame", opcode)
+		}
+		var response testAria2Response
+		if err := json.Unmarshal(payload, &response); err != nil {
+			t.Fatalf("invalid response %s: %s", payload, err)
+		}
+		if response.ID != nil {
+			return response
+		}
+	}
+}
+
+func TestWebsocketMessages(t *testing.T) {
+	_, rpc, _ := newTestAria2(t)
+	conn, reader := dialTestWebsocket(t, rpc)
+	request := `{"jsonrpc":"2.0","id":"v","method":"aria2.getVersion","params":["token:` + testRPCSecret + `"]}`
+
+	writeClientFrame(t, conn, websocketText, true, true, []byte(request))
+	if response := readRPCResponse(t, reader); string(response.ID) != `"v"` || response.Error != nil {
+		t.Errorf("got %+v", response)
+	}
+
+	// a message fragmented in three frames, with a ping in the middle
+	writeClientFrame(t, conn, websocketText, false, true, []byte(request[:10]))
+	writeClientFrame(t, conn, websocketContinuation, false, true, []byte(request[10:30]))
+	writeClientFrame(t, conn, websocketPing, true, true, []byte("are you there"))
+	writeClientFrame(t, conn, websocketContinuation, true, true, []byte(request[30:]))
+	opcode, payload := readServerFrame(t, reader)
+	if opcode != websocketPong || string(payload) != "are you there" {
+		t.Errorf("got opcode %d %q, want the pong", opcode, payload)
+	}
+	if response := readRPCResponse(t, reader); string(response.ID) != `"v"` || response.Error != nil {
+		t.Errorf("got %+v", response)
+	}
+
+	// lengths on 16 bits, in the request and the response
+	long := `{"jsonrpc":"2.0","id":"long","method":"aria2.tellStatus","params":["token:` + testRPCSecret + `","` + strings.Repeat("0", 300) + `"]}`
+	writeClientFrame(t, conn, websocketBinary, true, true, []byte(long))
+	if response := readRPCResponse(t, reader); string(response.ID) != `"long"` || response.Error == nil {
+		t.Errorf("got %+v", response)
+	}
+
+	writeClientFrame(t, conn, websocketClose, true, true, []byte{0x03, 0xe8})
+	opcode, payload = readServerFrame(t, reader)
+	if opcode != websocketClose || string(payload) != "\x03\xe8" {
+		t.Errorf("got opcode %d %x, want the close frame echoed", opcode, payload)
+	}
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Errorf("got %v, want the connection closed", err)
+	}
+}
+
+func TestWebsocketRejectsBadFrames(t *testing.T) {
+	_, rpc, _ := newTestAria2(t)
+	for name, send := range map[string]func(conn net.Conn){
+		"unmasked": func(conn net.Conn) {
+			writeClientFrame(t, conn, websocketText, true, false, []byte(`{"jsonrpc":"2.0","id":"1","method":"system.listMethods"}`))
+		},
+		"too large": func(conn net.Conn) {
+			conn.Write([]byte{0x81, 0xff, 0, 0, 0, 0, 0x7f, 0xff, 0xff, 0xff})
+		},
+		"unknown opcode": func(conn net.Conn) {
+			writeClientFrame(t, conn, 0x3, true, true, []byte("x"))
+		},
+	} {
+		conn, reader := dialTestWebsocket(t, rpc)
+		send(conn)
+		if _, err := reader.ReadByte(); err != io.EOF {
+			t.Errorf("%s: got %v, want the connection closed", name, err)
+		}
+	}
+}
+
+func TestWebsocketNotifications(t *testing.T) {
+	manager, rpc, files := newTestAria2(t)
+	conn, reader := dialTestWebsocket(t, rpc)
+	// the connection subscribes to the jobs before it answers requests
+	writeClientFrame(t, conn, websocketText, true, true, []byte(`{"jsonrpc":"2.0","id":"1","method":"system.listMethods"}`))
+	readRPCResponse(t, reader)
+
+	job, err := manager.Add(JobRequest{URL: files.URL + "/files/notified.bin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"aria2.onDownloadStart", "aria2.onDownloadComplete"}
+	for len(want) > 0 {
+		opcode, payload := readServerFrame(t, reader)
+		var notification aria2Notification
+		if opcode != websocketText || json.Unmarshal(payload, &notification) != nil {
+			t.Fatalf("got opcode %d %s, want a notification", opcode, payload)
+		}
+		if notification.Method != want[0] || len(notification.Params) != 1 || notification.Params[0]["gid"] != job.ID {
+			t.Fatalf("got %+v, want %s for %s", notification, want[0], job.ID)
+		}
+		want = want[1:]
+	}
+}
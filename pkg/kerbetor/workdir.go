@@ -0,0 +1,198 @@
+package kerbetor
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WorkDirStatus describes the state of a download work directory, as found on disk.
+type WorkDirStatus struct {
+	Path string `json:"path"`
+	// Output is the path of the file the work directory downloads to.
+	Output    string `json:"output"`
+	URL       string `json:"url,omitempty"`
+	FileSize  uint64 `json:"file_size"`
+	ChunkSize uint64 `json:"chunk_size"`
+
+	DownloadedBytes uint64  `json:"downloaded_bytes"`
+	Percent         float64 `json:"percent"`
+	Chunks          int     `json:"chunks"`
+	CompletedChunks int     `json:"completed_chunks"`
+	PartialChunks   int     `json:"partial_chunks"`
+	// LastActivity is the last modification of the metadata or of a part file.
+	LastActivity time.Time `json:"last_activity"`
+	// Problems lists inconsistencies that prevent or endanger resuming the download.
+	Problems []string `json:"problems,omitempty"`
+}
+
+// Resumable reports whether the download can be resumed from the work directory.
+func (s *WorkDirStatus) Resumable() bool {
+	return len(s.Problems) == 0
+}
+
+// IsWorkDir reports whether path is a download work directory.
+func IsWorkDir(path string) bool {
+	if !strings.HasSuffix(path, WorkDirSuffix) {
+		return false
+	}
+	info, err := os.Stat(path)
+	return err == nil && info.IsDir()
+}
+
+// FindWorkDirs returns the work directories under root. root can also be a work directory or
+// the output path of a download.
+func FindWorkDirs(root string) ([]string, error) {
+	if IsWorkDir(root) {
+		return []string{root}, nil
+	}
+	if IsWorkDir(root + WorkDirSuffix) {
+		return []string{root + WorkDirSuffix}, nil
+	}
+	return findDirs(root, func(name string) bool { return strings.HasSuffix(name, WorkDirSuffix) })
+}
+
+// FindTorDataDirs returns the tor data directories under root left behind by kerbetor, or still
+// used by a running kerbetor.
+func FindTorDataDirs(root string) ([]string, error) {
+	return findDirs(root, func(name string) bool { return strings.HasPrefix(name, TorDataDirPrefix) })
+}
+
+// findDirs returns the directories under root whose name matches, without looking inside them.
+func findDirs(root string, match func(name string) bool) ([]string, error) {
+	var dirs []string
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			// unreadable directories are skipped
+			return nil
+		}
+		if entry.IsDir() && path != root && match(entry.Name()) {
+			dirs = append(dirs, path)
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return dirs, err
+}
+
+// InspectWorkDir reads the metadata and the part files of the work directory workPath, without
+// modifying them.
+func InspectWorkDir(workPath string) (*WorkDirStatus, error) {
+	entries, err := os.ReadDir(workPath)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read work dir %s: %s", workPath, err)
+	}
+	status := &WorkDirStatus{Path: workPath, Output: strings.TrimSuffix(workPath, WorkDirSuffix)}
+
+	partSizes := make(map[int]uint64)
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if info.ModTime().After(status.LastActivity) {
+			status.LastActivity = info.ModTime().UTC()
+		}
+		index, err := strconv.Atoi(strings.TrimSuffix(entry.Name(), ".part"))
+		if !strings.HasSuffix(entry.Name(), ".part") || err != nil {
+			continue
+		}
+		partSizes[index] = uint64(info.Size())
+	}
+
+	metadata, err := LoadWorkDirMetadata(workPath)
+	if err != nil {
+		if errors.Is(err, ErrMetadataNotFound) {
+			status.Problems = append(status.Problems, "missing "+MetadataFileName)
+		} else {
+			status.Problems = append(status.Problems, err.Error())
+		}
+		for _, size := range partSizes {
+			status.DownloadedBytes += size
+		}
+		status.Chunks = len(partSizes)
+		return status, nil
+	}
+
+	status.URL = metadata.URL
+	status.FileSize = metadata.FileSize
+	status.ChunkSize = metadata.ChunkSize
+	if metadata.UpdatedAt.After(status.LastActivity) {
+		status.LastActivity = metadata.UpdatedAt
+	}
+
+	var chunks []*Chunk
+	if len(metadata.Chunks) > 0 {
+		layout, err := chunksFromMetadata(metadata, workPath)
+		if err != nil {
+			status.Problems = append(status.Problems, fmt.Sprintf("invalid chunk layout: %s", err))
+		} else {
+			chunks = *layout
+		}
+	} else if metadata.ChunkSize > 0 {
+		chunks = *GenerateChunks(metadata.FileSize, metadata.ChunkSize, workPath)
+	}
+
+	known := make(map[int]bool, len(chunks))
+	for _, chunk := range chunks {
+		known[chunk.index] = true
+		status.Chunks++
+		size, ok := partSizes[chunk.index]
+		if !ok {
+			continue
+		}
+		expectedSize := chunk.endOffset - chunk.startOffset + 1
+		switch {
+		case size == expectedSize:
+			status.CompletedChunks++
+			status.DownloadedBytes += size
+		case size > expectedSize:
+			status.Problems = append(status.Problems, fmt.Sprintf("%d.part is larger than its chunk (%d > %d bytes)", chunk.index, size, expectedSize))
+		case size > 0:
+			status.PartialChunks++
+			status.DownloadedBytes += size
+		}
+	}
+
+	var unknown []int
+	for index := range partSizes {
+		if !known[index] && len(chunks) > 0 {
+			unknown = append(unknown, index)
+		}
+	}
+	sort.Ints(unknown)
+	for _, index := range unknown {
+		status.Problems = append(status.Problems, fmt.Sprintf("%d.part does not belong to any chunk", index))
+	}
+
+	if status.FileSize > 0 {
+		status.Percent = float64(status.DownloadedBytes) * 100 / float64(status.FileSize)
+	}
+	return status, nil
+}
+
+// clearWorkDir removes the chunks and metadata of the work directory workPath, keeping its lock.
+func clearWorkDir(workPath string) error {
+	entries, err := os.ReadDir(workPath)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Name() == LockFileName {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(workPath, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
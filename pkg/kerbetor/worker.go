@@ -1,45 +1,88 @@
 package kerbetor
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"sync"
 	"time"
 
 	"github.com/dustin/go-humanize"
 	"github.com/sirupsen/logrus"
-	"github.com/vbauerster/mpb/v8"
 )
 
 type TorInstanceWorker struct {
 	workerIndex uint
-	torInstance *TorInstance
-	inChunkCh   chan *Chunk
+	// mirrors chooses the URL each chunk is fetched from
+	mirrors *mirrorSet
+	header  http.Header
+	// stream downloads the file in a single chunk without ranges, see ChunkRequest.Stream
+	stream bool
+	// pieces verifies completed chunks when the piece hashes of the file are known
+	pieces *pieceVerifier
+	// pool provides a circuit for each chunk; when nil, httpClient is used directly
+	pool       *CircuitPool
+	httpClient *http.Client
+	controller *ChunkController
+	abort      context.CancelCauseFunc
+	logger     logrus.FieldLogger
+	progress   ProgressSink
 }
 
 const (
-	maxChunkRetries = 3
-	chunkRetryDelay = 2 * time.Second
+	maxChunkAttempts = 3
+	chunkRetryDelay  = 2 * time.Second
 )
 
-func (w *TorInstanceWorker) NewChunkProgressBar(chunk *Chunk, p *mpb.Progress) *mpb.Bar {
-	return NewProgressBar(p, fmt.Sprintf("[W%d] Chunk #%d ...", w.workerIndex, chunk.index), chunk.endOffset-chunk.startOffset, int(w.workerIndex))
-}
+var (
+	// errCircuitDown marks downloads that failed because the tor serving them went down.
+	errCircuitDown = errors.New("tor circuit went down")
+	// errMirrorFailed marks downloads that failed on a mirror while other mirrors are in use.
+	errMirrorFailed = errors.New("mirror failed")
+)
 
-func (w *TorInstanceWorker) downloadChunkOnce(chunk *Chunk, bar *mpb.Bar) error {
-	var bytesDownloaded chan uint64
-	var errors chan error
-	if w.torInstance == nil {
-		bytesDownloaded, errors = DownloadFileChunkAsync(chunk.remoteUrl, chunk.chunkPath, chunk.startOffset, chunk.endOffset, nil)
-	} else {
-		bytesDownloaded, errors = w.torInstance.TorDownloadFileChunkAsync(chunk.remoteUrl, chunk.chunkPath, chunk.startOffset, chunk.endOffset)
+func (w *TorInstanceWorker) downloadChunkOnce(ctx context.Context, chunk *Chunk) error {
+	startOffset, endOffset := w.controller.ChunkRange(chunk)
+	source, err := w.mirrors.Acquire()
+	if err != nil {
+		return err
+	}
+	chunkReq := ChunkRequest{
+		URL:             source.url,
+		DestinationPath: chunk.chunkPath,
+		StartOffset:     startOffset,
+		EndOffset:       endOffset,
+		IfRange:         source.ifRange,
+		Header:          w.header,
+		Stream:          w.stream,
+		Claim: func(offset uint64, n uint64) uint64 {
+			return w.controller.Claim(chunk, offset, n)
+		},
 	}
 
+	httpClient := w.httpClient
+	var circuit *TorInstance
+	if w.pool != nil {
+		if circuit, err = w.pool.Acquire(); err != nil {
+			w.mirrors.Cancel(source)
+			return err
+		}
+		httpClient = w.pool.Client(circuit)
+		w.logger.Debug("Worker #", w.workerIndex, ". Using TOR instance ", circuit.Name(), " and ", source.url, " for chunk ", chunk.index)
+	}
+	startTime := time.Now()
+	var firstBytes, lastBytes uint64
+	firstUpdate := true
+
+	bytesDownloaded, downloadErrors := DownloadFileChunkAsync(ctx, chunkReq, httpClient)
+
 	var downloadErr error
-	for bytesDownloaded != nil || errors != nil {
+	for bytesDownloaded != nil || downloadErrors != nil {
 		select {
-		case err, ok := <-errors:
+		case err, ok := <-downloadErrors:
 			if !ok {
-				errors = nil
+				downloadErrors = nil
 				continue
 			}
 			if err != nil {
@@ -50,52 +93,183 @@ func (w *TorInstanceWorker) downloadChunkOnce(chunk *Chunk, bar *mpb.Bar) error
 				bytesDownloaded = nil
 				continue
 			}
-			chunk.bytesDownloaded = recvBytesDownloaded
-			logrus.Debug("Worker #", w.workerIndex, ". Got bytesDownloaded update from channel: ", chunk.bytesDownloaded, " [", humanize.Bytes(uint64(chunk.bytesDownloaded)), "]")
-			bar.SetCurrent(int64(chunk.bytesDownloaded))
+			if firstUpdate {
+				firstBytes, firstUpdate = recvBytesDownloaded, false
+				startTime = time.Now()
+			}
+			lastBytes = recvBytesDownloaded
+			w.controller.SetChunkProgress(chunk, recvBytesDownloaded)
+			w.logger.Debug("Worker #", w.workerIndex, ". Got bytesDownloaded update from channel: ", recvBytesDownloaded, " [", humanize.Bytes(recvBytesDownloaded), "]")
+			w.progress.ChunkProgress(w.workerIndex, chunk.index, recvBytesDownloaded)
 		}
 	}
 
+	circuitDown := circuit != nil && downloadErr != nil && !circuit.Alive()
+	wrongSource := errors.Is(downloadErr, ErrRemoteFileChanged) || errors.Is(downloadErr, ErrRangeNotSupported)
+	if circuit != nil {
+		circuitErr := downloadErr
+		if ctx.Err() != nil || wrongSource || circuitDown {
+			// not the circuit's fault, or tor is being restarted anyway
+			circuitErr = nil
+		}
+		w.pool.Release(circuit, lastBytes-firstBytes, time.Since(startTime), circuitErr)
+	}
+	mirrorErr := downloadErr
+	if ctx.Err() != nil || wrongSource || circuitDown {
+		mirrorErr = nil
+	}
+	w.mirrors.Release(source, lastBytes-firstBytes, time.Since(startTime), mirrorErr)
+
+	if circuitDown {
+		return fmt.Errorf("%w: %s", errCircuitDown, downloadErr)
+	}
+	if wrongSource && w.mirrors.Drop(source, downloadErr.Error()) {
+		// the file changed, or ranges are not supported, on this mirror only as far as we know
+		return fmt.Errorf("%w: %s", errMirrorFailed, downloadErr)
+	}
+	if mirrorErr != nil && w.mirrors.Alternatives(source) {
+		return fmt.Errorf("%w: %s: %s", errMirrorFailed, source.url, downloadErr)
+	}
 	return downloadErr
 }
 
-func (w *TorInstanceWorker) DownloadWorker(wg *sync.WaitGroup, p *mpb.Progress) {
+// DownloadWorker takes chunks from the shared queue of the chunk controller until it is empty.
+// A chunk that fails goes back in the queue, so that it can be retried by any worker.
+func (w *TorInstanceWorker) DownloadWorker(ctx context.Context, wg *sync.WaitGroup) {
 	defer wg.Done()
 
-	if w.torInstance != nil {
-		logrus.Debug("Started worker ", w.workerIndex, " w/ TOR instance ", w.torInstance.port, "...")
+	if w.pool != nil {
+		w.logger.Debug("Started worker ", w.workerIndex, " w/ ", w.pool.Len(), " TOR instances...")
 	} else {
-		logrus.Debug("Started worker ", w.workerIndex, " w/out a TOR instance...")
+		w.logger.Debug("Started worker ", w.workerIndex, " w/out a TOR instance...")
 	}
-	for chunk := range w.inChunkCh {
-		logrus.Debug(fmt.Sprintf("Worker #%d. Downloading chunk %d (%d-%d) to %s", w.workerIndex, chunk.index, chunk.startOffset, chunk.endOffset, chunk.chunkPath))
-
-		// create chunk progressbar
-		bar := w.NewChunkProgressBar(chunk, p)
-		if chunk.bytesDownloaded > 0 {
-			bar.SetCurrent(int64(chunk.bytesDownloaded))
+	for {
+		chunk := w.controller.NextChunk(ctx)
+		if chunk == nil {
+			return
 		}
+		startOffset, endOffset := w.controller.ChunkRange(chunk)
+		w.logger.Debug(fmt.Sprintf("Worker #%d. Downloading chunk %d (%d-%d) to %s", w.workerIndex, chunk.index, startOffset, endOffset, chunk.chunkPath))
 
-		var lastErr error
-		for attempt := 1; attempt <= maxChunkRetries; attempt++ {
-			if attempt > 1 {
-				logrus.Warnf("Retrying chunk %d (attempt %d/%d) after error: %v", chunk.index, attempt, maxChunkRetries, lastErr)
-				time.Sleep(chunkRetryDelay)
+		w.progress.ChunkStarted(w.workerIndex, chunk.index, endOffset-startOffset+1, chunk.bytesDownloaded)
+		err := w.downloadChunkOnce(ctx, chunk)
+		if err == nil {
+			w.logger.Debug("Chunk #", chunk.index, ". Download completed.")
+			err = w.controller.CompleteChunk(chunk)
+			if err == nil && w.pieces != nil {
+				startOffset, endOffset = w.controller.ChunkRange(chunk)
+				if err = w.repairPieces(ctx, startOffset, endOffset); ctx.Err() != nil {
+					// the pieces are verified again when the download resumes
+					err = nil
+				}
+			}
+			if err != nil {
+				w.logger.Error("cannot complete chunk: ", err)
+				w.controller.SetChunkStatus(chunk, ChunkStatusError, err)
 			}
+			w.progress.ChunkFinished(w.workerIndex, chunk.index, err)
+			continue
+		}
+		w.progress.ChunkFinished(w.workerIndex, chunk.index, err)
 
-			lastErr = w.downloadChunkOnce(chunk, bar)
-			if lastErr == nil {
-				logrus.Debug("Chunk #", chunk.index, ". Download completed.")
-				chunk.status = ChunkStatusCompleted
-				break
+		if ctx.Err() != nil {
+			w.logger.Debug("Chunk #", chunk.index, ". Download cancelled.")
+			w.controller.SetChunkStatus(chunk, ChunkStatusNotStarted, err)
+			return
+		}
+		if errors.Is(err, ErrRemoteFileChanged) || errors.Is(err, ErrRangeNotSupported) {
+			// retrying cannot help, stop the whole download. Without ranges it starts over as a
+			// single stream
+			w.controller.SetChunkStatus(chunk, ChunkStatusError, err)
+			w.abort(err)
+			return
+		}
+
+		if errors.Is(err, errCircuitDown) {
+			// switch to another circuit right away, keeping what was downloaded
+			w.logger.Warnf("Chunk %d interrupted on worker %d, tor went down. Retrying on another circuit", chunk.index, w.workerIndex)
+			w.controller.ReturnChunk(chunk, err)
+			if !w.pool.Available() {
+				// wait for a tor to be restarted
+				select {
+				case <-time.After(chunkRetryDelay):
+				case <-ctx.Done():
+					return
+				}
 			}
+			continue
+		}
+
+		if errors.Is(err, errMirrorFailed) {
+			// another mirror can serve the chunk, keeping what was downloaded
+			w.logger.Warnf("Chunk %d failed on worker %d: %v. Retrying on another mirror", chunk.index, w.workerIndex, err)
+			w.controller.ReturnChunk(chunk, err)
+			continue
+		}
+
+		w.logger.Warnf("Chunk %d failed on worker %d (attempt %d/%d): %v", chunk.index, w.workerIndex, chunk.attempts, maxChunkAttempts, err)
+		w.controller.RequeueChunk(chunk, err, maxChunkAttempts)
+
+		// give other workers a chance to pick up the chunk before this one asks for work again
+		select {
+		case <-time.After(chunkRetryDelay):
+		case <-ctx.Done():
+			return
 		}
+	}
+}
 
-		if chunk.status != ChunkStatusCompleted {
-			logrus.Error("cannot download chunk: ", lastErr)
-			chunk.status = ChunkStatusError
+// repairPieces verifies the pieces lying entirely within start-end and downloads the bad ones
+// again, until they match or maxChunkAttempts is reached.
+func (w *TorInstanceWorker) repairPieces(ctx context.Context, start uint64, end uint64) error {
+	for attempt := 1; ; attempt++ {
+		bad, err := w.pieces.Verify(w.controller, start, end)
+		if err != nil || len(bad) == 0 {
+			return err
 		}
+		if attempt > maxChunkAttempts {
+			return fmt.Errorf("piece %d does not match its %s hash", bad[0], w.pieces.pieces.Algorithm)
+		}
+		for _, piece := range bad {
+			pieceStart, pieceEnd := w.pieces.Range(piece)
+			w.logger.Warnf("Piece %d (%d-%d) is corrupted, downloading it again", piece, pieceStart, pieceEnd)
+			if err := w.downloadRange(ctx, pieceStart, pieceEnd); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				w.logger.Warn("Cannot download piece ", piece, ": ", err)
+			}
+		}
+	}
+}
 
-		bar.Abort(true)
+// downloadRange downloads the bytes start to end again over the completed chunks holding them.
+func (w *TorInstanceWorker) downloadRange(ctx context.Context, start uint64, end uint64) error {
+	source, err := w.mirrors.Acquire()
+	if err != nil {
+		return err
+	}
+	httpClient := w.httpClient
+	var circuit *TorInstance
+	if w.pool != nil {
+		if circuit, err = w.pool.Acquire(); err != nil {
+			w.mirrors.Cancel(source)
+			return err
+		}
+		httpClient = w.pool.Client(circuit)
+	}
+	startTime := time.Now()
+	data, err := fetchRange(ctx, source.url, w.header, source.ifRange, start, end, httpClient)
+	releaseErr := err
+	if ctx.Err() != nil || errors.Is(err, ErrRemoteFileChanged) || errors.Is(err, ErrRangeNotSupported) {
+		releaseErr = nil
+	}
+	if circuit != nil {
+		w.pool.Release(circuit, uint64(len(data)), time.Since(startTime), releaseErr)
+	}
+	w.mirrors.Release(source, uint64(len(data)), time.Since(startTime), releaseErr)
+	if err != nil {
+		return err
 	}
+	return w.controller.writeRange(start, data)
 }